@@ -0,0 +1,297 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ErrBackupObjectNotFound means the object does not exist in the backup store
+var ErrBackupObjectNotFound = errors.New("Backup object not found")
+
+// BackupStore is the storage target of backups. Objects are identified by
+// slash separated names relative to the root of the backup.
+// BackupStore implementations should be safe for concurrent use.
+type BackupStore interface {
+	// Create creates or truncates an object. The object is complete and
+	// durable once the returned writer is closed without an error.
+	Create(name string) (io.WriteCloser, error)
+	// Open opens an object for reading
+	Open(name string) (BackupObject, error)
+	// List returns the sorted names of objects with the prefix
+	List(prefix string) ([]string, error)
+	Delete(name string) error
+	// Commit atomically creates or replaces an object. It is used for
+	// manifests which describe the rest of the backup.
+	Commit(name string, data []byte) error
+}
+
+// BackupObject is an object opened for reading from a backup store
+type BackupObject interface {
+	io.ReadCloser
+	Size() int64
+}
+
+// readObject returns the contents of a backup store object
+func readObject(store BackupStore, name string) ([]byte, error) {
+	obj, err := store.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+
+	return ioutil.ReadAll(obj)
+}
+
+type dirBackupStore struct {
+	dir string
+}
+
+// NewDirBackupStore returns a backup store which keeps objects as files
+// under a local directory
+func NewDirBackupStore(dir string) BackupStore {
+	return &dirBackupStore{dir: dir}
+}
+
+func (s *dirBackupStore) path(name string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(name))
+}
+
+func (s *dirBackupStore) Create(name string) (io.WriteCloser, error) {
+	p := s.path(name)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return nil, err
+	}
+
+	fd, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	return &syncedFile{File: fd}, nil
+}
+
+// syncedFile makes the file and its directory entry durable when it is closed
+// so that a committed manifest never refers to torn or missing objects
+type syncedFile struct {
+	*os.File
+}
+
+func (f *syncedFile) Close() error {
+	err := f.File.Sync()
+	if cerr := f.File.Close(); err == nil {
+		err = cerr
+	}
+
+	if err == nil {
+		err = syncDir(filepath.Dir(f.Name()))
+	}
+
+	return err
+}
+
+type fileObject struct {
+	*os.File
+	size int64
+}
+
+func (f *fileObject) Size() int64 {
+	return f.size
+}
+
+func (s *dirBackupStore) Open(name string) (BackupObject, error) {
+	fd, err := os.Open(s.path(name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = ErrBackupObjectNotFound
+		}
+		return nil, err
+	}
+
+	fi, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+
+	return &fileObject{File: fd, size: fi.Size()}, nil
+}
+
+func (s *dirBackupStore) List(prefix string) ([]string, error) {
+	var names []string
+	err := filepath.Walk(s.dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		if !fi.IsDir() {
+			rel, _ := filepath.Rel(s.dir, p)
+			if name := filepath.ToSlash(rel); strings.HasPrefix(name, prefix) {
+				names = append(names, name)
+			}
+		}
+
+		return nil
+	})
+
+	sort.Strings(names)
+	return names, err
+}
+
+func (s *dirBackupStore) Delete(name string) error {
+	err := os.Remove(s.path(name))
+	if os.IsNotExist(err) {
+		err = ErrBackupObjectNotFound
+	}
+	return err
+}
+
+// Commit writes the object into a temporary file and renames it after
+// syncing, so that readers either find the old or the new object.
+func (s *dirBackupStore) Commit(name string, data []byte) error {
+	p := s.path(name)
+	dir := filepath.Dir(p)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(dir, "."+filepath.Base(p)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err == nil {
+		err = os.Rename(f.Name(), p)
+	}
+
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+type memBackupStore struct {
+	sync.Mutex
+	objects map[string][]byte
+}
+
+// NewMemBackupStore returns a backup store which keeps objects in memory.
+// It is meant for tests.
+func NewMemBackupStore() BackupStore {
+	return &memBackupStore{objects: make(map[string][]byte)}
+}
+
+type memObjectWriter struct {
+	bytes.Buffer
+	store *memBackupStore
+	name  string
+}
+
+func (w *memObjectWriter) Close() error {
+	w.store.Commit(w.name, w.Bytes())
+	return nil
+}
+
+func (s *memBackupStore) Create(name string) (io.WriteCloser, error) {
+	return &memObjectWriter{store: s, name: path.Clean(name)}, nil
+}
+
+type memObject struct {
+	*bytes.Reader
+}
+
+func (o memObject) Size() int64 {
+	return o.Reader.Size()
+}
+
+func (o memObject) Close() error {
+	return nil
+}
+
+func (s *memBackupStore) Open(name string) (BackupObject, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	data, ok := s.objects[path.Clean(name)]
+	if !ok {
+		return nil, ErrBackupObjectNotFound
+	}
+
+	return memObject{bytes.NewReader(data)}, nil
+}
+
+func (s *memBackupStore) List(prefix string) ([]string, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	var names []string
+	for name := range s.objects {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *memBackupStore) Delete(name string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	name = path.Clean(name)
+	if _, ok := s.objects[name]; !ok {
+		return ErrBackupObjectNotFound
+	}
+
+	delete(s.objects, name)
+	return nil
+}
+
+func (s *memBackupStore) Commit(name string, data []byte) error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.objects[path.Clean(name)] = append([]byte(nil), data...)
+	return nil
+}
@@ -1,13 +1,16 @@
 package nitro
 
 import (
-	"bytes"
 	"fmt"
 	"github.com/t3rm1n4l/nitro/skiplist"
 	"unsafe"
 )
 
-const blockSize = 4096
+const (
+	defaultBlockSize = 4096
+	minBlockSize     = 4096
+	maxBlockSize     = 1024 * 1024
+)
 
 type itemOp int
 
@@ -17,9 +20,14 @@ const (
 )
 
 type diskWriter struct {
-	shard      int
-	w          *Writer
-	rbuf, wbuf []byte
+	shard  int
+	w      *Writer
+	rbuf   []byte
+	obuf   []byte
+	wblock *dataBlock
+
+	// Index changes which are not journaled yet
+	changes []blockIndexChange
 
 	stats BatchOpStats
 }
@@ -54,11 +62,22 @@ func (r *BatchOpStats) ApplyDiff(a, b BatchOpStats) {
 
 func (m *Nitro) newDiskWriter(shard int) *diskWriter {
 	return &diskWriter{
-		rbuf:  make([]byte, blockSize),
-		wbuf:  make([]byte, blockSize),
-		w:     m.NewWriter(),
-		shard: shard,
+		rbuf:   make([]byte, m.blockSize),
+		obuf:   make([]byte, m.blockSize),
+		wblock: m.newBlockWriter(),
+		w:      m.NewWriter(),
+		shard:  shard,
+	}
+}
+
+// newBlockWriter returns a data block for writing blocks, which are
+// compressed if a block compression codec is configured
+func (m *Nitro) newBlockWriter() *dataBlock {
+	if m.blockCodec != nil {
+		return newCompressedDataBlock(m.blockSize, m.blockCodec)
 	}
+
+	return newDataBlock(make([]byte, m.blockSize), nil)
 }
 
 type nodeOpIterator struct {
@@ -109,77 +128,113 @@ func (dw *diskWriter) batchModifyCallback(n *skiplist.Node, cmp skiplist.Compare
 
 	opItr := sOpItr.(BatchOpIterator)
 
+	// Deleted data blocks and their overflow blocks should not be freed
+	// until the items of the block are rewritten
+	barrier := dw.w.store.GetAccesBarrier()
+	token := barrier.Acquire()
+	defer barrier.Release(token)
+
+	// Index node of a corrupted block is retained
 	if n.Item() != skiplist.MinItem {
-		dw.w.DeleteNode(n)
-		dw.stats.BlocksRemoved++
-		err := dw.w.bm.ReadBlock(blockPtr(n.DataPtr), dw.rbuf)
-		if err != nil {
+		if db, err = readDataBlock(dw.w.bm, blockPtr(n.DataPtr), dw.rbuf); err != nil {
 			return err
 		}
-		db = newDataBlock(dw.rbuf)
+		dw.recordIndexChange((*Item)(n.Item()).Key(), 0, true)
+		dw.w.DeleteNode(n)
+		dw.stats.BlocksRemoved++
 	}
 
-	wblock := newDataBlock(dw.wbuf)
+	wblock := dw.wblock
+	wblock.Clear()
 
+	// Entries which do not fit into a compressed block are retained for the
+	// next block
 	flushBlock := func() error {
 		bptr, err := dw.w.bm.WriteBlock(wblock.Bytes(), dw.shard)
 		if err == nil {
+			if wblock.HasOverflow() {
+				bptr |= blockPtrOverflow
+			}
+
 			indexNode := dw.w.Put2(indexItem)
 			if indexNode == nil {
 				panic("index node creation should not fail")
 			}
 			indexNode.DataPtr = uint64(bptr)
+			dw.recordIndexChange(indexItem, bptr, false)
 			wblock.Reset()
+			indexItem = wblock.FirstKey()
 			dw.stats.BlocksWritten++
 		}
 
 		return err
 	}
 
-	doWriteItem := func(itm []byte) error {
+	doWriteItem := func(key, val []byte) error {
 		if indexItem == nil {
-			indexItem = itm
+			indexItem = key
 		}
 
 		dw.stats.ItemsWritten++
-		if err := wblock.Write(itm); err == errBlockFull {
-			if err := flushBlock(); err != nil {
+		write := func() error {
+			return wblock.Write(key, val)
+		}
+
+		// Items which cannot fit into a block are spilled into a chain
+		// of overflow blocks
+		if wblock.IsOverflow(key, val) {
+			data := append(append([]byte(nil), key...), val...)
+			bptr, err := writeOverflow(dw.w.bm, dw.shard, data, dw.obuf)
+			if err != nil {
 				return err
 			}
 
-			indexItem = itm
-			return wblock.Write(itm)
+			write = func() error {
+				return wblock.WriteOverflow(key, len(data), len(val), bptr)
+			}
 		}
 
-		return nil
+		err := write()
+		for err == errBlockFull {
+			if err = flushBlock(); err != nil {
+				return err
+			}
+
+			if indexItem == nil {
+				indexItem = key
+			}
+			err = write()
+		}
+
+		return err
 	}
 
-	var nItm []byte
-	for nItm = db.Get(); err == nil && opItr.Valid() &&
-		skiplist.Compare(cmp, opItr.Item(), maxItem) < 0 && nItm != nil; {
-		opItm := (*Item)(opItr.Item()).Bytes()
-		cmpval := bytes.Compare(nItm, opItm)
+	var nKey, nVal []byte
+	for nKey, nVal = db.Get(); err == nil && opItr.Valid() &&
+		skiplist.Compare(cmp, opItr.Item(), maxItem) < 0 && nKey != nil; {
+		opItm := (*Item)(opItr.Item())
+		cmpval := dw.w.keyCmp(nKey, opItm.Key())
 		switch {
 		case cmpval < 0:
-			err = doWriteItem(nItm)
-			nItm = db.Get()
+			err = doWriteItem(nKey, nVal)
+			nKey, nVal = db.Get()
 			break
 		case cmpval == 0:
 			if opItr.Op() == itemInsertop {
-				err = doWriteItem(opItm)
+				err = doWriteItem(opItm.Key(), opItm.Value())
 			} else {
 				dw.stats.ItemsRemoved++
 			}
 
 			opItr.Next()
-			nItm = db.Get()
+			nKey, nVal = db.Get()
 			break
 		default:
 			if opItr.Op() == itemInsertop {
-				err = doWriteItem(opItm)
+				err = doWriteItem(opItm.Key(), opItm.Value())
 				dw.stats.ItemsInserted++
-				opItr.Next()
 			}
+			opItr.Next()
 		}
 	}
 
@@ -187,25 +242,29 @@ func (dw *diskWriter) batchModifyCallback(n *skiplist.Node, cmp skiplist.Compare
 		skiplist.Compare(cmp, opItr.Item(), maxItem) < 0; opItr.Next() {
 
 		if opItr.Op() == itemInsertop {
-			opItm := (*Item)(opItr.Item()).Bytes()
-			err = doWriteItem(opItm)
+			opItm := (*Item)(opItr.Item())
+			err = doWriteItem(opItm.Key(), opItm.Value())
 			dw.stats.ItemsInserted++
 		}
 	}
 
-	for ; err == nil && nItm != nil; nItm = db.Get() {
-		err = doWriteItem(nItm)
+	for ; err == nil && nKey != nil; nKey, nVal = db.Get() {
+		err = doWriteItem(nKey, nVal)
+	}
+
+	if err == nil {
+		err = db.Err()
 	}
 
 	if err != nil {
 		return err
 	}
 
-	if !wblock.IsEmpty() {
-		return flushBlock()
+	for err == nil && !wblock.IsEmpty() {
+		err = flushBlock()
 	}
 
-	return nil
+	return err
 }
 
 type batchOpIterator struct {
@@ -216,9 +275,7 @@ type batchOpIterator struct {
 
 func (it *batchOpIterator) fillItem() {
 	srcItm := (*Item)(it.BatchOpIterator.Item())
-	l := len(srcItm.Bytes())
-	dstItm := it.db.allocItem(l, false)
-	copy(dstItm.Bytes(), srcItm.Bytes())
+	dstItm := it.db.newKVItem(srcItm.Key(), srcItm.Value(), false)
 	dstItm.bornSn = it.db.getCurrSn()
 	it.itm = unsafe.Pointer(dstItm)
 }
@@ -257,10 +314,18 @@ func (m *Nitro) newBatchOpIterator(it *Iterator) BatchOpIterator {
 	return bItr
 }
 
+// ApplyOps rewrites the blocks of the block store which are modified by the
+// items of the snapshot. The changes are durable once ApplyOps returns
+// successfully. The written blocks are synced and the index changes are
+// appended to the block index journal. The block index is rewritten only
+// when the journal outgrows it and when the Nitro instance is closed.
 func (m *Nitro) ApplyOps(snap *Snapshot, concurr int) (BatchOpStats, error) {
 	var err error
 	var stats BatchOpStats
 
+	m.batchLock.Lock()
+	defer m.batchLock.Unlock()
+
 	w := m.NewWriter()
 	currSnap := &Snapshot{db: m, sn: m.getCurrSn(), refCount: 1}
 	pivots := m.partitionPivots(currSnap, concurr)
@@ -273,12 +338,12 @@ func (m *Nitro) ApplyOps(snap *Snapshot, concurr int) (BatchOpStats, error) {
 		beforeStats[i] = m.shardWrs[i].stats
 
 		itr := snap.NewIterator()
-		itr.Seek(pivots[i].Bytes())
-		itr.SetEnd(pivots[i+1].Bytes())
+		itr.Seek(pivots[i].Key())
+		itr.SetEnd(pivots[i+1].Key())
 		opItr := m.newBatchOpIterator(itr)
 		defer opItr.Close()
-		head := w.GetNode(pivots[i].Bytes())
-		tail := w.GetNode(pivots[i+1].Bytes())
+		head := w.GetNode(pivots[i].Key())
+		tail := w.GetNode(pivots[i+1].Key())
 
 		if pivots[i] == nil {
 			head = nil
@@ -301,5 +366,98 @@ func (m *Nitro) ApplyOps(snap *Snapshot, concurr int) (BatchOpStats, error) {
 		stats.ApplyDiff(m.shardWrs[i].stats, beforeStats[i])
 	}
 
+	if err == nil {
+		err = m.persistBlockIndexChanges()
+	}
+
 	return stats, err
 }
+
+// emptyOpIterator is used for rewriting blocks without modifying their items
+type emptyOpIterator struct{}
+
+func (emptyOpIterator) Next()                {}
+func (emptyOpIterator) Valid() bool          { return false }
+func (emptyOpIterator) Item() unsafe.Pointer { return nil }
+func (emptyOpIterator) Op() itemOp           { return itemInsertop }
+func (emptyOpIterator) Close()               {}
+
+// RotateBlockKeys rewrites the block store blocks which are not encrypted
+// using the current key of the key provider. Blocks are rewritten into new
+// blocks as in ApplyOps. Hence, it can run in the background along with
+// readers and ApplyOps. Replaced blocks are freed once they are garbage
+// collected after the next snapshot. The number of rewritten blocks is
+// returned.
+func (m *Nitro) RotateBlockKeys() (int64, error) {
+	var count int64
+
+	fbm, ok := m.bm.(*fileBlockManager)
+	if !ok || fbm.crypt == nil {
+		return 0, fmt.Errorf("Block store encryption is not enabled")
+	}
+
+	id, err := m.crypt.currentKey()
+	if err != nil {
+		return 0, err
+	}
+
+	buf := m.store.MakeBuf()
+	defer m.store.FreeBuf(buf)
+	bbuf := make([]byte, m.blockSize)
+
+	isStale := func(bptr blockPtr) (bool, error) {
+		ptrs := []blockPtr{bptr}
+		if bptr.HasOverflow() {
+			optrs, err := overflowBlocks(fbm, bptr, bbuf)
+			if err != nil {
+				return false, err
+			}
+			ptrs = append(ptrs, optrs...)
+		}
+
+		for _, ptr := range ptrs {
+			if keyID, err := fbm.blockKeyID(ptr); err != nil || keyID != id {
+				return err == nil, err
+			}
+		}
+
+		return false, nil
+	}
+
+	rotate := func(n *skiplist.Node) error {
+		m.batchLock.Lock()
+		defer m.batchLock.Unlock()
+
+		// The block may have been rewritten by ApplyOps
+		if !isValidNode(n) {
+			return nil
+		}
+
+		stale, err := isStale(blockPtr(n.DataPtr))
+		if err != nil || !stale {
+			return err
+		}
+
+		dw := m.shardWrs[blockPtr(n.DataPtr).Shard()%len(m.shardWrs)]
+		if err := dw.batchModifyCallback(n, m.insCmp, nil, emptyOpIterator{}); err != nil {
+			return err
+		}
+
+		count++
+		return nil
+	}
+
+	itr := m.store.NewIterator(m.iterCmp, buf)
+	defer itr.Close()
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		if n := itr.GetNode(); isValidNode(n) {
+			if err := rotate(n); err != nil {
+				return count, err
+			}
+		}
+	}
+
+	m.batchLock.Lock()
+	defer m.batchLock.Unlock()
+	return count, m.persistBlockIndex()
+}
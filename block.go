@@ -3,91 +3,631 @@ package nitro
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"hash/crc32"
 )
 
-var (
-	errBlockFull = errors.New("Block full")
-)
+var errBlockFull = errors.New("Block full")
+
+// BlockCorruptionError describes a block store block which failed verification
+type BlockCorruptionError struct {
+	Shard  int
+	Offset int64
+	Reason string
+}
+
+func (e *BlockCorruptionError) Error() string {
+	return fmt.Sprintf("Block %d:%d is corrupted: %s", e.Shard, e.Offset, e.Reason)
+}
+
+func blockCorruption(bptr blockPtr, reason string) error {
+	return &BlockCorruptionError{Shard: bptr.Shard(), Offset: bptr.Offset(), Reason: reason}
+}
 
 type blockPtr uint64
 
+// Data blocks are stored in [2 byte format version][1 byte codec id]
+// [1 byte reserved][4 byte entry count][4 byte entries len][4 byte crc32c]
+// [entries] format. The checksum covers the header with a zero checksum and
+// the entries. Entries of a block with a codec id other than NoCodec are
+// compressed and the entries len is the compressed length.
+// Block entries are stored in [2 byte len][2 byte value len][key][value] format
+//
+// Items which do not fit into an empty block are stored in a chain of overflow
+// blocks. Their block entry is stored in [2 byte 0xffff][2 byte reserved]
+// [4 byte len][4 byte value len][8 byte first overflow block ptr] format.
+// Overflow blocks are stored in [4 byte payload len][4 byte has next]
+// [8 byte next block ptr][4 byte crc32c][payload] format. The checksum covers
+// the header fields before it and the payload.
+const (
+	dataBlockVersion     = 1
+	dataBlockHdrSize     = 16
+	blockEntryHdrSize    = 4
+	overflowEntryLen     = 0xffff
+	overflowEntrySize    = blockEntryHdrSize + 16
+	overflowBlockHdrSize = 20
+
+	// Uncompressed entries of a compressed block are limited to a multiple
+	// of the block size
+	maxBlockCompression = 8
+)
+
 type dataBlock struct {
 	buf    []byte
 	offset int
+	// End of the entries of a verified block
+	end   int
+	count int
+	// Size of the written block
+	size int
+
+	// Block manager for reading overflow items
+	bm          BlockManager
+	hasOverflow bool
+	err         error
+
+	comp *blockCompressor
 }
 
-func newDataBlock(bs []byte) *dataBlock {
+// blockCompressor tracks the entries of a block being written which fit into
+// the block once compressed. Entries beyond the limit are compressed to check
+// whether they fit. Entries which are found not to fit while the block is
+// compressed are carried over to the next block.
+type blockCompressor struct {
+	codec Codec
+	limit int
+	keys  [][]byte
+
+	// Entries upto the fit offset fit into the block. Their compressed
+	// form is in cbuf if they do not fit uncompressed.
+	fitOffset     int
+	fitCount      int
+	fitOverflow   bool
+	fitCompressed bool
+	cbuf, tbuf    []byte
+	out           []byte
+
+	// Number of entries in the block returned by Bytes
+	written int
+}
+
+func newDataBlock(bs []byte, bm BlockManager) *dataBlock {
 	return &dataBlock{
-		buf: bs[:cap(bs)],
+		buf:    bs[:cap(bs)],
+		offset: dataBlockHdrSize,
+		end:    dataBlockHdrSize,
+		size:   cap(bs),
+		bm:     bm,
 	}
 }
 
-func (db *dataBlock) Get() []byte {
-	if db == nil {
-		return nil
+// newCompressedDataBlock returns a data block for writing blocks of the size
+// compressed using the codec
+func newCompressedDataBlock(size int, codec Codec) *dataBlock {
+	db := newDataBlock(make([]byte, size*maxBlockCompression), nil)
+	db.size = size
+	db.comp = &blockCompressor{
+		codec: codec,
+		out:   make([]byte, 0, size),
+	}
+	db.Clear()
+
+	return db
+}
+
+// readDataBlock reads a data block and verifies its header, checksum and
+// entries. Entries of the block are available only after the verification.
+func readDataBlock(bm BlockManager, bptr blockPtr, buf []byte) (*dataBlock, error) {
+	if err := bm.ReadBlock(bptr, buf); err != nil {
+		return nil, err
+	}
+
+	db := newDataBlock(buf, bm)
+	if err := db.verify(bptr); err != nil {
+		return nil, err
+	}
+
+	return db, nil
+}
+
+func (db *dataBlock) verify(bptr blockPtr) error {
+	hdr := db.buf[:dataBlockHdrSize]
+	if v := binary.BigEndian.Uint16(hdr[0:2]); v != dataBlockVersion {
+		return blockCorruption(bptr, fmt.Sprintf("unsupported format version %d", v))
+	}
+
+	codecID := hdr[2]
+
+	count := int(binary.BigEndian.Uint32(hdr[4:8]))
+	end := dataBlockHdrSize + int(binary.BigEndian.Uint32(hdr[8:12]))
+	if end > len(db.buf) {
+		return blockCorruption(bptr, "invalid entries length")
+	}
+
+	if dataBlockChecksum(db.buf[:end]) != binary.BigEndian.Uint32(hdr[12:16]) {
+		return blockCorruption(bptr, "checksum mismatch")
 	}
 
-	if db.offset+2 < blockSize {
+	// Entries of compressed blocks are decompressed into a new buffer
+	start := dataBlockHdrSize
+	if codecID != NoCodec {
+		codec := GetCodec(codecID)
+		if codec == nil {
+			return blockCorruption(bptr, fmt.Sprintf("unknown codec %d", codecID))
+		}
+
+		plain, err := codec.Decompress(nil, db.buf[dataBlockHdrSize:end])
+		if err != nil {
+			return blockCorruption(bptr, fmt.Sprintf("decompression failed (%v)", err))
+		}
+
+		db.buf, start, end = plain, 0, len(plain)
+	}
+
+	n := 0
+	for offset := start; offset < end; n++ {
+		if offset+blockEntryHdrSize > end {
+			return blockCorruption(bptr, "invalid entry")
+		}
+
+		l := int(binary.BigEndian.Uint16(db.buf[offset : offset+2]))
+		vl := int(binary.BigEndian.Uint16(db.buf[offset+2 : offset+4]))
+		if l == overflowEntryLen {
+			offset += overflowEntrySize
+		} else if vl <= l {
+			offset += blockEntryHdrSize + l
+		} else {
+			return blockCorruption(bptr, "invalid entry")
+		}
+
+		if offset > end {
+			return blockCorruption(bptr, "invalid entry")
+		}
+	}
+
+	if n != count {
+		return blockCorruption(bptr, "entry count mismatch")
+	}
+
+	db.offset = start
+	db.end = end
+	db.count = count
+	return nil
+}
+
+// dataBlockChecksum computes the checksum of a data block with a zero checksum
+func dataBlockChecksum(bs []byte) uint32 {
+	var zero [4]byte
+	crc := crc32.Update(0, crc32cTable, bs[:12])
+	crc = crc32.Update(crc, crc32cTable, zero[:])
+	return crc32.Update(crc, crc32cTable, bs[dataBlockHdrSize:])
+}
+
+// Get returns the key and value of the next entry in the block.
+// A nil key is returned once the block entries are exhausted or an overflow
+// item cannot be read. Err returns the error in the latter case.
+func (db *dataBlock) Get() (key, val []byte) {
+	if db == nil || db.err != nil {
+		return
+	}
+
+	if db.offset < db.end {
 		l := int(binary.BigEndian.Uint16(db.buf[db.offset : db.offset+2]))
-		if l == 0 {
-			db.offset = blockSize
-			return nil
+		if l == overflowEntryLen {
+			return db.getOverflow()
 		}
-		db.offset += 2
+
+		vl := int(binary.BigEndian.Uint16(db.buf[db.offset+2 : db.offset+4]))
+		db.offset += blockEntryHdrSize
 		offset := db.offset
 		db.offset += l
-		return db.buf[offset : offset+l]
+		return db.buf[offset : offset+l-vl], db.buf[offset+l-vl : offset+l]
 	}
 
-	return nil
+	return
 }
 
-func (db *dataBlock) GetItems() [][]byte {
-	var itms [][]byte
+// Err returns the error encountered while reading the block entries
+func (db *dataBlock) Err() error {
+	if db == nil {
+		return nil
+	}
 
-	for offset := 0; offset+2 < blockSize; {
-		l := int(binary.BigEndian.Uint16(db.buf[offset : offset+2]))
-		if l == 0 {
-			break
+	return db.err
+}
+
+func (db *dataBlock) getOverflow() (key, val []byte) {
+	l, vl, bptr := db.overflowEntry()
+	data, err := readOverflow(db.bm, bptr, l)
+	if err == nil && vl > l {
+		err = blockCorruption(bptr, "invalid overflow item")
+	}
+
+	if err != nil {
+		db.err = err
+		return
+	}
+
+	return data[:l-vl], data[l-vl:]
+}
+
+func (db *dataBlock) overflowEntry() (l, vl int, bptr blockPtr) {
+	entry := db.buf[db.offset+blockEntryHdrSize : db.offset+overflowEntrySize]
+	l = int(binary.BigEndian.Uint32(entry[0:4]))
+	vl = int(binary.BigEndian.Uint32(entry[4:8]))
+	bptr = blockPtr(binary.BigEndian.Uint64(entry[8:16]))
+	db.offset += overflowEntrySize
+	return
+}
+
+// OverflowPtrs returns the first overflow block ptr of all the overflow items
+func (db *dataBlock) OverflowPtrs() []blockPtr {
+	var ptrs []blockPtr
+	for db.offset < db.end {
+		l := int(binary.BigEndian.Uint16(db.buf[db.offset : db.offset+2]))
+		if l == overflowEntryLen {
+			_, _, bptr := db.overflowEntry()
+			ptrs = append(ptrs, bptr)
+		} else {
+			db.offset += blockEntryHdrSize + l
 		}
-		offset += 2
-		itms = append(itms, db.buf[offset:offset+l])
-		offset += l
 	}
 
-	return itms
+	return ptrs
+}
+
+// IsOverflow returns true if the item should be stored as an overflow item.
+// An inline entry should fit into an empty block uncompressed and its length
+// should fit into the 2 byte length.
+func (db *dataBlock) IsOverflow(key, val []byte) bool {
+	l := len(key) + len(val)
+	return l >= overflowEntryLen || dataBlockHdrSize+blockEntryHdrSize+l > db.size
+}
+
+// WriteOverflow writes a block entry for an item stored in overflow blocks
+func (db *dataBlock) WriteOverflow(key []byte, l, vl int, bptr blockPtr) error {
+	if db.offset+overflowEntrySize > len(db.buf) {
+		return errBlockFull
+	}
+
+	offset, hasOverflow := db.offset, db.hasOverflow
+
+	entry := db.buf[db.offset : db.offset+overflowEntrySize]
+	binary.BigEndian.PutUint16(entry[0:2], overflowEntryLen)
+	binary.BigEndian.PutUint16(entry[2:4], 0)
+	binary.BigEndian.PutUint32(entry[4:8], uint32(l))
+	binary.BigEndian.PutUint32(entry[8:12], uint32(vl))
+	binary.BigEndian.PutUint64(entry[12:20], uint64(bptr))
+	db.offset += overflowEntrySize
+	db.count++
+	db.hasOverflow = true
+
+	return db.checkFit(key, offset, hasOverflow)
 }
 
-func (db *dataBlock) Write(itm []byte) error {
-	newLen := db.offset + 2 + len(itm)
+func (db *dataBlock) Write(key, val []byte) error {
+	l := len(key) + len(val)
+	newLen := db.offset + blockEntryHdrSize + l
 	if newLen > len(db.buf) {
 		return errBlockFull
 	}
 
-	binary.BigEndian.PutUint16(db.buf[db.offset:db.offset+2], uint16(len(itm)))
-	db.offset += 2
-	copy(db.buf[db.offset:db.offset+len(itm)], itm)
-	db.offset += len(itm)
+	offset, hasOverflow := db.offset, db.hasOverflow
+
+	binary.BigEndian.PutUint16(db.buf[db.offset:db.offset+2], uint16(l))
+	binary.BigEndian.PutUint16(db.buf[db.offset+2:db.offset+4], uint16(len(val)))
+	db.offset += blockEntryHdrSize
+	copy(db.buf[db.offset:db.offset+len(key)], key)
+	db.offset += len(key)
+	copy(db.buf[db.offset:db.offset+len(val)], val)
+	db.offset += len(val)
+	db.count++
+
+	return db.checkFit(key, offset, hasOverflow)
+}
+
+// checkFit checks whether the entries of a compressed block still fit into
+// the block once an entry is written. The entry is removed if they do not fit.
+func (db *dataBlock) checkFit(key []byte, offset int, hasOverflow bool) error {
+	c := db.comp
+	if c == nil {
+		return nil
+	}
+
+	c.keys = append(c.keys, key)
+	if db.offset <= db.size {
+		c.fitOffset, c.fitCount, c.fitOverflow = db.offset, db.count, db.hasOverflow
+		return nil
+	}
+
+	if db.offset <= c.limit {
+		return nil
+	}
+
+	var err error
+	c.tbuf, err = c.codec.Compress(c.tbuf, db.buf[dataBlockHdrSize:db.offset])
+	if err != nil || dataBlockHdrSize+len(c.tbuf) > db.size {
+		db.offset, db.hasOverflow = offset, hasOverflow
+		db.count--
+		c.keys = c.keys[:len(c.keys)-1]
+		if err == nil {
+			err = errBlockFull
+		}
+		return err
+	}
 
+	// Entries expected to fill half of the remaining space at the current
+	// compression ratio are written before compressing again. They are
+	// limited to half of a block so that they fit uncompressed if they are
+	// retained for the next block.
+	c.cbuf, c.tbuf = c.tbuf, c.cbuf
+	c.fitOffset, c.fitCount, c.fitOverflow = db.offset, db.count, db.hasOverflow
+	c.fitCompressed = true
+	n := (db.size - dataBlockHdrSize - len(c.cbuf)) / 2
+	if len(c.cbuf) > 0 {
+		n = n * (db.offset - dataBlockHdrSize) / len(c.cbuf)
+	}
+	if n > (db.size-dataBlockHdrSize)/2 {
+		n = (db.size - dataBlockHdrSize) / 2
+	}
+	c.limit = db.offset + n
 	return nil
 }
 
 func (db *dataBlock) IsEmpty() bool {
-	return db.offset == 0
+	return db.count == 0
 }
 
+// Reset prepares the block for writing the next block. Entries which were
+// not included in the block returned by Bytes are retained.
 func (db *dataBlock) Reset() {
-	db.offset = 0
+	c := db.comp
+	if c != nil && c.written < db.count {
+		n := copy(db.buf[dataBlockHdrSize:], db.buf[c.fitOffset:db.offset])
+		db.offset = dataBlockHdrSize + n
+		db.count -= c.written
+		c.keys = c.keys[:copy(c.keys, c.keys[c.written:])]
+		db.hasOverflow = false
+		for offset := dataBlockHdrSize; offset < db.offset; {
+			l := int(binary.BigEndian.Uint16(db.buf[offset : offset+2]))
+			if l == overflowEntryLen {
+				db.hasOverflow = true
+				offset += overflowEntrySize
+			} else {
+				offset += blockEntryHdrSize + l
+			}
+		}
+	} else {
+		db.offset = dataBlockHdrSize
+		db.count = 0
+		db.hasOverflow = false
+		if c != nil {
+			c.keys = c.keys[:0]
+		}
+	}
+
+	// Retained entries fit uncompressed
+	if c != nil {
+		c.written = db.count
+		c.limit = db.size
+		c.fitOffset, c.fitCount, c.fitOverflow = db.offset, db.count, db.hasOverflow
+		c.fitCompressed = false
+	}
+}
+
+// Clear removes all the entries of the block
+func (db *dataBlock) Clear() {
+	if db.comp != nil {
+		db.comp.written = db.count
+	}
+	db.Reset()
+}
+
+// FirstKey returns the key of the first entry retained by Reset
+func (db *dataBlock) FirstKey() []byte {
+	if db.comp != nil && len(db.comp.keys) > 0 {
+		return db.comp.keys[0]
+	}
+
+	return nil
+}
+
+// Remaining returns the number of entries which were not included in the
+// block returned by Bytes
+func (db *dataBlock) Remaining() int {
+	if db.comp != nil {
+		return db.count - db.comp.written
+	}
+
+	return 0
+}
+
+// HasOverflow returns true if the block returned by Bytes has overflow entries
+func (db *dataBlock) HasOverflow() bool {
+	if db.Remaining() > 0 {
+		return db.comp.fitOverflow
+	}
+
+	return db.hasOverflow
 }
 
+// Bytes returns the block with a filled in header. A compressed block has
+// the entries which fit into the block once compressed.
 func (db *dataBlock) Bytes() []byte {
-	offset := db.offset
-	// Set 2 byte len = 0
-	if offset+1 < len(db.buf) {
-		db.buf[offset] = 0
-		db.buf[offset+1] = 0
-		offset += 2
+	c := db.comp
+	if c == nil {
+		return putDataBlockHeader(db.buf[:db.offset], NoCodec, db.count)
+	}
+
+	var err error
+	c.written = db.count
+	c.tbuf, err = c.codec.Compress(c.tbuf, db.buf[dataBlockHdrSize:db.offset])
+	switch {
+	case err == nil && len(c.tbuf) < db.offset-dataBlockHdrSize &&
+		dataBlockHdrSize+len(c.tbuf) <= db.size:
+		c.out = append(c.out[:dataBlockHdrSize], c.tbuf...)
+		return putDataBlockHeader(c.out, c.codec.ID(), db.count)
+	case db.offset <= db.size:
+		return putDataBlockHeader(db.buf[:db.offset], NoCodec, db.count)
 	}
 
-	return db.buf[:offset]
+	c.written = c.fitCount
+	if c.fitCompressed {
+		c.out = append(c.out[:dataBlockHdrSize], c.cbuf...)
+		return putDataBlockHeader(c.out, c.codec.ID(), c.fitCount)
+	}
+
+	return putDataBlockHeader(db.buf[:c.fitOffset], NoCodec, c.fitCount)
+}
+
+func putDataBlockHeader(bs []byte, codecID uint8, count int) []byte {
+	binary.BigEndian.PutUint16(bs[0:2], dataBlockVersion)
+	bs[2] = codecID
+	bs[3] = 0
+	binary.BigEndian.PutUint32(bs[4:8], uint32(count))
+	binary.BigEndian.PutUint32(bs[8:12], uint32(len(bs)-dataBlockHdrSize))
+	binary.BigEndian.PutUint32(bs[12:16], dataBlockChecksum(bs))
+
+	return bs
+}
+
+// verifyOverflowBlock checks the header and checksum of an overflow block
+func verifyOverflowBlock(bptr blockPtr, buf []byte) error {
+	n := int(binary.BigEndian.Uint32(buf[0:4]))
+	if n > len(buf)-overflowBlockHdrSize {
+		return blockCorruption(bptr, "invalid overflow block length")
+	}
+
+	crc := crc32.Update(0, crc32cTable, buf[0:16])
+	crc = crc32.Update(crc, crc32cTable, buf[overflowBlockHdrSize:overflowBlockHdrSize+n])
+	if crc != binary.BigEndian.Uint32(buf[16:20]) {
+		return blockCorruption(bptr, "overflow block checksum mismatch")
+	}
+
+	return nil
+}
+
+// readOverflow reads an item of length l from the chain of overflow blocks
+func readOverflow(bm BlockManager, bptr blockPtr, l int) ([]byte, error) {
+	data := make([]byte, 0, l)
+	buf := make([]byte, bm.BlockSize())
+	for {
+		if err := bm.ReadBlock(bptr, buf); err != nil {
+			return nil, err
+		}
+
+		if err := verifyOverflowBlock(bptr, buf); err != nil {
+			return nil, err
+		}
+
+		n := int(binary.BigEndian.Uint32(buf[0:4]))
+		if len(data)+n > l {
+			return nil, blockCorruption(bptr, "invalid overflow item length")
+		}
+
+		data = append(data, buf[overflowBlockHdrSize:overflowBlockHdrSize+n]...)
+		if binary.BigEndian.Uint32(buf[4:8]) == 0 {
+			break
+		}
+		bptr = blockPtr(binary.BigEndian.Uint64(buf[8:16]))
+	}
+
+	if len(data) != l {
+		return nil, blockCorruption(bptr, "invalid overflow item length")
+	}
+
+	return data, nil
+}
+
+// writeOverflow writes item data into a chain of overflow blocks and returns
+// the ptr of the first block. Blocks are written from the end of the chain so
+// that every block can refer to the next block. The written blocks are
+// deleted if the chain cannot be written completely.
+func writeOverflow(bm BlockManager, shard int, data []byte, buf []byte) (blockPtr, error) {
+	var next blockPtr
+	var hasNext uint32
+	var written []blockPtr
+
+	payloadSize := bm.BlockSize() - overflowBlockHdrSize
+	nblocks := (len(data) + payloadSize - 1) / payloadSize
+	for i := nblocks - 1; i >= 0; i-- {
+		end := (i + 1) * payloadSize
+		if end > len(data) {
+			end = len(data)
+		}
+		chunk := data[i*payloadSize : end]
+
+		binary.BigEndian.PutUint32(buf[0:4], uint32(len(chunk)))
+		binary.BigEndian.PutUint32(buf[4:8], hasNext)
+		binary.BigEndian.PutUint64(buf[8:16], uint64(next))
+		copy(buf[overflowBlockHdrSize:], chunk)
+		crc := crc32.Update(0, crc32cTable, buf[0:16])
+		crc = crc32.Update(crc, crc32cTable, chunk)
+		binary.BigEndian.PutUint32(buf[16:20], crc)
+
+		bptr, err := bm.WriteBlock(buf[:overflowBlockHdrSize+len(chunk)], shard)
+		if err != nil {
+			for _, ptr := range written {
+				bm.DeleteBlock(ptr)
+			}
+			return 0, err
+		}
+
+		written = append(written, bptr)
+		next, hasNext = bptr, 1
+	}
+
+	return next, nil
+}
+
+// overflowBlocks returns the blocks of the overflow block chains of a data block
+func overflowBlocks(bm BlockManager, bptr blockPtr, buf []byte) ([]blockPtr, error) {
+	var ptrs []blockPtr
+	db, err := readDataBlock(bm, bptr, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ptr := range db.OverflowPtrs() {
+		if ptrs, err = overflowChain(bm, ptr, buf, ptrs); err != nil {
+			return nil, err
+		}
+	}
+
+	return ptrs, nil
+}
+
+// overflowChain appends the blocks of an overflow block chain to ptrs
+func overflowChain(bm BlockManager, ptr blockPtr, buf []byte, ptrs []blockPtr) ([]blockPtr, error) {
+	for {
+		if err := bm.ReadBlock(ptr, buf); err != nil {
+			return nil, err
+		}
+
+		if err := verifyOverflowBlock(ptr, buf); err != nil {
+			return nil, err
+		}
+
+		ptrs = append(ptrs, ptr)
+		if binary.BigEndian.Uint32(buf[4:8]) == 0 {
+			return ptrs, nil
+		}
+		ptr = blockPtr(binary.BigEndian.Uint64(buf[8:16]))
+	}
+}
+
+// deleteOverflow deletes the overflow block chains of a data block
+func deleteOverflow(bm BlockManager, bptr blockPtr, buf []byte) error {
+	ptrs, err := overflowBlocks(bm, bptr, buf)
+	if err != nil {
+		return err
+	}
+
+	for _, ptr := range ptrs {
+		if err := bm.DeleteBlock(ptr); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
@@ -0,0 +1,165 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"path/filepath"
+)
+
+// Block store free map format
+// [4 byte magic][4 byte version][8 byte index generation][8 byte slots]
+// [bitmap of free slots][4 byte crc32c]
+//
+// The free map of every block store file is persisted when the Nitro instance
+// is closed. Free maps are valid only for the block index generation they are
+// persisted with. Once the index is persisted again, free blocks are found by
+// traversing the blocks of the index while reopening.
+const (
+	freeMapMagic   = 0x4e46524d
+	freeMapVersion = 1
+	freeMapHdrSize = 24
+)
+
+func freeMapFile(shard int) string {
+	return fmt.Sprintf("blockstore-%d.free", shard)
+}
+
+// BlockShardStats describes the space usage of a block store file
+type BlockShardStats struct {
+	TotalBlocks int64
+	FreeBlocks  int64
+	// Fraction of the file occupied by free blocks
+	FragmentationRatio float64
+}
+
+func (s BlockShardStats) String() string {
+	return fmt.Sprintf("total_blocks = %d, free_blocks = %d, fragmentation = %.2f",
+		s.TotalBlocks, s.FreeBlocks, s.FragmentationRatio)
+}
+
+// BlockStoreStats returns the space usage of every block store file
+func (m *Nitro) BlockStoreStats() []BlockShardStats {
+	if fbm, ok := m.bm.(*fileBlockManager); ok {
+		return fbm.Stats()
+	}
+
+	return nil
+}
+
+func (fbm *fileBlockManager) Stats() []BlockShardStats {
+	stats := make([]BlockShardStats, len(fbm.wpos))
+	for shard := range fbm.wpos {
+		fbm.wlocks[shard].Lock()
+		stats[shard].TotalBlocks = fbm.wpos[shard] / fbm.slotSize
+		stats[shard].FreeBlocks = int64(len(fbm.freeBlocks[shard]))
+		fbm.wlocks[shard].Unlock()
+
+		if stats[shard].TotalBlocks > 0 {
+			stats[shard].FragmentationRatio = float64(stats[shard].FreeBlocks) /
+				float64(stats[shard].TotalBlocks)
+		}
+	}
+
+	return stats
+}
+
+// writeFreeMaps persists the free blocks of every file for the index generation
+func (fbm *fileBlockManager) writeFreeMaps(dir string, gen uint64) error {
+	store := NewDirBackupStore(dir)
+	for shard := range fbm.wpos {
+		fbm.wlocks[shard].Lock()
+		slots := fbm.wpos[shard] / fbm.slotSize
+		bs := make([]byte, freeMapHdrSize+int(slots+7)/8, freeMapHdrSize+int(slots+7)/8+4)
+		bitmap := bs[freeMapHdrSize:]
+		for _, off := range fbm.freeBlocks[shard] {
+			slot := off / fbm.slotSize
+			bitmap[slot/8] |= 1 << uint(slot%8)
+		}
+		fbm.wlocks[shard].Unlock()
+
+		binary.BigEndian.PutUint32(bs[0:4], freeMapMagic)
+		binary.BigEndian.PutUint32(bs[4:8], freeMapVersion)
+		binary.BigEndian.PutUint64(bs[8:16], gen)
+		binary.BigEndian.PutUint64(bs[16:24], uint64(slots))
+
+		var crc [4]byte
+		binary.BigEndian.PutUint32(crc[:], crc32.Checksum(bs, crc32cTable))
+		bs = append(bs, crc[:]...)
+
+		if err := store.Commit(freeMapFile(shard), bs); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// loadFreeMaps restores the free blocks from the free maps persisted for the
+// index generation. Data blocks of the index should not be free. Blocks
+// written after the free maps were persisted are not in use. False is
+// returned if the free maps are missing, stale or invalid.
+func (fbm *fileBlockManager) loadFreeMaps(dir string, gen uint64,
+	used map[blockPtr]bool) bool {
+
+	slots := make([]int64, len(fbm.wpos))
+	freeBlocks := make([][]int64, len(fbm.wpos))
+	for shard := range fbm.wpos {
+		bs, err := ioutil.ReadFile(filepath.Join(dir, freeMapFile(shard)))
+		if err != nil || len(bs) < freeMapHdrSize+4 {
+			return false
+		}
+
+		end := len(bs) - 4
+		if crc32.Checksum(bs[:end], crc32cTable) != binary.BigEndian.Uint32(bs[end:]) ||
+			binary.BigEndian.Uint32(bs[0:4]) != freeMapMagic ||
+			binary.BigEndian.Uint32(bs[4:8]) != freeMapVersion ||
+			binary.BigEndian.Uint64(bs[8:16]) != gen {
+			return false
+		}
+
+		slots[shard] = int64(binary.BigEndian.Uint64(bs[16:24]))
+		bitmap := bs[freeMapHdrSize:end]
+		if int64(len(bitmap)) != (slots[shard]+7)/8 ||
+			slots[shard]*fbm.slotSize > fbm.wpos[shard] {
+			return false
+		}
+
+		for slot := int64(0); slot < fbm.wpos[shard]/fbm.slotSize; slot++ {
+			if slot < slots[shard] && bitmap[slot/8]&(1<<uint(slot%8)) == 0 {
+				continue
+			}
+
+			off := slot * fbm.slotSize
+			if used[newBlockPtr(shard, off)] {
+				return false
+			}
+			freeBlocks[shard] = append(freeBlocks[shard], off)
+		}
+	}
+
+	for shard := range freeBlocks {
+		for _, off := range freeBlocks[shard] {
+			if off < slots[shard]*fbm.slotSize {
+				fbm.freeBlocks[shard] = append(fbm.freeBlocks[shard], off)
+			} else if fbm.freeBlock(shard, off) != nil {
+				for i := range fbm.freeBlocks {
+					fbm.freeBlocks[i] = nil
+				}
+				return false
+			}
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,569 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"unsafe"
+
+	"github.com/t3rm1n4l/nitro/skiplist"
+)
+
+// Block store index format
+// header: [4 byte magic][4 byte version][8 byte generation][8 byte count]
+// entry:  [uvarint key len][key][8 byte block ptr]
+// end:    [4 byte crc32c of the header and entries]
+//
+// Block store index journal format
+// record:  [4 byte payload len][4 byte crc32c of the payload][payload]
+// payload: [8 byte generation][8 byte count][change]...
+// change:  [1 byte op][uvarint key len][key][8 byte block ptr of an insert]
+//
+// The index maps the first key of every data block to the block. ApplyOps
+// appends the index changes of its blocks to the journal once the written
+// blocks are synced. The index is rewritten when the journal grows larger
+// than the index, after compaction and key rotation, and when the Nitro
+// instance is closed. Hence, a reopened block store has the items of the last
+// completed ApplyOps. The index and the journal records are encrypted if the
+// block store is encrypted. The generation is incremented every time the
+// index is rewritten or a journal record is appended. Journal records which
+// are not newer than the index are ignored.
+const (
+	blockIndexFile       = "blockstore.index"
+	blockIndexMagic      = 0x4e424958
+	blockIndexVersion    = 1
+	blockIndexHdrSize    = 24
+	blockIndexLogFile    = "blockstore.index.log"
+	blockIndexLogHdrSize = 8
+	blockIndexLogMinSize = 1 << 20
+
+	indexChangeInsert = 1
+	indexChangeDelete = 2
+)
+
+// ErrInvalidBlockIndex means the persisted block store index is corrupted
+var ErrInvalidBlockIndex = errors.New("Invalid block store index")
+
+// blockIndexChange is an index node inserted or deleted by ApplyOps
+type blockIndexChange struct {
+	key     []byte
+	bptr    blockPtr
+	deleted bool
+}
+
+func (dw *diskWriter) recordIndexChange(key []byte, bptr blockPtr, deleted bool) {
+	dw.changes = append(dw.changes, blockIndexChange{
+		key:     append([]byte(nil), key...),
+		bptr:    bptr,
+		deleted: deleted,
+	})
+}
+
+// persistBlockIndex atomically replaces the persisted block index with the
+// current index nodes and removes the journal. It should be called with the
+// batch lock held.
+func (m *Nitro) persistBlockIndex() error {
+	var count uint64
+	var vbuf [binary.MaxVarintLen64]byte
+
+	fbm, ok := m.bm.(*fileBlockManager)
+	if !ok {
+		return nil
+	}
+
+	if err := fbm.Sync(); err != nil {
+		return err
+	}
+
+	buf := bytes.NewBuffer(make([]byte, blockIndexHdrSize))
+	sbuf := m.store.MakeBuf()
+	defer m.store.FreeBuf(sbuf)
+
+	itr := m.store.NewIterator(m.iterCmp, sbuf)
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		n := itr.GetNode()
+		if !isValidNode(n) {
+			continue
+		}
+
+		key := (*Item)(n.Item()).Key()
+		l := binary.PutUvarint(vbuf[:], uint64(len(key)))
+		buf.Write(vbuf[:l])
+		buf.Write(key)
+		binary.BigEndian.PutUint64(vbuf[:8], n.DataPtr)
+		buf.Write(vbuf[:8])
+		count++
+	}
+	itr.Close()
+
+	bs := buf.Bytes()
+	binary.BigEndian.PutUint32(bs[0:4], blockIndexMagic)
+	binary.BigEndian.PutUint32(bs[4:8], blockIndexVersion)
+	binary.BigEndian.PutUint64(bs[8:16], m.blockIndexGen+1)
+	binary.BigEndian.PutUint64(bs[16:24], count)
+
+	var crc [4]byte
+	binary.BigEndian.PutUint32(crc[:], crc32.Checksum(bs, crc32cTable))
+	bs = append(bs, crc[:]...)
+
+	if m.crypt != nil {
+		id, err := m.crypt.currentKey()
+		if err != nil {
+			return err
+		}
+
+		if bs, err = m.crypt.seal(nil, id, bs, []byte(blockIndexFile)); err != nil {
+			return err
+		}
+	}
+
+	if err := NewDirBackupStore(m.blockStoreDir).Commit(blockIndexFile, bs); err != nil {
+		return err
+	}
+
+	m.blockIndexGen++
+	m.indexSize = int64(len(bs))
+	for _, dw := range m.shardWrs {
+		dw.changes = nil
+	}
+
+	// The journal records are older than the index. Hence, they are ignored
+	// if the removal is lost in a crash.
+	if err := m.closeBlockIndexLog(); err != nil {
+		return err
+	}
+
+	err := os.Remove(filepath.Join(m.blockStoreDir, blockIndexLogFile))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	m.indexLogSize = 0
+
+	return fbm.releaseBlocks()
+}
+
+// persistBlockIndexChanges appends the index changes of the block store
+// writers to the journal once the written blocks are synced. The index is
+// rewritten instead if the journal is larger than the index. It should be
+// called with the batch lock held.
+func (m *Nitro) persistBlockIndexChanges() error {
+	var count uint64
+	var vbuf [binary.MaxVarintLen64]byte
+
+	fbm, ok := m.bm.(*fileBlockManager)
+	if !ok {
+		return nil
+	}
+
+	limit := m.indexSize
+	if limit < blockIndexLogMinSize {
+		limit = blockIndexLogMinSize
+	}
+
+	if m.indexLogSize > limit {
+		return m.persistBlockIndex()
+	}
+
+	if err := fbm.Sync(); err != nil {
+		return err
+	}
+
+	buf := bytes.NewBuffer(make([]byte, blockIndexLogHdrSize+16))
+	for _, dw := range m.shardWrs {
+		for _, c := range dw.changes {
+			op := byte(indexChangeInsert)
+			if c.deleted {
+				op = indexChangeDelete
+			}
+
+			buf.WriteByte(op)
+			l := binary.PutUvarint(vbuf[:], uint64(len(c.key)))
+			buf.Write(vbuf[:l])
+			buf.Write(c.key)
+			if !c.deleted {
+				binary.BigEndian.PutUint64(vbuf[:8], uint64(c.bptr))
+				buf.Write(vbuf[:8])
+			}
+			count++
+		}
+	}
+
+	if count == 0 {
+		return fbm.releaseBlocks()
+	}
+
+	rec := buf.Bytes()
+	binary.BigEndian.PutUint64(rec[blockIndexLogHdrSize:], m.blockIndexGen+1)
+	binary.BigEndian.PutUint64(rec[blockIndexLogHdrSize+8:], count)
+
+	if m.crypt != nil {
+		id, err := m.crypt.currentKey()
+		if err != nil {
+			return err
+		}
+
+		hdr := append([]byte(nil), rec[:blockIndexLogHdrSize]...)
+		rec, err = m.crypt.seal(hdr, id, rec[blockIndexLogHdrSize:], []byte(blockIndexLogFile))
+		if err != nil {
+			return err
+		}
+	}
+
+	payload := rec[blockIndexLogHdrSize:]
+	binary.BigEndian.PutUint32(rec[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(rec[4:8], crc32.Checksum(payload, crc32cTable))
+
+	if err := m.appendBlockIndexLog(rec); err != nil {
+		// A partially written record would hide the records appended
+		// after it. Hence, the index is rewritten on the next ApplyOps.
+		m.closeBlockIndexLog()
+		m.indexLogSize = math.MaxInt64
+		return err
+	}
+
+	m.blockIndexGen++
+	for _, dw := range m.shardWrs {
+		dw.changes = nil
+	}
+
+	return fbm.releaseBlocks()
+}
+
+func (m *Nitro) appendBlockIndexLog(rec []byte) error {
+	if m.indexLog == nil {
+		path := filepath.Join(m.blockStoreDir, blockIndexLogFile)
+		fd, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0755)
+		if err != nil {
+			return err
+		}
+
+		// The directory entry of a new journal should be durable
+		if m.indexLogSize == 0 {
+			if err := syncDir(m.blockStoreDir); err != nil {
+				fd.Close()
+				return err
+			}
+		}
+		m.indexLog = fd
+	}
+
+	if _, err := m.indexLog.Write(rec); err != nil {
+		return err
+	}
+
+	if err := m.indexLog.Sync(); err != nil {
+		return err
+	}
+
+	m.indexLogSize += int64(len(rec))
+	return nil
+}
+
+func (m *Nitro) closeBlockIndexLog() error {
+	if m.indexLog == nil {
+		return nil
+	}
+
+	err := m.indexLog.Close()
+	m.indexLog = nil
+	return err
+}
+
+// readBlockIndex returns the index entries and the generation of the
+// persisted block index. The entries refer to the index file bytes.
+func (m *Nitro) readBlockIndex() ([]blockIndexChange, uint64, error) {
+	bs, err := ioutil.ReadFile(filepath.Join(m.blockStoreDir, blockIndexFile))
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	} else if err != nil {
+		return nil, 0, err
+	}
+	m.indexSize = int64(len(bs))
+
+	if m.crypt != nil {
+		if bs, err = m.crypt.open(nil, bs, []byte(blockIndexFile)); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	if len(bs) < blockIndexHdrSize+4 ||
+		binary.BigEndian.Uint32(bs[0:4]) != blockIndexMagic ||
+		binary.BigEndian.Uint32(bs[4:8]) != blockIndexVersion {
+		return nil, 0, ErrInvalidBlockIndex
+	}
+
+	end := len(bs) - 4
+	if crc32.Checksum(bs[:end], crc32cTable) != binary.BigEndian.Uint32(bs[end:]) {
+		return nil, 0, ErrInvalidBlockIndex
+	}
+
+	gen := binary.BigEndian.Uint64(bs[8:16])
+	count := binary.BigEndian.Uint64(bs[16:24])
+	if count > uint64(end-blockIndexHdrSize)/9 {
+		return nil, 0, ErrInvalidBlockIndex
+	}
+
+	entries := make([]blockIndexChange, 0, count)
+	data := bs[blockIndexHdrSize:end]
+	for i := uint64(0); i < count; i++ {
+		l, n := binary.Uvarint(data)
+		if n <= 0 || uint64(len(data)-n) < l+8 {
+			return nil, 0, ErrInvalidBlockIndex
+		}
+
+		key := data[n : n+int(l)]
+		bptr := blockPtr(binary.BigEndian.Uint64(data[n+int(l):]))
+		data = data[n+int(l)+8:]
+		entries = append(entries, blockIndexChange{key: key, bptr: bptr})
+	}
+
+	if len(data) != 0 {
+		return nil, 0, ErrInvalidBlockIndex
+	}
+
+	return entries, gen, nil
+}
+
+// replayBlockIndexLog applies the journal records newer than the index to
+// the index entries. A torn record at the end of the journal is discarded
+// and truncated so that new records can be appended.
+func (m *Nitro) replayBlockIndexLog(entries []blockIndexChange,
+	gen uint64) ([]blockIndexChange, uint64, error) {
+
+	path := filepath.Join(m.blockStoreDir, blockIndexLogFile)
+	bs, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return entries, gen, nil
+	} else if err != nil {
+		return nil, 0, err
+	}
+
+	var index map[string]blockPtr
+	var off int
+	for off < len(bs) {
+		if len(bs)-off < blockIndexLogHdrSize {
+			break
+		}
+
+		l := int64(binary.BigEndian.Uint32(bs[off:]))
+		if l > int64(len(bs)-off-blockIndexLogHdrSize) {
+			break
+		}
+
+		end := off + blockIndexLogHdrSize + int(l)
+		payload := bs[off+blockIndexLogHdrSize : end]
+		if crc32.Checksum(payload, crc32cTable) != binary.BigEndian.Uint32(bs[off+4:]) {
+			if end == len(bs) {
+				break
+			}
+			return nil, 0, ErrInvalidBlockIndex
+		}
+
+		if m.crypt != nil {
+			if payload, err = m.crypt.open(nil, payload, []byte(blockIndexLogFile)); err != nil {
+				return nil, 0, err
+			}
+		}
+
+		if len(payload) < 16 {
+			return nil, 0, ErrInvalidBlockIndex
+		}
+
+		off = end
+		rgen := binary.BigEndian.Uint64(payload[0:8])
+		if rgen <= gen {
+			continue
+		} else if rgen != gen+1 {
+			return nil, 0, ErrInvalidBlockIndex
+		}
+
+		if index == nil {
+			index = make(map[string]blockPtr, len(entries))
+			for _, e := range entries {
+				index[string(e.key)] = e.bptr
+			}
+		}
+
+		count := binary.BigEndian.Uint64(payload[8:16])
+		changes := payload[16:]
+		for i := uint64(0); i < count; i++ {
+			if len(changes) == 0 {
+				return nil, 0, ErrInvalidBlockIndex
+			}
+
+			op := changes[0]
+			l, n := binary.Uvarint(changes[1:])
+			if n <= 0 || uint64(len(changes)-1-n) < l {
+				return nil, 0, ErrInvalidBlockIndex
+			}
+
+			key := string(changes[1+n : 1+n+int(l)])
+			changes = changes[1+n+int(l):]
+			switch {
+			case op == indexChangeDelete:
+				delete(index, key)
+			case op == indexChangeInsert && len(changes) >= 8:
+				index[key] = blockPtr(binary.BigEndian.Uint64(changes))
+				changes = changes[8:]
+			default:
+				return nil, 0, ErrInvalidBlockIndex
+			}
+		}
+
+		if len(changes) != 0 {
+			return nil, 0, ErrInvalidBlockIndex
+		}
+		gen = rgen
+	}
+
+	if off < len(bs) {
+		if err := os.Truncate(path, int64(off)); err != nil {
+			return nil, 0, err
+		}
+	}
+	m.indexLogSize = int64(off)
+
+	if index == nil {
+		return entries, gen, nil
+	}
+
+	entries = entries[:0]
+	for key, bptr := range index {
+		entries = append(entries, blockIndexChange{key: []byte(key), bptr: bptr})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return m.keyCmp(entries[i].key, entries[j].key) < 0
+	})
+
+	return entries, gen, nil
+}
+
+// loadBlockIndex rebuilds the index nodes of a reopened block store from the
+// persisted block index and its journal. Free blocks are obtained from the
+// free maps if they were persisted along with the index. Otherwise, blocks
+// which are not reachable from the index are freed.
+func (m *Nitro) loadBlockIndex() error {
+	var bptr blockPtr
+
+	fbm, ok := m.bm.(*fileBlockManager)
+	if !ok {
+		return nil
+	}
+
+	used := make(map[blockPtr]bool)
+	entries, gen, err := m.readBlockIndex()
+	if err != nil {
+		return err
+	}
+
+	if entries, gen, err = m.replayBlockIndexLog(entries, gen); err != nil {
+		return err
+	} else if gen == 0 {
+		return fbm.freeUnusedBlocks(used)
+	}
+
+	b := skiplist.NewBuilderWithConfig(m.newStoreConfig())
+	b.SetItemSizeFunc(ItemSize)
+	seg := b.NewSegment()
+	seg.SetNodeCallback(func(n *skiplist.Node) {
+		n.DataPtr = uint64(bptr)
+	})
+
+	// Index nodes are born before the current snapshot so that ApplyOps
+	// can replace them with new index nodes of the same key
+	sn := m.getCurrSn()
+	var overflows []blockPtr
+	for _, e := range entries {
+		bptr = e.bptr
+		used[newBlockPtr(bptr.Shard(), bptr.Offset())] = true
+		if bptr.HasOverflow() {
+			overflows = append(overflows, bptr)
+		}
+
+		itm := m.newItem(e.key, m.useMemoryMgmt)
+		itm.bornSn = sn
+		seg.Add(unsafe.Pointer(itm))
+	}
+
+	m.store = b.Assemble(seg)
+	m.itemsCount = int64(len(entries))
+	m.currSn = sn + 1
+	m.blockIndexGen = gen
+
+	if fbm.loadFreeMaps(m.blockStoreDir, gen, used) {
+		return nil
+	}
+
+	bbuf := make([]byte, m.blockSize)
+	for _, bptr := range overflows {
+		ptrs, err := overflowBlocks(m.bm, bptr, bbuf)
+		if err != nil {
+			return err
+		}
+
+		for _, ptr := range ptrs {
+			used[ptr] = true
+		}
+	}
+
+	return fbm.freeUnusedBlocks(used)
+}
+
+// closeBlockStore frees the blocks of the index nodes which are not garbage
+// collected yet. The block index is persisted along with the free maps so
+// that the free blocks are known when the block store is reopened.
+func (m *Nitro) closeBlockStore() error {
+	m.batchLock.Lock()
+	defer m.batchLock.Unlock()
+
+	fbm, ok := m.bm.(*fileBlockManager)
+	if !ok {
+		return nil
+	}
+
+	buf := m.store.MakeBuf()
+	defer m.store.FreeBuf(buf)
+	bbuf := make([]byte, m.blockSize)
+
+	itr := m.store.NewIterator(m.iterCmp, buf)
+	defer itr.Close()
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		n := itr.GetNode()
+		if isValidNode(n) {
+			continue
+		}
+
+		bptr := blockPtr(n.DataPtr)
+		if bptr.HasOverflow() {
+			if err := deleteOverflow(m.bm, bptr, bbuf); err != nil {
+				return err
+			}
+		}
+
+		if err := m.bm.DeleteBlock(bptr); err != nil {
+			return err
+		}
+	}
+
+	if err := m.persistBlockIndex(); err != nil {
+		return err
+	}
+
+	return fbm.writeFreeMaps(m.blockStoreDir, m.blockIndexGen)
+}
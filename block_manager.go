@@ -1,8 +1,11 @@
 package nitro
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sync"
@@ -12,28 +15,41 @@ import (
 
 var useLinuxHolePunch = false
 
+var errNoFreeBlock = errors.New("No free block")
+
 // TODO: Reopen fds on error
 type BlockManager interface {
 	DeleteBlock(bptr blockPtr) error
 	WriteBlock(bs []byte, shard int) (blockPtr, error)
 	ReadBlock(bptr blockPtr, buf []byte) error
+	BlockSize() int
+	Close() error
 }
 
+// Data blocks holding overflow items are flagged in the block ptr
+const blockPtrOverflow = 1 << 54
+
 func newBlockPtr(shard int, off int64) blockPtr {
 	off |= int64(shard) << 55
 	return blockPtr(off)
 }
 
 func (ptr blockPtr) Offset() int64 {
-	off := int64(ptr) & ^(0xff << 55)
+	off := int64(ptr) & ^(0xff<<55 | blockPtrOverflow)
 	return off
 }
 
+func (ptr blockPtr) HasOverflow() bool {
+	return ptr&blockPtrOverflow != 0
+}
+
 func (ptr blockPtr) Shard() int {
 	shard := int(int64(ptr) >> 55)
 	return shard
 }
 
+// Encrypted blocks are padded to the block size and stored in slots
+// which are larger than a block by the encryption overhead
 type fileBlockManager struct {
 	wlocks []sync.Mutex
 	wfds   []*os.File
@@ -42,13 +58,96 @@ type fileBlockManager struct {
 	wpos []int64
 
 	freeBlocks [][]int64
+
+	// Deleted blocks may be referenced by the persisted block index. They
+	// are reused once a newer index is persisted.
+	pendingBlocks [][]int64
+
+	// Shards written after the last sync
+	dirty []int32
+
+	blockSize int
+	crypt     *encryptor
+	slotSize  int64
+	bufs      sync.Pool
+}
+
+const blockStoreMetaFile = "blockstore.meta"
+
+// blockStoreMeta records the layout of a block store. A block store cannot
+// be reopened with a different layout.
+type blockStoreMeta struct {
+	BlockSize int  `json:"block_size"`
+	Encrypted bool `json:"encrypted"`
+	// Block stores created before the data block header have format 0
+	BlockFormat int `json:"block_format"`
+}
+
+func blockStoreMetaMismatch(path string, old, meta blockStoreMeta) error {
+	return fmt.Errorf("Block store %s has block size %d (encrypted: %v, format: %d), "+
+		"configured %d (encrypted: %v, format: %d)", path, old.BlockSize, old.Encrypted,
+		old.BlockFormat, meta.BlockSize, meta.Encrypted, meta.BlockFormat)
 }
 
-func newFileBlockManager(nfiles int, path string) (*fileBlockManager, error) {
+// checkBlockStoreMeta compares the layout of an existing block store with
+// the configured layout. The layout is recorded for a new block store.
+func checkBlockStoreMeta(path string, meta blockStoreMeta) error {
+	file := filepath.Join(path, blockStoreMetaFile)
+	bs, err := ioutil.ReadFile(file)
+	if err == nil {
+		var old blockStoreMeta
+		if err := json.Unmarshal(bs, &old); err != nil {
+			return fmt.Errorf("Invalid block store meta %s (%v)", file, err)
+		}
+
+		if old != meta {
+			return blockStoreMetaMismatch(path, old, meta)
+		}
+
+		return nil
+	}
+
+	if !os.IsNotExist(err) {
+		return err
+	}
+
+	// Block stores created before the meta file have the default layout
+	files, _ := filepath.Glob(filepath.Join(path, "blockstore-*.data"))
+	for _, f := range files {
+		if fi, err := os.Stat(f); err == nil && fi.Size() > 0 {
+			if legacy := (blockStoreMeta{BlockSize: defaultBlockSize}); legacy != meta {
+				return blockStoreMetaMismatch(path, legacy, meta)
+			}
+			break
+		}
+	}
+
+	bs, _ = json.Marshal(meta)
+	return NewDirBackupStore(path).Commit(blockStoreMetaFile, bs)
+}
+
+func newFileBlockManager(nfiles int, path string, blockSize int,
+	crypt *encryptor) (*fileBlockManager, error) {
 	var fd *os.File
 	var err error
 
-	fbm := &fileBlockManager{}
+	meta := blockStoreMeta{
+		BlockSize:   blockSize,
+		Encrypted:   crypt != nil,
+		BlockFormat: dataBlockVersion,
+	}
+	if err := checkBlockStoreMeta(path, meta); err != nil {
+		return nil, err
+	}
+
+	fbm := &fileBlockManager{blockSize: blockSize, crypt: crypt, slotSize: int64(blockSize)}
+	if crypt != nil {
+		fbm.slotSize += encryptionOverhead
+	}
+	fbm.bufs.New = func() interface{} {
+		return make([]byte, fbm.slotSize)
+	}
+
 	defer func() {
 		if err != nil {
 			for _, wfd := range fbm.wfds {
@@ -63,6 +162,8 @@ func newFileBlockManager(nfiles int, path string) (*fileBlockManager, error) {
 	fbm.wlocks = make([]sync.Mutex, nfiles)
 	fbm.wpos = make([]int64, nfiles)
 	fbm.freeBlocks = make([][]int64, nfiles)
+	fbm.pendingBlocks = make([][]int64, nfiles)
+	fbm.dirty = make([]int32, nfiles)
 
 	for i := 0; i < nfiles; i++ {
 		fpath := filepath.Join(path, fmt.Sprintf("blockstore-%d.data", i))
@@ -77,7 +178,11 @@ func newFileBlockManager(nfiles int, path string) (*fileBlockManager, error) {
 			return nil, err
 		}
 
-		fbm.wpos[i] += fbm.wpos[i] % blockSize
+		// The last block may be shorter than a slot
+		if r := fbm.wpos[i] % fbm.slotSize; r != 0 {
+			fbm.wpos[i] += fbm.slotSize - r
+		}
+
 		fd, err = os.Open(fpath)
 		if err != nil {
 			return nil, err
@@ -91,44 +196,228 @@ func newFileBlockManager(nfiles int, path string) (*fileBlockManager, error) {
 
 func (fbm *fileBlockManager) DeleteBlock(bptr blockPtr) error {
 	shard := bptr.Shard()
+	fbm.wlocks[shard].Lock()
+	defer fbm.wlocks[shard].Unlock()
+	fbm.pendingBlocks[shard] = append(fbm.pendingBlocks[shard], bptr.Offset())
+
+	return nil
+}
+
+// freeBlock makes a block available for reuse. The space of the block is
+// released until it is reused if hole punching is supported.
+func (fbm *fileBlockManager) freeBlock(shard int, off int64) error {
 	if useLinuxHolePunch {
-		return punchHole(fbm.wfds[shard], bptr.Offset(), blockSize)
+		if err := punchHole(fbm.wfds[shard], off, fbm.slotSize); err != nil {
+			return err
+		}
+	}
+
+	fbm.freeBlocks[shard] = append(fbm.freeBlocks[shard], off)
+	return nil
+}
+
+// releaseBlocks frees the deleted blocks once they are no longer referenced
+// by the persisted block index
+func (fbm *fileBlockManager) releaseBlocks() error {
+	for shard := range fbm.pendingBlocks {
+		fbm.wlocks[shard].Lock()
+		pending := fbm.pendingBlocks[shard]
+		fbm.pendingBlocks[shard] = nil
+		for _, off := range pending {
+			if err := fbm.freeBlock(shard, off); err != nil {
+				fbm.wlocks[shard].Unlock()
+				return err
+			}
+		}
+		fbm.wlocks[shard].Unlock()
 	}
 
+	return nil
+}
+
+// freeUnusedBlocks frees the blocks of a reopened block store which are not
+// in use. It includes the blocks written after the block index was persisted.
+func (fbm *fileBlockManager) freeUnusedBlocks(used map[blockPtr]bool) error {
+	for shard := range fbm.wpos {
+		fbm.wlocks[shard].Lock()
+		for off := int64(0); off+fbm.slotSize <= fbm.wpos[shard]; off += fbm.slotSize {
+			if !used[newBlockPtr(shard, off)] {
+				if err := fbm.freeBlock(shard, off); err != nil {
+					fbm.wlocks[shard].Unlock()
+					return err
+				}
+			}
+		}
+		fbm.wlocks[shard].Unlock()
+	}
+
+	return nil
+}
+
+// truncate removes the free blocks at the end of a file and returns the
+// number of bytes reclaimed
+func (fbm *fileBlockManager) truncate(shard int) (int64, error) {
 	fbm.wlocks[shard].Lock()
 	defer fbm.wlocks[shard].Unlock()
-	fbm.freeBlocks[shard] = append(fbm.freeBlocks[shard], bptr.Offset())
+
+	free := make(map[int64]bool)
+	for _, off := range fbm.freeBlocks[shard] {
+		free[off] = true
+	}
+
+	wpos := fbm.wpos[shard]
+	for wpos > 0 && free[wpos-fbm.slotSize] {
+		wpos -= fbm.slotSize
+	}
+
+	if wpos == fbm.wpos[shard] {
+		return 0, nil
+	}
+
+	if err := fbm.wfds[shard].Truncate(wpos); err != nil {
+		return 0, err
+	}
+
+	flist := fbm.freeBlocks[shard][:0]
+	for _, off := range fbm.freeBlocks[shard] {
+		if off < wpos {
+			flist = append(flist, off)
+		}
+	}
+
+	reclaimed := fbm.wpos[shard] - wpos
+	fbm.freeBlocks[shard] = flist
+	fbm.wpos[shard] = wpos
+	return reclaimed, nil
+}
+
+// Sync flushes the written blocks to disk. Only the shards written after the
+// last sync are flushed.
+func (fbm *fileBlockManager) Sync() error {
+	for shard, fd := range fbm.wfds {
+		if atomic.SwapInt32(&fbm.dirty[shard], 0) == 0 {
+			continue
+		}
+
+		if err := fd.Sync(); err != nil {
+			atomic.StoreInt32(&fbm.dirty[shard], 1)
+			return err
+		}
+	}
 
 	return nil
 }
 
+func (fbm *fileBlockManager) Close() error {
+	var err error
+	for i := range fbm.wfds {
+		if e := fbm.wfds[i].Close(); e != nil {
+			err = e
+		}
+
+		if e := fbm.rfds[i].Close(); e != nil {
+			err = e
+		}
+	}
+
+	return err
+}
+
 func (fbm *fileBlockManager) WriteBlock(bs []byte, shard int) (blockPtr, error) {
 	shard = shard % len(fbm.wpos)
 	fbm.wlocks[shard].Lock()
 	var pos int64
 
 	flist := fbm.freeBlocks[shard]
-	if !useLinuxHolePunch && len(flist) > 0 {
+	if len(flist) > 0 {
 		pos = flist[len(flist)-1]
 		flist = flist[0 : len(flist)-1]
 		fbm.freeBlocks[shard] = flist
 	} else {
 		pos = fbm.wpos[shard]
-		fbm.wpos[shard] += blockSize
+		fbm.wpos[shard] += fbm.slotSize
 	}
 	fbm.wlocks[shard].Unlock()
 
+	return fbm.writeBlockAt(bs, shard, pos)
+}
+
+// writeBlockBelow writes a block into a free block before the offset limit.
+// Unlike WriteBlock, it never extends the file.
+func (fbm *fileBlockManager) writeBlockBelow(bs []byte, shard int, limit int64) (blockPtr, error) {
+	fbm.wlocks[shard].Lock()
+	pos := int64(-1)
+	flist := fbm.freeBlocks[shard]
+	for i := len(flist) - 1; i >= 0; i-- {
+		if flist[i] < limit {
+			pos = flist[i]
+			fbm.freeBlocks[shard] = append(flist[:i], flist[i+1:]...)
+			break
+		}
+	}
+	fbm.wlocks[shard].Unlock()
+
+	if pos < 0 {
+		return 0, errNoFreeBlock
+	}
+
+	return fbm.writeBlockAt(bs, shard, pos)
+}
+
+func (fbm *fileBlockManager) writeBlockAt(bs []byte, shard int, pos int64) (blockPtr, error) {
+	if fbm.crypt != nil {
+		sbuf := fbm.bufs.Get().([]byte)
+		defer fbm.bufs.Put(sbuf)
+
+		var err error
+		if bs, err = fbm.sealBlock(sbuf, bs, shard, pos); err != nil {
+			return 0, err
+		}
+	}
+
 	_, err := fbm.wfds[shard].WriteAt(bs, pos)
 	if err != nil {
 		return 0, err
 	}
+	atomic.StoreInt32(&fbm.dirty[shard], 1)
 
 	bptr := newBlockPtr(shard, pos)
 	return bptr, nil
 }
 
+// sealBlock encrypts the block padded to the block size using the current key
+func (fbm *fileBlockManager) sealBlock(sbuf, bs []byte, shard int, pos int64) ([]byte, error) {
+	var ad [12]byte
+	id, err := fbm.crypt.currentKey()
+	if err != nil {
+		return nil, err
+	}
+
+	// Encrypted in place after the encryption header
+	plain := sbuf[encryptionHdrSize : encryptionHdrSize+fbm.blockSize]
+	n := copy(plain, bs)
+	for i := n; i < fbm.blockSize; i++ {
+		plain[i] = 0
+	}
+
+	sealed, err := fbm.crypt.seal(sbuf[:0], id, plain, locationAD(ad[:], shard, pos))
+	if err != nil {
+		return nil, err
+	}
+
+	return sealed, nil
+}
+
+func (fbm *fileBlockManager) BlockSize() int {
+	return fbm.blockSize
+}
+
 func (fbm *fileBlockManager) ReadBlock(bptr blockPtr, buf []byte) error {
 	shard := bptr.Shard()
+	if fbm.crypt != nil {
+		return fbm.readSealedBlock(bptr, buf)
+	}
+
 	n, err := fbm.rfds[shard].ReadAt(buf, bptr.Offset())
 	if err == io.EOF {
 		for ; n < len(buf); n++ {
@@ -139,17 +428,46 @@ func (fbm *fileBlockManager) ReadBlock(bptr blockPtr, buf []byte) error {
 	return err
 }
 
+func (fbm *fileBlockManager) readSealedBlock(bptr blockPtr, buf []byte) error {
+	var ad [12]byte
+	sbuf := fbm.bufs.Get().([]byte)
+	defer fbm.bufs.Put(sbuf)
+
+	shard := bptr.Shard()
+	if _, err := fbm.rfds[shard].ReadAt(sbuf, bptr.Offset()); err != nil {
+		return err
+	}
+
+	_, err := fbm.crypt.open(buf[:0], sbuf, locationAD(ad[:], shard, bptr.Offset()))
+	if err == errDecryptionFailed {
+		err = fmt.Errorf("Block %d:%d decryption failed", shard, bptr.Offset())
+	}
+
+	return err
+}
+
+// blockKeyID returns the id of the key used for encrypting the block
+func (fbm *fileBlockManager) blockKeyID(bptr blockPtr) (uint32, error) {
+	var hdr [4]byte
+	if _, err := fbm.rfds[bptr.Shard()].ReadAt(hdr[:], bptr.Offset()); err != nil {
+		return 0, err
+	}
+
+	return sealedKeyID(hdr[:]), nil
+}
+
 type mmapBlockManager struct {
-	file   *os.File
-	offset int64
-	data   []byte
+	file      *os.File
+	offset    int64
+	data      []byte
+	blockSize int64
 }
 
 const maxFileOffset = 16000000000000 // 16TB
-func newMmapBlockManager(dir string) (*mmapBlockManager, error) {
+func newMmapBlockManager(dir string, blockSize int) (*mmapBlockManager, error) {
 	// TODO: Ability to reuse file and update offset
 	file := filepath.Join(dir, "blockstore-mmap.data")
-	mbm := new(mmapBlockManager)
+	mbm := &mmapBlockManager{blockSize: int64(blockSize)}
 	if f, err := os.Create(file); err == nil {
 		if _, err := f.WriteAt([]byte("EOF"), maxFileOffset); err != nil {
 			return nil, err
@@ -172,8 +490,8 @@ func newMmapBlockManager(dir string) (*mmapBlockManager, error) {
 }
 
 func (mbm *mmapBlockManager) WriteBlock(bs []byte, shard int) (blockPtr, error) {
-	pos := atomic.AddInt64(&mbm.offset, blockSize)
-	pos -= blockSize
+	pos := atomic.AddInt64(&mbm.offset, mbm.blockSize)
+	pos -= mbm.blockSize
 
 	copy(mbm.data[pos:], bs)
 
@@ -183,11 +501,23 @@ func (mbm *mmapBlockManager) WriteBlock(bs []byte, shard int) (blockPtr, error)
 
 func (mbm *mmapBlockManager) DeleteBlock(bptr blockPtr) error {
 	pos := bptr.Offset()
-	return mmapPunchHole(mbm.data[pos : pos+blockSize])
+	return mmapPunchHole(mbm.data[pos : pos+mbm.blockSize])
 }
 
 func (mbm mmapBlockManager) ReadBlock(bptr blockPtr, buf []byte) error {
 	pos := bptr.Offset()
-	copy(buf[:blockSize], mbm.data[pos:pos+blockSize])
+	copy(buf[:mbm.blockSize], mbm.data[pos:pos+mbm.blockSize])
 	return nil
 }
+
+func (mbm mmapBlockManager) BlockSize() int {
+	return int(mbm.blockSize)
+}
+
+func (mbm *mmapBlockManager) Close() error {
+	if err := syscall.Munmap(mbm.data); err != nil {
+		return err
+	}
+
+	return mbm.file.Close()
+}
@@ -0,0 +1,224 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+// nitro-backup inspects nitro disk backups
+//
+//	nitro-backup verify [-keys <file>] <dir>
+//	nitro-backup stat <dir>
+//	nitro-backup dump [-keys <file>] [-values] [-hex] <dir>
+//
+// Encrypted backups are read using the keys of the key file, which has one
+// "<key id> <hex key>" line per key. Backups taken with a custom key
+// comparator are checked for integrity, but the key ordering checks of
+// verify are skipped since the comparator is not known.
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/t3rm1n4l/nitro"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s <verify|stat|dump> [options] <backup dir>\n", os.Args[0])
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	var err error
+	cmd, args := os.Args[1], os.Args[2:]
+	switch cmd {
+	case "verify":
+		err = verify(args)
+	case "stat":
+		err = stat(args)
+	case "dump":
+		err = dump(args)
+	default:
+		usage()
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", cmd, err)
+		os.Exit(1)
+	}
+}
+
+func parseDir(fs *flag.FlagSet, args []string) string {
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	return fs.Arg(0)
+}
+
+// readKeys returns a key ring with the keys of a key file
+func readKeys(path string) (nitro.KeyProvider, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	ring := nitro.NewKeyRing()
+	for i, line := range strings.Split(string(bs), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected <key id> <hex key>", path, i+1)
+		}
+
+		id, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid key id (%v)", path, i+1, err)
+		}
+
+		key, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid key (%v)", path, i+1, err)
+		}
+
+		if err := ring.AddKey(uint32(id), key, false); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, i+1, err)
+		}
+	}
+
+	return ring, nil
+}
+
+// unordered is used in place of an unknown key comparator. It never reports
+// items out of order.
+func unordered([]byte, []byte) int {
+	return -1
+}
+
+func verify(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	keyFile := fs.String("keys", "", "Key file of an encrypted backup")
+	dir := parseDir(fs, args)
+
+	kp, err := readKeys(*keyFile)
+	if err != nil {
+		return err
+	}
+
+	store := nitro.NewDirBackupStore(dir)
+	manifest, err := nitro.ReadBackupManifest(store)
+	if err != nil {
+		return err
+	}
+
+	var cmp nitro.KeyCompare
+	if manifest.KeyComparatorID != 0 {
+		fmt.Printf("key ordering is not checked for key comparator %d\n", manifest.KeyComparatorID)
+		cmp = unordered
+	}
+
+	t0 := time.Now()
+	report, err := nitro.VerifyEncryptedBackupStore(store, cmp, kp)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range report.Problems {
+		fmt.Println(p)
+	}
+
+	fmt.Printf("items=%d deletes=%d delta=%d took=%v\n", report.ItemsCount,
+		report.DeletesCount, report.DeltaCount, time.Since(t0))
+
+	if !report.OK() {
+		return fmt.Errorf("found %d problems", len(report.Problems))
+	}
+
+	fmt.Println("OK")
+	return nil
+}
+
+func stat(args []string) error {
+	fs := flag.NewFlagSet("stat", flag.ExitOnError)
+	dir := parseDir(fs, args)
+
+	manifest, err := nitro.ReadBackupManifest(nitro.NewDirBackupStore(dir))
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("snapshot           %d\n", manifest.Snapshot)
+	if manifest.Incremental {
+		fmt.Printf("base_snapshot      %d\n", manifest.BaseSnapshot)
+		fmt.Printf("deletes_count      %d\n", manifest.DeletesCount)
+	}
+	fmt.Printf("items_count        %d\n", manifest.ItemsCount)
+	fmt.Printf("created_at         %v\n", manifest.CreatedAt)
+	fmt.Printf("file_type          %d\n", manifest.FileType)
+	fmt.Printf("codec_id           %d\n", manifest.CodecID)
+	fmt.Printf("key_comparator_id  %d\n", manifest.KeyComparatorID)
+	fmt.Printf("delta_interleaving %v\n", manifest.DeltaInterleaving)
+
+	var size int64
+	for _, fi := range manifest.Files {
+		fmt.Printf("%-18s %12d %08x\n", fi.Name, fi.Size, fi.Checksum)
+		size += fi.Size
+	}
+	fmt.Printf("total_size         %d\n", size)
+
+	return nil
+}
+
+func dump(args []string) error {
+	fs := flag.NewFlagSet("dump", flag.ExitOnError)
+	keyFile := fs.String("keys", "", "Key file of an encrypted backup")
+	values := fs.Bool("values", false, "Print item values")
+	hexOut := fs.Bool("hex", false, "Print keys and values in hex")
+	dir := parseDir(fs, args)
+
+	kp, err := readKeys(*keyFile)
+	if err != nil {
+		return err
+	}
+
+	format := "%s"
+	if *hexOut {
+		format = "%x"
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+
+	store := nitro.NewDirBackupStore(dir)
+	return nitro.VisitEncryptedBackup(store, kp, func(file string, itm *nitro.Item) error {
+		fmt.Fprintf(w, "%s "+format, file, itm.Key())
+		if *values {
+			fmt.Fprintf(w, " "+format, itm.Value())
+		}
+		_, err := fmt.Fprintln(w)
+		return err
+	})
+}
@@ -0,0 +1,114 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"sync"
+)
+
+// Codec implements compression of data blocks
+// Codec implementations should be safe for concurrent use.
+type Codec interface {
+	// ID identifies the codec in the stored data. Zero is reserved for
+	// uncompressed data.
+	ID() uint8
+	Compress(dst, src []byte) ([]byte, error)
+	Decompress(dst, src []byte) ([]byte, error)
+}
+
+const (
+	// NoCodec - data is not compressed
+	NoCodec uint8 = iota
+	// FlateCodec - DEFLATE compression
+	FlateCodec
+)
+
+var (
+	codecsLock sync.RWMutex
+	codecs     = make(map[uint8]Codec)
+)
+
+func init() {
+	RegisterCodec(newFlateCodec(flate.DefaultCompression))
+}
+
+// RegisterCodec makes a codec available for compression and decompression.
+// A previously registered codec with the same id is replaced.
+func RegisterCodec(c Codec) {
+	codecsLock.Lock()
+	defer codecsLock.Unlock()
+	codecs[c.ID()] = c
+}
+
+// GetCodec returns the registered codec with the id or nil if not found
+func GetCodec(id uint8) Codec {
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+	return codecs[id]
+}
+
+type flateCodec struct {
+	level   int
+	writers sync.Pool
+	readers sync.Pool
+}
+
+func newFlateCodec(level int) *flateCodec {
+	c := &flateCodec{level: level}
+	c.writers.New = func() interface{} {
+		w, _ := flate.NewWriter(nil, c.level)
+		return w
+	}
+	c.readers.New = func() interface{} {
+		return flate.NewReader(bytes.NewReader(nil))
+	}
+
+	return c
+}
+
+func (c *flateCodec) ID() uint8 {
+	return FlateCodec
+}
+
+func (c *flateCodec) Compress(dst, src []byte) ([]byte, error) {
+	b := bytes.NewBuffer(dst[:0])
+	w := c.writers.Get().(*flate.Writer)
+	defer c.writers.Put(w)
+
+	w.Reset(b)
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
+
+func (c *flateCodec) Decompress(dst, src []byte) ([]byte, error) {
+	b := bytes.NewBuffer(dst[:0])
+	r := c.readers.Get().(io.ReadCloser)
+	defer c.readers.Put(r)
+
+	if err := r.(flate.Resetter).Reset(bytes.NewReader(src), nil); err != nil {
+		return nil, err
+	}
+
+	if _, err := b.ReadFrom(r); err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
@@ -0,0 +1,325 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/t3rm1n4l/nitro/skiplist"
+)
+
+// ErrCompactionUnsupported means the block store cannot be compacted
+var ErrCompactionUnsupported = errors.New("Block store compaction requires memory management")
+
+// CompactionOptions control a block store compaction
+type CompactionOptions struct {
+	// Context cancels the compaction. Blocks moved so far are retained.
+	Context context.Context
+	// RateLimiter limits the blocks and block bytes moved by the compaction
+	RateLimiter *RateLimiter
+	// MinFragmentation is the fragmentation ratio from which a block store
+	// file is compacted
+	MinFragmentation float64
+	// Progress is called after every compacted file
+	Progress func(CompactionStats)
+}
+
+// CompactionStats describes the progress of a block store compaction
+type CompactionStats struct {
+	FilesCompacted int
+	BlocksMoved    int64
+	BytesReclaimed int64
+	Elapsed        time.Duration
+}
+
+func (s CompactionStats) String() string {
+	return fmt.Sprintf("files_compacted = %d, blocks_moved = %d, bytes_reclaimed = %d, elapsed = %v",
+		s.FilesCompacted, s.BlocksMoved, s.BytesReclaimed, s.Elapsed)
+}
+
+// compactionBlockManager writes the moved blocks only into the free blocks
+// before the offset from which a file is truncated
+type compactionBlockManager struct {
+	*fileBlockManager
+	limit int64
+}
+
+func (bm compactionBlockManager) WriteBlock(bs []byte, shard int) (blockPtr, error) {
+	return bm.writeBlockBelow(bs, shard, bm.limit)
+}
+
+// blockGroup is a data block along with its overflow blocks. The offset of
+// the last block of the group decides the order of moving the groups.
+type blockGroup struct {
+	n    *skiplist.Node
+	bptr blockPtr
+	ptrs []blockPtr
+	last int64
+}
+
+// CompactBlockStore moves the blocks at the tail of the block store files
+// into free blocks and truncates the files. Moved blocks are swapped into
+// their index nodes without creating new index nodes. Hence, it can run in
+// the background along with readers and ApplyOps. It requires memory
+// management as the moved blocks are freed once the readers which may be
+// reading them have finished. ErrCompactionUnsupported is returned without
+// memory management.
+//
+// Blocks are moved only into the free blocks before the end of the used
+// blocks. Compaction of a file stops once there are no such free blocks.
+func (m *Nitro) CompactBlockStore(opts CompactionOptions) (CompactionStats, error) {
+	var stats CompactionStats
+
+	fbm, ok := m.bm.(*fileBlockManager)
+	if !ok {
+		return stats, fmt.Errorf("Block store is not enabled")
+	}
+
+	if !m.useMemoryMgmt {
+		return stats, ErrCompactionUnsupported
+	}
+
+	if opts.Context == nil {
+		opts.Context = context.Background()
+	}
+
+	t0 := time.Now()
+	for shard, s := range fbm.Stats() {
+		if s.FreeBlocks == 0 || s.FragmentationRatio < opts.MinFragmentation {
+			continue
+		}
+
+		moved, reclaimed, err := m.compactShard(fbm, shard, opts)
+		stats.BlocksMoved += moved
+		stats.BytesReclaimed += reclaimed
+		stats.Elapsed = time.Since(t0)
+		if err != nil {
+			return stats, err
+		}
+
+		stats.FilesCompacted++
+		if opts.Progress != nil {
+			opts.Progress(stats)
+		}
+	}
+
+	return stats, nil
+}
+
+// compactShard moves the block groups of a file having blocks beyond the
+// number of used blocks, starting from the tail of the file
+func (m *Nitro) compactShard(fbm *fileBlockManager, shard int,
+	opts CompactionOptions) (moved, reclaimed int64, err error) {
+
+	var old []blockPtr
+
+	groups, limit, err := m.tailBlockGroups(fbm, shard)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	bm := compactionBlockManager{fileBlockManager: fbm, limit: limit}
+
+	// Free blocks are reused from the head of the file
+	fbm.wlocks[shard].Lock()
+	flist := fbm.freeBlocks[shard]
+	sort.Slice(flist, func(i, j int) bool { return flist[i] > flist[j] })
+	fbm.wlocks[shard].Unlock()
+
+	rbuf := make([]byte, m.blockSize)
+	obuf := make([]byte, m.blockSize)
+	wblock := m.newBlockWriter()
+
+	move := func(g blockGroup) error {
+		m.batchLock.Lock()
+		defer m.batchLock.Unlock()
+
+		// The block may have been rewritten by ApplyOps
+		if !isValidNode(g.n) || blockPtr(g.n.DataPtr) != g.bptr {
+			return nil
+		}
+
+		// Entries of a compressed block may not fit into a block again
+		bptr, err := m.copyBlockGroup(bm, g.bptr, shard, rbuf, obuf, wblock)
+		if err == errBlockFull {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		atomic.StoreUint64(&g.n.DataPtr, uint64(bptr))
+		old = append(old, g.ptrs...)
+		moved += int64(len(g.ptrs))
+		return nil
+	}
+
+	for _, g := range groups {
+		if err = opts.Context.Err(); err != nil {
+			break
+		}
+
+		if opts.RateLimiter != nil {
+			bytes := int64(len(g.ptrs) * m.blockSize)
+			if err = opts.RateLimiter.Wait(opts.Context, int64(len(g.ptrs)), bytes); err != nil {
+				break
+			}
+		}
+
+		if err = move(g); err != nil {
+			if err == errNoFreeBlock {
+				err = nil
+			}
+			break
+		}
+	}
+
+	// Readers may still be reading the moved blocks. Moved blocks are freed
+	// once the index referring to the new blocks is persisted.
+	m.waitForAccessors()
+
+	m.batchLock.Lock()
+	defer m.batchLock.Unlock()
+
+	for _, bptr := range old {
+		if e := fbm.DeleteBlock(bptr); e != nil && err == nil {
+			err = e
+		}
+	}
+
+	if e := m.persistBlockIndex(); e != nil {
+		return moved, 0, e
+	}
+
+	reclaimed, e := fbm.truncate(shard)
+	if err == nil {
+		err = e
+	}
+
+	return moved, reclaimed, err
+}
+
+// tailBlockGroups returns the block groups of a file having blocks beyond the
+// number of used blocks in the descending order of their last block. The
+// offset of the end of the used blocks is returned along with the groups.
+func (m *Nitro) tailBlockGroups(fbm *fileBlockManager, shard int) ([]blockGroup, int64, error) {
+	var groups []blockGroup
+
+	s := fbm.Stats()[shard]
+	limit := (s.TotalBlocks - s.FreeBlocks) * fbm.slotSize
+
+	m.batchLock.Lock()
+	defer m.batchLock.Unlock()
+
+	buf := m.store.MakeBuf()
+	defer m.store.FreeBuf(buf)
+	bbuf := make([]byte, m.blockSize)
+
+	itr := m.store.NewIterator(m.iterCmp, buf)
+	defer itr.Close()
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		n := itr.GetNode()
+		bptr := blockPtr(n.DataPtr)
+		if !isValidNode(n) || bptr.Shard() != shard {
+			continue
+		}
+
+		g := blockGroup{n: n, bptr: bptr, ptrs: []blockPtr{bptr}}
+		if bptr.HasOverflow() {
+			ptrs, err := overflowBlocks(fbm, bptr, bbuf)
+			if err != nil {
+				return nil, 0, err
+			}
+			g.ptrs = append(g.ptrs, ptrs...)
+		}
+
+		for _, ptr := range g.ptrs {
+			if ptr.Offset() > g.last {
+				g.last = ptr.Offset()
+			}
+		}
+
+		if g.last >= limit {
+			groups = append(groups, g)
+		}
+	}
+
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].last > groups[j].last
+	})
+
+	return groups, limit, nil
+}
+
+// copyBlockGroup writes a copy of a data block and its overflow items using
+// the block manager and returns the block ptr of the copy. The written
+// overflow blocks are deleted if the group cannot be copied.
+func (m *Nitro) copyBlockGroup(bm BlockManager, bptr blockPtr, shard int, rbuf, obuf []byte,
+	wblock *dataBlock) (newPtr blockPtr, err error) {
+
+	var optrs []blockPtr
+
+	db, err := readDataBlock(m.bm, bptr, rbuf)
+	if err != nil {
+		return 0, err
+	}
+
+	defer func() {
+		if err != nil {
+			for _, optr := range optrs {
+				bm.DeleteBlock(optr)
+			}
+		}
+	}()
+
+	wblock.Clear()
+	for key, val := db.Get(); key != nil; key, val = db.Get() {
+		if !wblock.IsOverflow(key, val) {
+			if err := wblock.Write(key, val); err != nil {
+				return 0, err
+			}
+			continue
+		}
+
+		data := append(append([]byte(nil), key...), val...)
+		optr, err := writeOverflow(bm, shard, data, obuf)
+		if err != nil {
+			return 0, err
+		}
+
+		if optrs, err = overflowChain(bm, optr, obuf, optrs); err != nil {
+			return 0, err
+		}
+
+		if err := wblock.WriteOverflow(key, len(data), len(val), optr); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := db.Err(); err != nil {
+		return 0, err
+	}
+
+	bs := wblock.Bytes()
+	if wblock.Remaining() > 0 {
+		return 0, errBlockFull
+	}
+
+	newPtr, err = bm.WriteBlock(bs, shard)
+	if err == nil && wblock.HasOverflow() {
+		newPtr |= blockPtrOverflow
+	}
+
+	return newPtr, err
+}
@@ -0,0 +1,232 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var (
+	// ErrUnknownKey means the key provider does not have the encryption key
+	ErrUnknownKey = errors.New("Unknown encryption key")
+
+	// ErrEncryptionUnsupported means the backup file type cannot be encrypted
+	ErrEncryptionUnsupported = errors.New("Encryption is not supported by the file type")
+
+	errDecryptionFailed = errors.New("Decryption failed")
+)
+
+// KeyProvider supplies the keys for encryption at rest. Keys are identified by
+// a key id recorded along with the encrypted data. Hence, a key should remain
+// available as long as any data encrypted using it exists.
+type KeyProvider interface {
+	// CurrentKey returns the key used for encrypting new data
+	CurrentKey() (id uint32, key []byte, err error)
+	// Key returns the key with the given id for decrypting data
+	Key(id uint32) ([]byte, error)
+}
+
+// KeyRing is an in-memory key provider
+type KeyRing struct {
+	sync.RWMutex
+	keys    map[uint32][]byte
+	current uint32
+}
+
+// NewKeyRing creates an empty key ring
+func NewKeyRing() *KeyRing {
+	return &KeyRing{keys: make(map[uint32][]byte)}
+}
+
+// AddKey adds an AES-128, AES-192 or AES-256 key. If current is set, the key
+// is used for encrypting new data.
+func (r *KeyRing) AddKey(id uint32, key []byte, current bool) error {
+	if _, err := aes.NewCipher(key); err != nil {
+		return err
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	if old, ok := r.keys[id]; ok && string(old) != string(key) {
+		return fmt.Errorf("Key %d already exists", id)
+	}
+
+	r.keys[id] = append([]byte(nil), key...)
+	if current {
+		r.current = id
+	}
+
+	return nil
+}
+
+// SetCurrentKey changes the key used for encrypting new data
+func (r *KeyRing) SetCurrentKey(id uint32) error {
+	r.Lock()
+	defer r.Unlock()
+
+	if _, ok := r.keys[id]; !ok {
+		return ErrUnknownKey
+	}
+
+	r.current = id
+	return nil
+}
+
+func (r *KeyRing) CurrentKey() (uint32, []byte, error) {
+	r.RLock()
+	defer r.RUnlock()
+
+	key, ok := r.keys[r.current]
+	if !ok {
+		return 0, nil, ErrUnknownKey
+	}
+
+	return r.current, key, nil
+}
+
+func (r *KeyRing) Key(id uint32) ([]byte, error) {
+	r.RLock()
+	defer r.RUnlock()
+
+	key, ok := r.keys[id]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+
+	return key, nil
+}
+
+// Encrypted data format
+// [4 byte key id][12 byte nonce][ciphertext][16 byte AES-GCM tag]
+//
+// The additional data authenticated along with the ciphertext binds it
+// to its location. Hence, encrypted blocks cannot be swapped.
+const (
+	encryptionHdrSize   = 4 + encryptionNonceSize
+	encryptionNonceSize = 12
+	encryptionOverhead  = encryptionHdrSize + 16
+)
+
+// encryptor encrypts data using AES-GCM with the keys of a key provider
+type encryptor struct {
+	sync.Mutex
+	kp    KeyProvider
+	aeads map[uint32]cipher.AEAD
+}
+
+func newEncryptor(kp KeyProvider) *encryptor {
+	return &encryptor{
+		kp:    kp,
+		aeads: make(map[uint32]cipher.AEAD),
+	}
+}
+
+// aead returns the cipher for the key id. The key is obtained from the key
+// provider if it is not provided.
+func (e *encryptor) aead(id uint32, key []byte) (cipher.AEAD, error) {
+	e.Lock()
+	defer e.Unlock()
+
+	if aead, ok := e.aeads[id]; ok {
+		return aead, nil
+	}
+
+	if key == nil {
+		var err error
+		if key, err = e.kp.Key(id); err != nil {
+			return nil, err
+		}
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	e.aeads[id] = aead
+	return aead, nil
+}
+
+// currentKey returns the id of the key used for encrypting new data
+func (e *encryptor) currentKey() (uint32, error) {
+	id, key, err := e.kp.CurrentKey()
+	if err == nil {
+		_, err = e.aead(id, key)
+	}
+
+	return id, err
+}
+
+// seal appends the data encrypted using the key id to dst
+func (e *encryptor) seal(dst []byte, id uint32, plain, ad []byte) ([]byte, error) {
+	aead, err := e.aead(id, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var hdr [encryptionHdrSize]byte
+	binary.BigEndian.PutUint32(hdr[0:4], id)
+	if _, err := rand.Read(hdr[4:]); err != nil {
+		return nil, err
+	}
+
+	dst = append(dst, hdr[:]...)
+	return aead.Seal(dst, hdr[4:], plain, ad), nil
+}
+
+// open appends the decrypted data to dst
+func (e *encryptor) open(dst, sealed, ad []byte) ([]byte, error) {
+	if len(sealed) < encryptionOverhead {
+		return nil, errDecryptionFailed
+	}
+
+	aead, err := e.aead(sealedKeyID(sealed), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	plain, err := aead.Open(dst, sealed[4:encryptionHdrSize], sealed[encryptionHdrSize:], ad)
+	if err != nil {
+		return nil, errDecryptionFailed
+	}
+
+	return plain, nil
+}
+
+func sealedKeyID(sealed []byte) uint32 {
+	return binary.BigEndian.Uint32(sealed[0:4])
+}
+
+// locationAD returns the additional data binding encrypted data to a location
+func locationAD(buf []byte, shard int, offset int64) []byte {
+	binary.BigEndian.PutUint32(buf[0:4], uint32(shard))
+	binary.BigEndian.PutUint64(buf[4:12], uint64(offset))
+	return buf[:12]
+}
+
+// objectAD returns the additional data binding encrypted data to an offset of
+// a named backup object
+func objectAD(buf []byte, name string, offset int64) []byte {
+	var off [8]byte
+	binary.BigEndian.PutUint64(off[:], uint64(offset))
+	return append(append(buf[:0], off[:]...), name...)
+}
@@ -9,14 +9,32 @@
 
 package nitro
 
-import "os"
 import "bufio"
+import "bytes"
 import "errors"
+import "fmt"
+import "io"
+import "hash"
+import "hash/crc32"
+import "encoding/binary"
 
 var (
 	// DiskBlockSize - backup file reader and writer
 	DiskBlockSize     = 512 * 1024
 	errNotEnoughSpace = errors.New("Not enough space in the buffer")
+	errInvalidItemLen = errors.New("Invalid item length")
+
+	// ErrItemTooLarge means the item cannot be encoded in the file format
+	ErrItemTooLarge = errors.New("Item is too large for the file format")
+
+	// ErrItemValueUnsupported means the file format cannot store item values
+	ErrItemValueUnsupported = errors.New("Item values are not supported by the file format")
+
+	// ErrComparatorMismatch means a backup file was written using a different
+	// key comparator
+	ErrComparatorMismatch = errors.New("Backup file key comparator mismatch")
+
+	crc32cTable = crc32.MakeTable(crc32.Castagnoli)
 )
 
 // FileType describes backup file format
@@ -25,59 +43,112 @@ type FileType int
 const (
 	encodeBufSize = 4
 	readerBufSize = 10000
-	// RawdbFile - backup file storage format
+	// RawdbFile - backup file storage format for items without a value
 	RawdbFile FileType = iota
+	// ChecksumFile - backup file format with header, checksummed blocks and footer
+	ChecksumFile
+	// CompressedFile - ChecksumFile format with compressed blocks
+	CompressedFile
+	// RawdbVarintFile - RawdbFile format with varint item lengths
+	RawdbVarintFile
+	// RawdbKVFile - RawdbFile format with item value lengths
+	RawdbKVFile
 )
 
+const varintEncodeBufSize = 2 * binary.MaxVarintLen32
+
 // FileWriter represents backup file writer
 type FileWriter interface {
-	Open(path string) error
+	Open(store BackupStore, name string) error
 	WriteItem(*Item) error
 	Close() error
 }
 
 // FileReader represents backup file reader
 type FileReader interface {
-	Open(path string) error
+	Open(store BackupStore, name string) error
 	ReadItem() (*Item, error)
 	Close() error
 }
 
-func (m *Nitro) newFileWriter(t FileType) FileWriter {
+// newFileWriter creates a backup file writer for items of snapshot sn
+func (m *Nitro) newFileWriter(t FileType, sn uint32) FileWriter {
 	var w FileWriter
-	if t == RawdbFile {
+	switch t {
+	case RawdbFile:
 		w = &rawFileWriter{db: m}
+	case RawdbVarintFile:
+		w = &rawFileWriter{db: m, varint: true}
+	case RawdbKVFile:
+		w = &rawFileWriter{db: m, kv: true}
+	case ChecksumFile:
+		w = &checksumFileWriter{db: m, sn: sn, blockSize: checksumBlockSize}
+	case CompressedFile:
+		cw := &checksumFileWriter{db: m, sn: sn, blockSize: checksumBlockSize, codecID: m.codecID}
+		if cw.codecID != NoCodec {
+			cw.blockSize = DiskBlockSize
+		}
+		w = cw
 	}
 	return w
 }
 
 func (m *Nitro) newFileReader(t FileType) FileReader {
 	var r FileReader
-	if t == RawdbFile {
+	switch t {
+	case RawdbFile:
 		r = &rawFileReader{db: m}
+	case RawdbVarintFile:
+		r = &rawFileReader{db: m, varint: true}
+	case RawdbKVFile:
+		r = &rawFileReader{db: m, kv: true}
+	case ChecksumFile, CompressedFile:
+		r = &checksumFileReader{db: m}
 	}
 	return r
 }
 
+// CorruptionError describes a corrupted backup file
+type CorruptionError struct {
+	Path   string
+	Offset int64
+	Reason string
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("Backup file %s is corrupted at offset %d: %s", e.Path, e.Offset, e.Reason)
+}
+
 type rawFileWriter struct {
-	db   *Nitro
-	fd   *os.File
-	w    *bufio.Writer
-	buf  []byte
-	path string
+	db     *Nitro
+	fd     io.WriteCloser
+	w      *bufio.Writer
+	buf    []byte
+	path   string
+	varint bool
+	kv     bool
 }
 
-func (f *rawFileWriter) Open(path string) error {
+func (f *rawFileWriter) Open(store BackupStore, name string) error {
 	var err error
-	f.fd, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0755)
+	if f.db.crypt != nil {
+		return ErrEncryptionUnsupported
+	}
+
+	f.fd, err = store.Create(name)
 	if err == nil {
-		f.buf = make([]byte, encodeBufSize)
+		f.buf = make([]byte, varintEncodeBufSize)
 		f.w = bufio.NewWriterSize(f.fd, DiskBlockSize)
 	}
 	return err
 }
 
 func (f *rawFileWriter) WriteItem(itm *Item) error {
+	if f.varint {
+		return f.db.encodeItemVarint(itm, f.buf, f.w)
+	} else if f.kv {
+		return f.db.encodeItemKV(itm, f.buf, f.w)
+	}
 	return f.db.EncodeItem(itm, f.buf, f.w)
 }
 
@@ -88,21 +159,27 @@ func (f *rawFileWriter) Close() error {
 		return err
 	}
 
-	f.w.Flush()
+	if err := f.w.Flush(); err != nil {
+		f.fd.Close()
+		return err
+	}
+
 	return f.fd.Close()
 }
 
 type rawFileReader struct {
-	db   *Nitro
-	fd   *os.File
-	r    *bufio.Reader
-	buf  []byte
-	path string
+	db     *Nitro
+	fd     BackupObject
+	r      *bufio.Reader
+	buf    []byte
+	path   string
+	varint bool
+	kv     bool
 }
 
-func (f *rawFileReader) Open(path string) error {
+func (f *rawFileReader) Open(store BackupStore, name string) error {
 	var err error
-	f.fd, err = os.Open(path)
+	f.fd, err = store.Open(name)
 	if err == nil {
 		f.buf = make([]byte, encodeBufSize)
 		f.r = bufio.NewReaderSize(f.fd, DiskBlockSize)
@@ -111,9 +188,389 @@ func (f *rawFileReader) Open(path string) error {
 }
 
 func (f *rawFileReader) ReadItem() (*Item, error) {
+	if f.varint {
+		return f.db.decodeItemVarint(f.r)
+	} else if f.kv {
+		return f.db.decodeItemKV(f.buf, f.r)
+	}
 	return f.db.DecodeItem(f.buf, f.r)
 }
 
 func (f *rawFileReader) Close() error {
 	return f.fd.Close()
 }
+
+// Checksum file format
+// header: [4 byte magic][2 byte version][1 byte flags][1 byte codec id]
+// [4 byte comparator id][4 byte snapshot sn][4 byte key id if encrypted]
+// [4 byte header crc32c]
+// blocks: [4 byte payload len][4 byte payload crc32c][varint encoded items]
+// footer: [4 byte zero len][8 byte item count][4 byte file crc32c]
+//
+// The file checksum covers all the bytes preceding it. If the codec id is
+// set, block payloads are compressed and the checksum covers the compressed
+// payload. Version 1 files, which encoded items with 2 byte lengths, were
+// never released and are not readable. Encrypted files are written with
+// version 3. Their block payloads
+// are encrypted after compression using the key of the header and the
+// checksum covers the encrypted payload.
+const (
+	checksumFileMagic      = 0x4e54524f
+	checksumFileVersion    = 2
+	checksumFileEncVersion = 3
+	checksumFileEncrypted  = 0x1
+	checksumFileHdrSize    = 20
+	checksumBlockHdrSize   = 8
+	checksumFileFooterSize = 16
+	checksumBlockSize      = 64 * 1024
+)
+
+type checksumFileWriter struct {
+	db        *Nitro
+	sn        uint32
+	fd        io.WriteCloser
+	w         *bufio.Writer
+	block     bytes.Buffer
+	buf       []byte
+	count     uint64
+	crc       hash.Hash32
+	blockSize int
+
+	codecID uint8
+	codec   Codec
+	cbuf    []byte
+
+	crypt  *encryptor
+	keyID  uint32
+	ebuf   []byte
+	ad     []byte
+	name   string
+	offset int64
+}
+
+func (f *checksumFileWriter) Open(store BackupStore, name string) error {
+	var err error
+	if f.codecID != NoCodec {
+		if f.codec = GetCodec(f.codecID); f.codec == nil {
+			return fmt.Errorf("Unknown codec %d", f.codecID)
+		}
+	}
+
+	version := uint16(checksumFileVersion)
+	if f.crypt = f.db.crypt; f.crypt != nil {
+		if f.keyID, err = f.crypt.currentKey(); err != nil {
+			return err
+		}
+		version = checksumFileEncVersion
+	}
+
+	f.fd, err = store.Create(name)
+	if err != nil {
+		return err
+	}
+
+	f.name = name
+	f.buf = make([]byte, varintEncodeBufSize)
+	f.crc = crc32.New(crc32cTable)
+	f.w = bufio.NewWriterSize(io.MultiWriter(f.fd, f.crc), DiskBlockSize)
+
+	var hdr [checksumFileHdrSize + 4]byte
+	hl := checksumFileHdrSize - 4
+	binary.BigEndian.PutUint32(hdr[0:4], checksumFileMagic)
+	binary.BigEndian.PutUint16(hdr[4:6], version)
+	hdr[7] = f.codecID
+	binary.BigEndian.PutUint32(hdr[8:12], f.db.keyCmpID)
+	binary.BigEndian.PutUint32(hdr[12:16], f.sn)
+	if f.crypt != nil {
+		hdr[6] = checksumFileEncrypted
+		binary.BigEndian.PutUint32(hdr[16:20], f.keyID)
+		hl += 4
+	}
+	binary.BigEndian.PutUint32(hdr[hl:hl+4], crc32.Checksum(hdr[:hl], crc32cTable))
+	return f.write(hdr[:hl+4])
+}
+
+func (f *checksumFileWriter) write(p []byte) error {
+	n, err := f.w.Write(p)
+	f.offset += int64(n)
+	return err
+}
+
+func (f *checksumFileWriter) WriteItem(itm *Item) error {
+	if err := f.db.encodeItemVarint(itm, f.buf, &f.block); err != nil {
+		return err
+	}
+
+	f.count++
+	if f.block.Len() >= f.blockSize {
+		return f.flushBlock()
+	}
+
+	return nil
+}
+
+func (f *checksumFileWriter) flushBlock() error {
+	if f.block.Len() == 0 {
+		return nil
+	}
+
+	var err error
+	payload := f.block.Bytes()
+	if f.codec != nil {
+		if f.cbuf, err = f.codec.Compress(f.cbuf, payload); err != nil {
+			return err
+		}
+		payload = f.cbuf
+	}
+
+	// Encrypted blocks are bound to the file name and their offset in the
+	// file so that blocks cannot be moved between files
+	if f.crypt != nil {
+		f.ad = objectAD(f.ad, f.name, f.offset)
+		if f.ebuf, err = f.crypt.seal(f.ebuf[:0], f.keyID, payload, f.ad); err != nil {
+			return err
+		}
+		payload = f.ebuf
+	}
+
+	var hdr [checksumBlockHdrSize]byte
+	binary.BigEndian.PutUint32(hdr[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(hdr[4:8], crc32.Checksum(payload, crc32cTable))
+	if err := f.write(hdr[:]); err != nil {
+		return err
+	}
+
+	err = f.write(payload)
+	f.block.Reset()
+	return err
+}
+
+func (f *checksumFileWriter) Close() error {
+	var footer [checksumFileFooterSize]byte
+	binary.BigEndian.PutUint64(footer[4:12], f.count)
+
+	err := f.flushBlock()
+	if err == nil {
+		err = f.write(footer[:12])
+	}
+
+	if err == nil {
+		err = f.w.Flush()
+	}
+
+	if err == nil {
+		binary.BigEndian.PutUint32(footer[12:16], f.crc.Sum32())
+		_, err = f.fd.Write(footer[12:16])
+	}
+
+	if cerr := f.fd.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+type checksumFileReader struct {
+	db     *Nitro
+	fd     BackupObject
+	r      *bufio.Reader
+	crc    hash.Hash32
+	block  []byte
+	plain  []byte
+	codec  Codec
+	dec    []byte
+	ad     []byte
+	br     bytes.Reader
+	offset int64
+	size   int64
+	count  uint64
+	sn     uint32
+	name   string
+	path   string
+
+	encrypted bool
+}
+
+func (f *checksumFileReader) corruption(offset int64, reason string) error {
+	return &CorruptionError{Path: f.path, Offset: offset, Reason: reason}
+}
+
+// read reads exactly len(p) bytes and updates the file checksum
+func (f *checksumFileReader) read(p []byte, what string) error {
+	if _, err := io.ReadFull(f.r, p); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return f.corruption(f.offset, "truncated "+what)
+		}
+		return err
+	}
+
+	f.crc.Write(p)
+	f.offset += int64(len(p))
+	return nil
+}
+
+func (f *checksumFileReader) Open(store BackupStore, name string) error {
+	var err error
+	f.fd, err = store.Open(name)
+	if err != nil {
+		return err
+	}
+
+	// Local files are reported by their path
+	f.name = name
+	f.path = name
+	if fd, ok := f.fd.(interface {
+		Name() string
+	}); ok {
+		f.path = fd.Name()
+	}
+	f.crc = crc32.New(crc32cTable)
+	f.r = bufio.NewReaderSize(f.fd, DiskBlockSize)
+
+	hdr := make([]byte, checksumFileHdrSize, checksumFileHdrSize+4)
+	if err = f.read(hdr, "header"); err == nil {
+		version := binary.BigEndian.Uint16(hdr[4:6])
+		f.encrypted = version >= checksumFileEncVersion && hdr[6]&checksumFileEncrypted != 0
+		if f.encrypted {
+			hdr = hdr[:checksumFileHdrSize+4]
+			err = f.read(hdr[checksumFileHdrSize:], "header")
+		}
+	}
+
+	if err == nil {
+		hl := len(hdr) - 4
+		switch {
+		case binary.BigEndian.Uint32(hdr[0:4]) != checksumFileMagic:
+			err = f.corruption(0, "invalid magic")
+		case binary.BigEndian.Uint32(hdr[hl:]) != crc32.Checksum(hdr[:hl], crc32cTable):
+			err = f.corruption(0, "header checksum mismatch")
+		case binary.BigEndian.Uint16(hdr[4:6]) < checksumFileVersion,
+			binary.BigEndian.Uint16(hdr[4:6]) > checksumFileEncVersion:
+			err = fmt.Errorf("Backup file %s has unsupported version %d", name,
+				binary.BigEndian.Uint16(hdr[4:6]))
+		case binary.BigEndian.Uint32(hdr[8:12]) != f.db.keyCmpID:
+			err = ErrComparatorMismatch
+		case f.encrypted && f.db.crypt == nil:
+			err = fmt.Errorf("Backup file %s is encrypted with key %d", name,
+				binary.BigEndian.Uint32(hdr[16:20]))
+		case hdr[7] != NoCodec:
+			if f.codec = GetCodec(hdr[7]); f.codec == nil {
+				err = fmt.Errorf("Backup file %s uses unknown codec %d", name, hdr[7])
+			}
+		}
+	}
+
+	if err != nil {
+		f.fd.Close()
+		return err
+	}
+
+	f.size = f.fd.Size()
+	f.sn = binary.BigEndian.Uint32(hdr[12:16])
+	return nil
+}
+
+func (f *checksumFileReader) ReadItem() (*Item, error) {
+	if f.br.Len() == 0 {
+		if done, err := f.readBlock(); done || err != nil {
+			return nil, err
+		}
+	}
+
+	offset := f.offset - int64(f.br.Len())
+	itm, err := f.db.decodeItemVarint(&f.br)
+	if err != nil || itm == nil {
+		return nil, f.corruption(offset, "invalid item")
+	}
+
+	f.count++
+	return itm, nil
+}
+
+// readBlock loads the next block. It returns true at the end of the file
+// after validating the footer.
+func (f *checksumFileReader) readBlock() (bool, error) {
+	var hdr [checksumBlockHdrSize]byte
+	offset := f.offset
+	if err := f.read(hdr[0:4], "block header"); err != nil {
+		return false, err
+	}
+
+	l := binary.BigEndian.Uint32(hdr[0:4])
+	if l == 0 {
+		return true, f.readFooter()
+	}
+
+	if err := f.read(hdr[4:8], "block header"); err != nil {
+		return false, err
+	}
+
+	// Blocks holding large items are not limited in size
+	if int64(l) > f.size-f.offset {
+		return false, f.corruption(offset, "truncated block")
+	}
+
+	if cap(f.block) < int(l) {
+		f.block = make([]byte, l)
+	}
+	f.block = f.block[:l]
+	if err := f.read(f.block, "block"); err != nil {
+		return false, err
+	}
+
+	if crc32.Checksum(f.block, crc32cTable) != binary.BigEndian.Uint32(hdr[4:8]) {
+		return false, f.corruption(offset, "block checksum mismatch")
+	}
+
+	payload := f.block
+	if f.encrypted {
+		var err error
+		f.ad = objectAD(f.ad, f.name, offset)
+		f.dec, err = f.db.crypt.open(f.dec[:0], payload, f.ad)
+		if err == errDecryptionFailed {
+			return false, f.corruption(offset, "block decryption failed")
+		} else if err != nil {
+			return false, err
+		}
+		payload = f.dec
+	}
+
+	if f.codec != nil {
+		var err error
+		if f.plain, err = f.codec.Decompress(f.plain, payload); err != nil {
+			return false, f.corruption(offset, "invalid compressed block")
+		}
+		payload = f.plain
+	}
+
+	f.br.Reset(payload)
+	return false, nil
+}
+
+func (f *checksumFileReader) readFooter() error {
+	var footer [checksumFileFooterSize]byte
+	offset := f.offset - 4
+
+	if err := f.read(footer[4:12], "footer"); err != nil {
+		return err
+	}
+
+	crc := f.crc.Sum32()
+	if _, err := io.ReadFull(f.r, footer[12:16]); err != nil {
+		return f.corruption(f.offset, "truncated footer")
+	}
+
+	if binary.BigEndian.Uint32(footer[12:16]) != crc {
+		return f.corruption(offset, "file checksum mismatch")
+	}
+
+	if count := binary.BigEndian.Uint64(footer[4:12]); count != f.count {
+		return f.corruption(offset, fmt.Sprintf("expected %d items, found %d", count, f.count))
+	}
+
+	return nil
+}
+
+func (f *checksumFileReader) Close() error {
+	return f.fd.Close()
+}
@@ -0,0 +1,283 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/t3rm1n4l/nitro/skiplist"
+)
+
+// Incremental backup layout
+// data/    - items which became visible after the base snapshot
+// deletes/ - items of the base snapshot which are no longer visible
+// The manifest records the snapshot numbers of the range
+
+func (m *Nitro) openShardWriters(store BackupStore, dir string, shards int, sn uint32) ([]FileWriter, []string, error) {
+	writers := make([]FileWriter, shards)
+	files := make([]string, shards)
+
+	for shard := 0; shard < shards; shard++ {
+		w := m.newFileWriter(m.fileType, sn)
+		file := fmt.Sprintf("shard-%d", shard)
+		if err := w.Open(store, dir+"/"+file); err != nil {
+			return writers, files, err
+		}
+
+		writers[shard] = w
+		files[shard] = file
+	}
+
+	return writers, files, nil
+}
+
+// StoreIncremental backups the changes between two snapshots to disk. Items
+// which became visible after baseSnap are stored as inserts and items of
+// baseSnap which are no longer visible in snap are stored as deletes.
+// Both the snapshots should be kept open by the caller until it returns.
+//
+// The deletes are found from the items which died after baseSnap. Hence,
+// baseSnap holds the items deleted or replaced after it from being garbage
+// collected for as long as it is open, and the memory held by them grows
+// with the changes made since baseSnap. The caller should close baseSnap
+// once the incremental backup is stored and keep snap open as the base of
+// the next incremental backup only if incremental backups are taken often
+// enough for the retained changes to fit in memory.
+func (m *Nitro) StoreIncremental(dir string, baseSnap, snap *Snapshot, concurr int) error {
+	return m.StoreIncrementalToBackupStore(NewDirBackupStore(dir), baseSnap, snap, concurr)
+}
+
+// StoreIncrementalToBackupStore backups the changes between two snapshots to
+// a backup store. Like StoreIncremental, the base snapshot delays garbage
+// collection of the items deleted after it while it is open.
+func (m *Nitro) StoreIncrementalToBackupStore(backupStore BackupStore, baseSnap, snap *Snapshot,
+	concurr int) (err error) {
+	if baseSnap.sn >= snap.sn {
+		return fmt.Errorf("Base snapshot %d is not older than snapshot %d", baseSnap.sn, snap.sn)
+	}
+
+	if err := beginBackup(backupStore); err != nil {
+		return err
+	}
+
+	if m.useMemoryMgmt {
+		m.shutdownWg1.Add(1)
+		defer m.shutdownWg1.Done()
+	}
+
+	shards := runtime.NumCPU()
+	store := newManifestStore(backupStore)
+	manifest := m.newBackupManifest(snap)
+	manifest.Incremental = true
+	manifest.BaseSnapshot = baseSnap.sn
+	insCounts := make([]int64, shards)
+	delCounts := make([]int64, shards)
+
+	insWriters, insFiles, err := m.openShardWriters(store, "data", shards, snap.sn)
+	defer closeFileWriters(insWriters)
+	if err != nil {
+		return err
+	}
+
+	delWriters, delFiles, err := m.openShardWriters(store, "deletes", shards, snap.sn)
+	defer closeFileWriters(delWriters)
+	if err != nil {
+		return err
+	}
+
+	changed := func(itm *Item) bool {
+		return baseSnap.isVisible(itm) != snap.isVisible(itm)
+	}
+
+	visitorCallback := func(itm *Item, shard int) error {
+		if m.hasShutdown {
+			return ErrShutdown
+		}
+
+		w := insWriters[shard]
+		if snap.isVisible(itm) {
+			insCounts[shard]++
+		} else {
+			w = delWriters[shard]
+			delCounts[shard]++
+		}
+
+		return w.WriteItem(itm)
+	}
+
+	if err = m.visitor(snap, changed, visitorCallback, shards, concurr); err != nil {
+		return err
+	}
+
+	if err = closeFileWriters(insWriters); err != nil {
+		return err
+	}
+
+	if err = closeFileWriters(delWriters); err != nil {
+		return err
+	}
+
+	bs, _ := json.Marshal(delFiles)
+	if err = store.Commit("deletes/files.json", bs); err != nil {
+		return err
+	}
+
+	bs, _ = json.Marshal(insFiles)
+	if err = store.Commit("data/files.json", bs); err != nil {
+		return err
+	}
+
+	for shard := range insCounts {
+		manifest.ItemsCount += insCounts[shard]
+		manifest.DeletesCount += delCounts[shard]
+	}
+
+	return store.commit(manifest)
+}
+
+// closeFileWriters closes the open writers and returns the first error
+func closeFileWriters(writers []FileWriter) error {
+	var err error
+	for i, w := range writers {
+		if w != nil {
+			if cerr := w.Close(); err == nil {
+				err = cerr
+			}
+			writers[i] = nil
+		}
+	}
+
+	return err
+}
+
+// loadIncremental applies an incremental backup on top of the backup of
+// snapshot sn and returns the snapshot number of the incremental backup.
+func (m *Nitro) loadIncremental(store BackupStore, sn uint32, writers []*Writer,
+	nodeCallb skiplist.NodeCallback) (uint32, error) {
+
+	manifest, err := ReadBackupManifest(store)
+	if err != nil {
+		return 0, err
+	}
+
+	if !manifest.Incremental || manifest.BaseSnapshot != sn {
+		return 0, ErrIncrementalChain
+	}
+
+	// Deletes are applied first since a deleted item may be replaced
+	// by a newer item with the same key.
+	err = m.applyBackupFiles(store, "deletes", manifest.FileType, writers,
+		func(w *Writer, itm *Item) {
+			w.Delete(itm.Key())
+			w.freeItem(itm)
+		})
+	if err != nil {
+		return 0, err
+	}
+
+	// Restored items are born with snapshot number 0 and are ordered by
+	// deadSn after deletion. The new items are born in the next snapshot
+	// interval to avoid collisions with the deleted items.
+	atomic.AddUint32(&m.currSn, 1)
+
+	err = m.applyBackupFiles(store, "data", manifest.FileType, writers,
+		func(w *Writer, itm *Item) {
+			itm.bornSn = w.getCurrSn()
+			if n, success := w.store.Insert2(unsafe.Pointer(itm),
+				w.insCmp, w.existCmp, w.buf, w.rand.Float32, &w.slSts1); success {
+				w.count++
+				if nodeCallb != nil {
+					nodeCallb(n)
+				}
+			} else {
+				w.freeItem(itm)
+			}
+		})
+	if err != nil {
+		return 0, err
+	}
+
+	return manifest.Snapshot, nil
+}
+
+// applyBackupFiles concurrently reads the backup files in dir and calls fn
+// for every item using one writer per reader.
+func (m *Nitro) applyBackupFiles(store BackupStore, dir string, t FileType, writers []*Writer,
+	fn func(*Writer, *Item)) error {
+	var wg sync.WaitGroup
+	var files []string
+
+	bs, err := readObject(store, dir+"/files.json")
+	if err != nil {
+		return err
+	}
+	json.Unmarshal(bs, &files)
+
+	readers := make([]FileReader, len(files))
+	errors := make([]error, len(files))
+	defer func() {
+		for _, r := range readers {
+			if r != nil {
+				r.Close()
+			}
+		}
+	}()
+
+	for i, file := range files {
+		r := m.newFileReader(t)
+		if err := r.Open(store, dir+"/"+file); err != nil {
+			return err
+		}
+		readers[i] = r
+	}
+
+	wchan := make(chan int)
+	for i := range writers {
+		wg.Add(1)
+		go func(wg *sync.WaitGroup, w *Writer) {
+			defer wg.Done()
+
+			for shard := range wchan {
+				r := readers[shard]
+				for {
+					itm, err := r.ReadItem()
+					if err != nil {
+						errors[shard] = err
+						break
+					}
+
+					if itm == nil {
+						break
+					}
+					fn(w, itm)
+				}
+			}
+		}(&wg, writers[i])
+	}
+
+	for i := range files {
+		wchan <- i
+	}
+	close(wchan)
+	wg.Wait()
+
+	for _, err := range errors {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -12,26 +12,38 @@ package nitro
 import (
 	"encoding/binary"
 	"io"
+	"math"
 	"reflect"
 	"unsafe"
 )
 
 var itemHeaderSize = unsafe.Sizeof(Item{})
 
+// maxItemSize is the largest item which can be logged or restored
+const maxItemSize = 1 << 30
+
 // Item represents nitro item header
 // The item data is followed by the header.
-// Item data is a block of bytes. The user can store key and value into a
-// block of bytes and provide custom key comparator.
+// Item data is a block of bytes made of the key followed by an optional value.
+// The user can either store key and value into a single block of bytes and
+// provide custom key comparator, or store the value separately so that the
+// key comparator only sees the key.
 type Item struct {
 	bornSn  uint32
 	deadSn  uint32
 	dataLen uint32
+	valLen  uint32
 }
 
 func (m *Nitro) newItem(data []byte, useMM bool) (itm *Item) {
-	l := len(data)
-	itm = m.allocItem(l, useMM)
-	copy(itm.Bytes(), data)
+	return m.newKVItem(data, nil, useMM)
+}
+
+func (m *Nitro) newKVItem(key, val []byte, useMM bool) (itm *Item) {
+	itm = m.allocItem(len(key)+len(val), useMM)
+	itm.valLen = uint32(len(val))
+	copy(itm.Key(), key)
+	copy(itm.Value(), val)
 	return itm
 }
 
@@ -47,6 +59,7 @@ func (m *Nitro) allocItem(l int, useMM bool) (itm *Item) {
 		itm = (*Item)(m.mallocFun(int(blockSize)))
 		itm.deadSn = 0
 		itm.bornSn = 0
+		itm.valLen = 0
 	} else {
 		block := make([]byte, blockSize)
 		itm = (*Item)(unsafe.Pointer(&block[0]))
@@ -56,13 +69,22 @@ func (m *Nitro) allocItem(l int, useMM bool) (itm *Item) {
 	return
 }
 
-// EncodeItem encodes in [2 byte len][item_bytes] format.
+// EncodeItem encodes in [2 byte len][item_bytes] format. The value length is
+// not encoded. Hence, items with a value cannot be encoded.
 func (m *Nitro) EncodeItem(itm *Item, buf []byte, w io.Writer) error {
 	l := 2
 	if len(buf) < l {
 		return errNotEnoughSpace
 	}
 
+	if itm.dataLen > math.MaxUint16 {
+		return ErrItemTooLarge
+	}
+
+	if itm.valLen > 0 {
+		return ErrItemValueUnsupported
+	}
+
 	binary.BigEndian.PutUint16(buf[0:2], uint16(itm.dataLen))
 	if _, err := w.Write(buf[0:2]); err != nil {
 		return err
@@ -83,15 +105,124 @@ func (m *Nitro) DecodeItem(buf []byte, r io.Reader) (*Item, error) {
 	l := binary.BigEndian.Uint16(buf[0:2])
 	if l > 0 {
 		itm := m.allocItem(int(l), m.useMemoryMgmt)
-		data := itm.Bytes()
-		_, err := io.ReadFull(r, data)
-		return itm, err
+		return m.readItemData(itm, r)
+	}
+
+	return nil, nil
+}
+
+// encodeItemKV encodes in [2 byte len][2 byte value len][item_bytes] format.
+func (m *Nitro) encodeItemKV(itm *Item, buf []byte, w io.Writer) error {
+	l := 4
+	if len(buf) < l {
+		return errNotEnoughSpace
+	}
+
+	if itm.dataLen > math.MaxUint16 {
+		return ErrItemTooLarge
+	}
+
+	binary.BigEndian.PutUint16(buf[0:2], uint16(itm.dataLen))
+	binary.BigEndian.PutUint16(buf[2:4], uint16(itm.valLen))
+	if _, err := w.Write(buf[0:4]); err != nil {
+		return err
+	}
+	if _, err := w.Write(itm.Bytes()); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// decodeItemKV decodes encoded [2 byte len][2 byte value len][item_bytes] format.
+func (m *Nitro) decodeItemKV(buf []byte, r io.Reader) (*Item, error) {
+	if _, err := io.ReadFull(r, buf[0:4]); err != nil {
+		return nil, err
+	}
+
+	l := binary.BigEndian.Uint16(buf[0:2])
+	vl := binary.BigEndian.Uint16(buf[2:4])
+	if vl > l {
+		return nil, errInvalidItemLen
+	}
+
+	if l > 0 {
+		itm := m.allocItem(int(l), m.useMemoryMgmt)
+		itm.valLen = uint32(vl)
+		return m.readItemData(itm, r)
+	}
+
+	return nil, nil
+}
+
+// encodeItemVarint encodes in [uvarint len][uvarint value len][item_bytes] format.
+func (m *Nitro) encodeItemVarint(itm *Item, buf []byte, w io.Writer) error {
+	if len(buf) < varintEncodeBufSize {
+		return errNotEnoughSpace
+	}
+
+	if itm.dataLen > maxItemSize {
+		return ErrItemTooLarge
+	}
+
+	n := binary.PutUvarint(buf, uint64(itm.dataLen))
+	n += binary.PutUvarint(buf[n:], uint64(itm.valLen))
+	if _, err := w.Write(buf[:n]); err != nil {
+		return err
+	}
+	if _, err := w.Write(itm.Bytes()); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// decodeItemVarint decodes encoded [uvarint len][uvarint value len][item_bytes] format.
+func (m *Nitro) decodeItemVarint(r byteReader) (*Item, error) {
+	l, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+
+	vl, err := binary.ReadUvarint(r)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	// The length is validated before the item is allocated since files
+	// without checksums may be corrupted
+	if l > maxItemSize || vl > l {
+		return nil, errInvalidItemLen
+	}
+
+	if l > 0 {
+		itm := m.allocItem(int(l), m.useMemoryMgmt)
+		itm.valLen = uint32(vl)
+		return m.readItemData(itm, r)
 	}
 
 	return nil, nil
 }
 
-// Bytes return item data bytes
+// readItemData reads the item bytes. The item is freed if it cannot be read.
+func (m *Nitro) readItemData(itm *Item, r io.Reader) (*Item, error) {
+	if _, err := io.ReadFull(r, itm.Bytes()); err != nil {
+		m.freeItem(itm)
+		return nil, err
+	}
+
+	return itm, nil
+}
+
+// Bytes return item data bytes, which is the key followed by the value
 func (itm *Item) Bytes() (bs []byte) {
 	if itm == nil {
 		return
@@ -107,6 +238,26 @@ func (itm *Item) Bytes() (bs []byte) {
 	return
 }
 
+// Key returns the item key bytes
+func (itm *Item) Key() []byte {
+	if itm == nil {
+		return nil
+	}
+
+	bs := itm.Bytes()
+	return bs[:len(bs)-int(itm.valLen)]
+}
+
+// Value returns the item value bytes
+func (itm *Item) Value() []byte {
+	if itm == nil {
+		return nil
+	}
+
+	bs := itm.Bytes()
+	return bs[len(bs)-int(itm.valLen):]
+}
+
 // ItemSize returns total bytes consumed by item representation
 func ItemSize(p unsafe.Pointer) int {
 	itm := (*Item)(p)
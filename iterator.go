@@ -10,7 +10,9 @@
 package nitro
 
 import (
+	"bytes"
 	"github.com/t3rm1n4l/nitro/skiplist"
+	"sync/atomic"
 	"unsafe"
 )
 
@@ -23,21 +25,38 @@ type Iterator struct {
 	iter *skiplist.Iterator
 	buf  *skiplist.ActionBuffer
 
+	// Optional item visibility filter to be used instead of the snapshot
+	visible func(*Item) bool
+
 	blockBuf []byte
 
-	block dataBlock
-	curr  []byte
+	// Entries of the current data block
+	keys, vals [][]byte
+	pos        int
+	err        error
+
+	// Iterator bounds. A nil bound is unlimited.
+	lo, hi      []byte
+	loExclusive bool
+	hiInclusive bool
+	prefix      []byte
+	// Seeks scan for the keys with the prefix
+	scanPrefix bool
+}
 
-	endItm *Item
+// RangeOptions specifies whether the bounds of a range iterator are included
+// in the range. By default, range is [lo, hi).
+type RangeOptions struct {
+	LowExclusive  bool
+	HighInclusive bool
 }
 
-func (it *Iterator) skipItem(ptr unsafe.Pointer) bool {
-	itm := (*Item)(ptr)
-	if ptr != skiplist.MaxItem && itm.bornSn > it.snap.sn {
-		return true
+func (it *Iterator) isVisible(itm *Item) bool {
+	if it.visible != nil {
+		return it.visible(itm)
 	}
 
-	return false
+	return it.snap.isVisible(itm)
 }
 
 func (it *Iterator) skipUnwanted() {
@@ -46,49 +65,141 @@ loop:
 		return
 	}
 	itm := (*Item)(it.iter.Get())
-	if itm.bornSn > it.snap.sn || (itm.deadSn > 0 && itm.deadSn <= it.snap.sn) {
+	if !it.isVisible(itm) {
 		it.iter.Next()
 		it.count++
 		goto loop
 	}
 }
 
-func (it *Iterator) loadItems() {
-	if it.snap.db.HasBlockStore() && it.iter.Valid() {
+func (it *Iterator) skipUnwantedReverse() {
+loop:
+	if !it.iter.Valid() {
+		return
+	}
+	itm := (*Item)(it.iter.Get())
+	if !it.isVisible(itm) {
+		it.iter.PrevWithCmp(it.snap.db.insCmp)
+		it.count++
+		goto loop
+	}
+}
+
+// loadItems reads the data block of the current index node and positions
+// the cursor at its first or last entry. The iterator becomes invalid if the
+// block cannot be read.
+func (it *Iterator) loadItems(last bool) {
+	it.keys = it.keys[:0]
+	it.vals = it.vals[:0]
+	if it.snap.db.HasBlockStore() && it.iter.Valid() && it.err == nil {
 		n := it.GetNode()
-		if err := it.snap.db.bm.ReadBlock(blockPtr(n.DataPtr), it.blockBuf); err != nil {
-			panic(err)
+		bptr := blockPtr(atomic.LoadUint64(&n.DataPtr))
+		block, err := readDataBlock(it.snap.db.bm, bptr, it.blockBuf)
+		if err != nil {
+			it.err = err
+			return
+		}
+
+		for k, v := block.Get(); k != nil; k, v = block.Get() {
+			it.keys = append(it.keys, k)
+			it.vals = append(it.vals, v)
 		}
 
-		it.block = *newDataBlock(it.blockBuf)
-		it.curr = it.block.Get()
+		if it.err = block.Err(); it.err != nil {
+			it.keys = it.keys[:0]
+			it.vals = it.vals[:0]
+			return
+		}
+
+		it.pos = 0
+		if last {
+			it.pos = len(it.keys) - 1
+		}
 	}
 }
 
+func (it *Iterator) inBlock() bool {
+	return it.pos >= 0 && it.pos < len(it.keys)
+}
+
 // SeekFirst moves cursor to the beginning
 func (it *Iterator) SeekFirst() {
+	if it.lo != nil {
+		it.seekLow()
+		return
+	}
+
 	it.iter.SeekFirst()
 	it.skipUnwanted()
-	it.loadItems()
+	it.loadItems(false)
+	it.seekPrefix(false)
+}
+
+// SeekLast moves cursor to the last item
+func (it *Iterator) SeekLast() {
+	if it.hi != nil {
+		it.seekHigh()
+		return
+	}
+
+	it.iter.SeekLast()
+	it.skipUnwantedReverse()
+	it.loadItems(true)
+	it.seekPrefix(true)
+}
+
+// seekPrefix moves the cursor to the nearest key with the prefix if the
+// prefix does not bound the iterator
+func (it *Iterator) seekPrefix(reverse bool) {
+	if !it.scanPrefix {
+		return
+	}
+
+	for it.err == nil && it.iter.Valid() && !bytes.HasPrefix(it.Get(), it.prefix) {
+		if reverse {
+			it.Prev()
+		} else {
+			it.Next()
+		}
+	}
+}
+
+func (it *Iterator) seekLow() {
+	it.seek(it.lo)
+	if it.loExclusive && it.iter.Valid() && it.snap.db.keyCmp(it.Get(), it.lo) == 0 {
+		it.Next()
+	}
+}
+
+func (it *Iterator) seekHigh() {
+	it.seekForPrev(it.hi)
+	if !it.hiInclusive && it.iter.Valid() && it.snap.db.keyCmp(it.Get(), it.hi) == 0 {
+		it.Prev()
+	}
 }
 
 // Seek to a specified key or the next bigger one if an item with key does not
 // exist.
 func (it *Iterator) Seek(bs []byte) {
-	if bs == nil {
+	if bs == nil || (it.lo != nil && it.snap.db.keyCmp(bs, it.lo) <= 0) {
 		it.SeekFirst()
 		return
 	}
 
+	it.seek(bs)
+	it.seekPrefix(false)
+}
+
+func (it *Iterator) seek(bs []byte) {
 	itm := it.snap.db.newItem(bs, false)
 	if it.snap.db.HasBlockStore() {
-		it.iter.SeekPrev(unsafe.Pointer(itm), it.skipItem)
+		it.iter.SeekPrev(unsafe.Pointer(itm), it.snap.skipInvisible)
 		it.skipUnwanted()
-		it.loadItems()
-		for ; it.curr != nil && it.snap.db.keyCmp(it.curr, bs) < 0; it.curr = it.block.Get() {
+		it.loadItems(false)
+		for ; it.inBlock() && it.snap.db.keyCmp(it.keys[it.pos], bs) < 0; it.pos++ {
 		}
 
-		if it.curr == nil {
+		if !it.inBlock() {
 			it.Next()
 		}
 	} else {
@@ -97,30 +208,94 @@ func (it *Iterator) Seek(bs []byte) {
 	}
 }
 
+// SeekForPrev moves cursor to a specified key or the previous smaller one if
+// an item with key does not exist.
+func (it *Iterator) SeekForPrev(bs []byte) {
+	if bs == nil || (it.hi != nil && it.snap.db.keyCmp(bs, it.hi) >= 0) {
+		it.SeekLast()
+		return
+	}
+
+	it.seekForPrev(bs)
+	it.seekPrefix(true)
+}
+
+func (it *Iterator) seekForPrev(bs []byte) {
+	it.seek(bs)
+	if !it.iter.Valid() {
+		it.iter.SeekLast()
+		it.skipUnwantedReverse()
+		it.loadItems(true)
+	} else if it.snap.db.keyCmp(it.Get(), bs) > 0 {
+		it.Prev()
+	}
+}
+
+// SetEnd sets an exclusive upper bound for the iterator
 func (it *Iterator) SetEnd(bs []byte) {
 	if len(bs) > 0 {
-		it.endItm = it.snap.db.newItem(bs, false)
+		it.hi = append([]byte(nil), bs...)
+		it.hiInclusive = false
 	}
 }
 
-// Valid returns false when the iterator has reached the end.
+// Valid returns false when the iterator has reached the end or moved
+// outside the iterator bounds. It also returns false once a block store
+// block cannot be read. Err returns the error in that case.
 func (it *Iterator) Valid() bool {
-	if it.iter.Valid() {
-		if it.endItm != nil && it.snap.db.iterCmp(it.iter.Get(), unsafe.Pointer(it.endItm)) >= 0 {
+	if it.err == nil && it.iter.Valid() {
+		return it.inRange(it.Get())
+	}
+
+	return false
+}
+
+// Err returns the error which made the iterator invalid, such as a
+// *BlockCorruptionError
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+func (it *Iterator) inRange(key []byte) bool {
+	if it.lo != nil {
+		if cmp := it.snap.db.keyCmp(key, it.lo); cmp < 0 || (cmp == 0 && it.loExclusive) {
 			return false
 		}
-		return true
 	}
 
-	return false
+	if it.hi != nil {
+		if cmp := it.snap.db.keyCmp(key, it.hi); cmp > 0 || (cmp == 0 && !it.hiInclusive) {
+			return false
+		}
+	}
+
+	if it.prefix != nil && !bytes.HasPrefix(key, it.prefix) {
+		return false
+	}
+
+	return true
 }
 
-// Get eturns the current item data from the iterator.
+// Get eturns the current item key from the iterator.
 func (it *Iterator) Get() []byte {
 	if it.snap.db.HasBlockStore() {
-		return it.curr
+		if it.inBlock() {
+			return it.keys[it.pos]
+		}
+		return nil
+	}
+	return (*Item)(it.iter.Get()).Key()
+}
+
+// Value returns the current item value from the iterator.
+func (it *Iterator) Value() []byte {
+	if it.snap.db.HasBlockStore() {
+		if it.inBlock() {
+			return it.vals[it.pos]
+		}
+		return nil
 	}
-	return (*Item)(it.iter.Get()).Bytes()
+	return (*Item)(it.iter.Get()).Value()
 }
 
 // GetNode eturns the current skiplist node which holds current item.
@@ -131,7 +306,7 @@ func (it *Iterator) GetNode() *skiplist.Node {
 // Next moves iterator cursor to the next item
 func (it *Iterator) Next() {
 	if it.snap.db.HasBlockStore() && it.iter.Valid() {
-		if it.curr = it.block.Get(); it.curr != nil {
+		if it.pos++; it.inBlock() {
 			return
 		}
 	}
@@ -143,18 +318,37 @@ func (it *Iterator) Next() {
 		it.Refresh()
 		it.count = 0
 	}
-	it.loadItems()
+	it.loadItems(false)
+}
+
+// Prev moves iterator cursor to the previous item
+func (it *Iterator) Prev() {
+	if it.snap.db.HasBlockStore() && it.iter.Valid() {
+		if it.pos--; it.inBlock() {
+			return
+		}
+	}
+
+	it.iter.PrevWithCmp(it.snap.db.insCmp)
+	it.count++
+	it.skipUnwantedReverse()
+	if it.refreshRate > 0 && it.count > it.refreshRate {
+		it.Refresh()
+		it.count = 0
+	}
+	it.loadItems(true)
 }
 
 // Refresh is a helper API to call refresh accessor tokens manually
 // This would enable SMR to reclaim objects faster if an iterator is
 // alive for a longer duration of time.
 func (it *Iterator) Refresh() {
-	if it.Valid() {
+	if it.iter.Valid() {
 		itm := it.snap.db.ptrToItem(it.GetNode().Item())
 		it.iter.Close()
 		it.iter = it.snap.db.store.NewIterator(it.snap.db.iterCmp, it.buf)
 		it.iter.Seek(unsafe.Pointer(itm))
+		it.skipUnwanted()
 	}
 }
 
@@ -185,8 +379,64 @@ func (m *Nitro) NewIterator(snap *Snapshot) *Iterator {
 	}
 
 	if snap.db.HasBlockStore() {
-		it.blockBuf = make([]byte, blockSize, blockSize)
+		it.blockBuf = make([]byte, m.blockSize, m.blockSize)
+	}
+
+	return it
+}
+
+// NewRangeIterator creates an iterator over the keys between lo and hi.
+// A nil bound leaves that end of the range open.
+func (m *Nitro) NewRangeIterator(snap *Snapshot, lo, hi []byte, opts RangeOptions) *Iterator {
+	it := m.NewIterator(snap)
+	if it != nil {
+		if lo != nil {
+			it.lo = append([]byte(nil), lo...)
+		}
+		if hi != nil {
+			it.hi = append([]byte(nil), hi...)
+		}
+		it.loExclusive = opts.LowExclusive
+		it.hiInclusive = opts.HighInclusive
 	}
 
 	return it
 }
+
+// NewPrefixIterator creates an iterator over the keys which start with
+// prefix. Keys sharing a prefix are expected to be ordered contiguously
+// by the key comparator. With a custom key comparator, the position of the
+// prefix keys is not known and seeks scan the keys up to the first key with
+// the prefix.
+func (m *Nitro) NewPrefixIterator(snap *Snapshot, prefix []byte) *Iterator {
+	var it *Iterator
+
+	// Only the bytewise order places the keys with a prefix between the
+	// prefix and its successor
+	if m.bytewiseKeyCmp {
+		it = m.NewRangeIterator(snap, prefix, prefixSuccessor(prefix), RangeOptions{})
+	} else {
+		it = m.NewIterator(snap)
+	}
+
+	if it != nil {
+		it.prefix = append([]byte{}, prefix...)
+		it.scanPrefix = !m.bytewiseKeyCmp
+	}
+
+	return it
+}
+
+// prefixSuccessor returns the smallest key greater than all the keys with
+// the given prefix or nil if there is none.
+func prefixSuccessor(prefix []byte) []byte {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] != 0xff {
+			succ := append([]byte(nil), prefix[:i+1]...)
+			succ[i]++
+			return succ
+		}
+	}
+
+	return nil
+}
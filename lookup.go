@@ -0,0 +1,133 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"github.com/t3rm1n4l/nitro/skiplist"
+	"sync/atomic"
+	"unsafe"
+)
+
+// lookup performs point lookups on a snapshot by walking the skiplist
+// directly instead of going through an Iterator.
+type lookup struct {
+	snap  *Snapshot
+	buf   *skiplist.ActionBuffer
+	token *skiplist.BarrierSession
+
+	// Currently loaded data block
+	blockBuf []byte
+	bptr     blockPtr
+	block    *dataBlock
+}
+
+func (s *Snapshot) newLookup() *lookup {
+	db := s.db
+	l := &lookup{
+		snap:  s,
+		buf:   db.lookupBufs.Get().(*skiplist.ActionBuffer),
+		token: db.store.GetAccesBarrier().Acquire(),
+	}
+
+	if db.HasBlockStore() {
+		l.blockBuf = db.blockBufs.Get().([]byte)
+	}
+
+	return l
+}
+
+func (l *lookup) close() {
+	db := l.snap.db
+	db.store.GetAccesBarrier().Release(l.token)
+	db.lookupBufs.Put(l.buf)
+	if l.blockBuf != nil {
+		db.blockBufs.Put(l.blockBuf)
+	}
+}
+
+func (l *lookup) get(key []byte) ([]byte, bool, error) {
+	db := l.snap.db
+	itm := db.newItem(key, false)
+	if db.HasBlockStore() {
+		return l.getFromBlock(itm)
+	}
+
+	_, n := db.store.FindNode(unsafe.Pointer(itm), db.iterCmp, nil, l.buf, &db.store.Stats)
+	for ; n != nil; n = db.store.NextNode(n) {
+		x := (*Item)(n.Item())
+		if db.keyCmp(x.Key(), key) != 0 {
+			break
+		}
+
+		if l.snap.isVisible(x) {
+			return lookupValue(x.Key(), x.Value()), true, nil
+		}
+	}
+
+	return nil, false, nil
+}
+
+// lookupValue returns the value of an item found by a lookup. Items without
+// a value, such as the items written using Put, are returned as a whole since
+// they carry the key and the value packed together.
+func lookupValue(key, val []byte) []byte {
+	if len(val) == 0 {
+		return key
+	}
+
+	return val
+}
+
+// getFromBlock locates the only data block which can hold the key and
+// searches the key within the block.
+func (l *lookup) getFromBlock(itm *Item) ([]byte, bool, error) {
+	db := l.snap.db
+	key := itm.Key()
+	prev, curr := db.store.FindNode(unsafe.Pointer(itm), db.iterCmp,
+		l.snap.skipInvisible, l.buf, &db.store.Stats)
+
+	n := prev
+	if curr != nil && db.keyCmp((*Item)(curr.Item()).Key(), key) == 0 {
+		n = curr
+	}
+
+	if n == nil {
+		return nil, false, nil
+	}
+
+	// Blocks are moved by the block store compaction
+	// Corrupted blocks are never served as items.
+	bptr := blockPtr(atomic.LoadUint64(&n.DataPtr))
+	if l.block == nil || l.bptr != bptr {
+		l.block = nil
+		block, err := readDataBlock(db.bm, bptr, l.blockBuf)
+		if err != nil {
+			return nil, false, err
+		}
+		l.bptr = bptr
+		l.block = block
+	}
+
+	block := *l.block
+	for k, v := block.Get(); k != nil; k, v = block.Get() {
+		cmpval := db.keyCmp(k, key)
+		if cmpval == 0 {
+			return append([]byte{}, lookupValue(k, v)...), true, nil
+		} else if cmpval > 0 {
+			break
+		}
+	}
+
+	if err := block.Err(); err != nil {
+		return nil, false, err
+	}
+
+	return nil, false, nil
+}
@@ -0,0 +1,244 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	backupManifestVersion = 1
+	backupManifestFile    = "manifest.json"
+	// backupMarkerFile exists while a backup is written. It distinguishes
+	// an interrupted backup from a backup taken before manifests existed.
+	backupMarkerFile = "backup.inprogress"
+)
+
+// ErrIncompleteBackup means the backup does not have a manifest. The backup
+// was either interrupted or failed.
+var ErrIncompleteBackup = errors.New("Backup is incomplete")
+
+// BackupManifest describes a complete backup. It is committed atomically
+// after all the other objects of the backup are written.
+type BackupManifest struct {
+	Version           int              `json:"version"`
+	Snapshot          uint32           `json:"snapshot"`
+	SnapshotTime      time.Time        `json:"snapshot_time"`
+	Incremental       bool             `json:"incremental"`
+	BaseSnapshot      uint32           `json:"base_snapshot,omitempty"`
+	ItemsCount        int64            `json:"items_count"`
+	DeletesCount      int64            `json:"deletes_count,omitempty"`
+	CreatedAt         time.Time        `json:"created_at"`
+	FileType          FileType         `json:"file_type"`
+	DeltaInterleaving bool             `json:"delta_interleaving"`
+	KeyComparatorID   uint32           `json:"key_comparator_id"`
+	CodecID           uint8            `json:"codec_id"`
+	Files             []BackupFileInfo `json:"files"`
+}
+
+// BackupFileInfo describes a backup file
+type BackupFileInfo struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	// crc32c of the file contents
+	Checksum uint32 `json:"checksum"`
+}
+
+func (m *Nitro) newBackupManifest(snap *Snapshot) *BackupManifest {
+	return &BackupManifest{
+		Version:           backupManifestVersion,
+		Snapshot:          snap.sn,
+		SnapshotTime:      snap.created,
+		CreatedAt:         time.Now(),
+		FileType:          m.fileType,
+		DeltaInterleaving: m.useDeltaFiles,
+		KeyComparatorID:   m.keyCmpID,
+		CodecID:           m.codecID,
+	}
+}
+
+// Legacy reports whether the backup was taken before backup manifests were
+// introduced. The snapshot number, item counts and file checksums of such a
+// backup are unknown.
+func (bm *BackupManifest) Legacy() bool {
+	return bm.Version == 0
+}
+
+// ReadBackupManifest returns the manifest of a complete backup. A manifest
+// is made up for a backup taken before backup manifests were introduced.
+func ReadBackupManifest(store BackupStore) (*BackupManifest, error) {
+	bs, err := readObject(store, backupManifestFile)
+	if err == ErrBackupObjectNotFound {
+		return readLegacyManifest(store)
+	} else if err != nil {
+		return nil, err
+	}
+
+	var manifest BackupManifest
+	if err := json.Unmarshal(bs, &manifest); err != nil {
+		return nil, fmt.Errorf("Invalid backup manifest (%v)", err)
+	}
+
+	if manifest.Version > backupManifestVersion {
+		return nil, fmt.Errorf("Backup manifest has unsupported version %d", manifest.Version)
+	}
+
+	return &manifest, nil
+}
+
+// readLegacyManifest describes a backup without a manifest. Such backups
+// only have the files.json lists, which were written once the backup files
+// were complete. Their files are in the RawdbFile format.
+func readLegacyManifest(store BackupStore) (*BackupManifest, error) {
+	if _, err := readObject(store, backupMarkerFile); err == nil {
+		return nil, ErrIncompleteBackup
+	} else if err != ErrBackupObjectNotFound {
+		return nil, err
+	}
+
+	if _, err := readObject(store, "data/files.json"); err != nil {
+		if err == ErrBackupObjectNotFound {
+			err = ErrIncompleteBackup
+		}
+		return nil, err
+	}
+
+	manifest := &BackupManifest{FileType: RawdbFile}
+	if _, err := readObject(store, "delta/files.json"); err == nil {
+		manifest.DeltaInterleaving = true
+	} else if err != ErrBackupObjectNotFound {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+// beginBackup marks the backup in the store as incomplete until its
+// manifest is committed. A previous manifest is removed after the marker is
+// written, so that the store never looks like a backup without a manifest.
+func beginBackup(store BackupStore) error {
+	if err := store.Commit(backupMarkerFile, nil); err != nil {
+		return err
+	}
+
+	if err := store.Delete(backupManifestFile); err != nil && err != ErrBackupObjectNotFound {
+		return err
+	}
+
+	return nil
+}
+
+// manifestStore records the size and checksum of the objects created
+// through it for the backup manifest
+type manifestStore struct {
+	BackupStore
+	sync.Mutex
+	files []BackupFileInfo
+	names []string
+}
+
+func newManifestStore(store BackupStore) *manifestStore {
+	return &manifestStore{BackupStore: store}
+}
+
+type manifestObjectWriter struct {
+	io.WriteCloser
+	store *manifestStore
+	info  BackupFileInfo
+	crc   hash.Hash32
+}
+
+func (w *manifestObjectWriter) Write(p []byte) (int, error) {
+	n, err := w.WriteCloser.Write(p)
+	w.crc.Write(p[:n])
+	w.info.Size += int64(n)
+	return n, err
+}
+
+func (w *manifestObjectWriter) Close() error {
+	if err := w.WriteCloser.Close(); err != nil {
+		return err
+	}
+
+	w.info.Checksum = w.crc.Sum32()
+	w.store.Lock()
+	w.store.files = append(w.store.files, w.info)
+	w.store.Unlock()
+	return nil
+}
+
+func (s *manifestStore) Create(name string) (io.WriteCloser, error) {
+	w, err := s.BackupStore.Create(name)
+	if err != nil {
+		return nil, err
+	}
+
+	s.Lock()
+	s.names = append(s.names, name)
+	s.Unlock()
+
+	return &manifestObjectWriter{
+		WriteCloser: w,
+		store:       s,
+		info:        BackupFileInfo{Name: name},
+		crc:         crc32.New(crc32cTable),
+	}, nil
+}
+
+func (s *manifestStore) Commit(name string, data []byte) error {
+	s.Lock()
+	s.names = append(s.names, name)
+	s.Unlock()
+
+	return s.BackupStore.Commit(name, data)
+}
+
+// cleanup removes all the objects written through the store and the
+// backup marker
+func (s *manifestStore) cleanup() {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, name := range s.names {
+		s.BackupStore.Delete(name)
+	}
+	s.names = nil
+	s.BackupStore.Delete(backupMarkerFile)
+}
+
+// commit atomically writes the manifest with the recorded files
+func (s *manifestStore) commit(manifest *BackupManifest) error {
+	s.Lock()
+	manifest.Files = append([]BackupFileInfo(nil), s.files...)
+	s.Unlock()
+
+	sort.Slice(manifest.Files, func(i, j int) bool {
+		return manifest.Files[i].Name < manifest.Files[j].Name
+	})
+
+	bs, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := s.BackupStore.Commit(backupManifestFile, bs); err != nil {
+		return err
+	}
+
+	return s.BackupStore.Delete(backupMarkerFile)
+}
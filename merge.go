@@ -0,0 +1,123 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// MergePolicy resolves a conflict between an existing item and a backup item
+// with the same key. The backup item replaces the existing item if it returns
+// true. It is called concurrently by the merge workers.
+type MergePolicy func(existing, restored *Item) bool
+
+// MergeKeepExisting is a merge policy which keeps the existing items
+func MergeKeepExisting(existing, restored *Item) bool {
+	return false
+}
+
+// MergeOverwrite is a merge policy which replaces the existing items
+func MergeOverwrite(existing, restored *Item) bool {
+	return true
+}
+
+// MergeStats describes the result of a merge
+type MergeStats struct {
+	Inserted int64
+	Replaced int64
+	Skipped  int64
+}
+
+func (s MergeStats) String() string {
+	return fmt.Sprintf("inserted = %d, replaced = %d, skipped = %d",
+		s.Inserted, s.Replaced, s.Skipped)
+}
+
+// MergeFromDisk inserts the items of a disk backup into a Nitro instance
+// which may already have items. Conflicting items are resolved by the
+// merge policy.
+func (m *Nitro) MergeFromDisk(dir string, concurr int, policy MergePolicy) (MergeStats, error) {
+	return m.MergeFromBackupStore(NewDirBackupStore(dir), concurr, policy)
+}
+
+// MergeFromBackupStore inserts the items of a full backup into a Nitro
+// instance using regular writers. Unlike LoadFromBackupStore, the existing
+// items are retained and the merged items are logged in the write-ahead log.
+// Merged items become visible from the next snapshot.
+//
+// Existing items are looked up before the backup items are inserted. Hence,
+// concurrent writers should not modify the keys of the backup while merging.
+func (m *Nitro) MergeFromBackupStore(store BackupStore, concurr int,
+	policy MergePolicy) (MergeStats, error) {
+	var stats MergeStats
+
+	if concurr <= 0 {
+		return stats, ErrInvalidConcurrency
+	}
+
+	if policy == nil {
+		policy = MergeKeepExisting
+	}
+
+	manifest, err := ReadBackupManifest(store)
+	if err != nil {
+		return stats, err
+	}
+
+	if manifest.Incremental {
+		return stats, fmt.Errorf("Backup of snapshot %d is an incremental backup", manifest.Snapshot)
+	}
+
+	// The key comparator of a legacy backup is unknown
+	if !manifest.Legacy() && manifest.KeyComparatorID != m.keyCmpID {
+		return stats, fmt.Errorf("Backup key comparator %d does not match %d",
+			manifest.KeyComparatorID, m.keyCmpID)
+	}
+
+	writers := make([]*Writer, concurr)
+	for i := range writers {
+		writers[i] = m.NewWriter()
+	}
+
+	merge := func(w *Writer, itm *Item) {
+		defer w.freeItem(itm)
+
+		key := itm.Key()
+		if n := w.GetNode(key); n != nil {
+			if !policy(w.ptrToItem(n.Item()), itm) {
+				atomic.AddInt64(&stats.Skipped, 1)
+				return
+			}
+
+			w.Set(key, itm.Value())
+			atomic.AddInt64(&stats.Replaced, 1)
+			return
+		}
+
+		w.Set(key, itm.Value())
+		atomic.AddInt64(&stats.Inserted, 1)
+	}
+
+	// Items of the delta files were visible in the backup snapshot,
+	// but deleted while the backup was taken.
+	dirs := []string{"data"}
+	if manifest.DeltaInterleaving {
+		dirs = append(dirs, "delta")
+	}
+
+	for _, dir := range dirs {
+		if err := m.applyBackupFiles(store, dir, manifest.FileType, writers, merge); err != nil {
+			return stats, err
+		}
+	}
+
+	return stats, nil
+}
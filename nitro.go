@@ -17,11 +17,9 @@ import (
 	"github.com/t3rm1n4l/nitro/mm"
 	"github.com/t3rm1n4l/nitro/skiplist"
 	"io"
-	"io/ioutil"
 	"math"
 	"math/rand"
 	"os"
-	"path/filepath"
 	"runtime"
 	"sync"
 	"sync/atomic"
@@ -34,6 +32,9 @@ var (
 	ErrMaxSnapshotsLimitReached = fmt.Errorf("Maximum snapshots limit reached")
 	// ErrShutdown means an operation on a shutdown Nitro instance
 	ErrShutdown = fmt.Errorf("Nitro instance has been shutdown")
+	// ErrIncrementalChain means an incremental backup is not based on the
+	// previously restored backup
+	ErrIncrementalChain = fmt.Errorf("Incremental backup does not follow the previous backup")
 )
 
 // KeyCompare implements item data key comparator
@@ -87,9 +88,12 @@ func CompareNitro(this unsafe.Pointer, that unsafe.Pointer) int {
 func DefaultConfig() Config {
 	var cfg Config
 	cfg.SetKeyComparator(defaultKeyCmp)
+	cfg.bytewiseKeyCmp = true
 	cfg.fileType = RawdbFile
+	cfg.codecID = NoCodec
 	cfg.useMemoryMgmt = false
 	cfg.refreshRate = defaultRefreshRate
+	cfg.blockSize = defaultBlockSize
 	// TOOD: Remove this
 	cfg.storageShards = 48
 	return cfg
@@ -100,7 +104,7 @@ func newInsertCompare(keyCmp KeyCompare) skiplist.CompareFn {
 		var v int
 		thisItem := (*Item)(this)
 		thatItem := (*Item)(that)
-		if v = keyCmp(thisItem.Bytes(), thatItem.Bytes()); v == 0 {
+		if v = keyCmp(thisItem.Key(), thatItem.Key()); v == 0 {
 			var thisSn, thatSn uint32
 
 			if thisItem.bornSn == 0 {
@@ -125,7 +129,7 @@ func newIterCompare(keyCmp KeyCompare) skiplist.CompareFn {
 	return func(this, that unsafe.Pointer) int {
 		thisItem := (*Item)(this)
 		thatItem := (*Item)(that)
-		return keyCmp(thisItem.Bytes(), thatItem.Bytes())
+		return keyCmp(thisItem.Key(), thatItem.Key())
 	}
 }
 
@@ -136,7 +140,7 @@ func newExistCompare(keyCmp KeyCompare) skiplist.CompareFn {
 		if thisItem.deadSn != 0 || thatItem.deadSn != 0 {
 			return 1
 		}
-		return keyCmp(thisItem.Bytes(), thatItem.Bytes())
+		return keyCmp(thisItem.Key(), thatItem.Key())
 	}
 }
 
@@ -186,6 +190,9 @@ type Writer struct {
 	fd     *os.File
 	rfd    *os.File
 	offset int
+
+	wal    *walLog
+	walErr error
 }
 
 func (w *Writer) doCheckpoint() {
@@ -213,23 +220,88 @@ func (w *Writer) doDeltaWrite(itm *Item) {
 }
 
 // Put implements insert of an item into Intro
-// Put fails if an item already exists
+// Put fails if an item already exists or if the operation cannot be written
+// to the write-ahead log. Err returns the log write error.
 func (w *Writer) Put(bs []byte) {
 	w.Put2(bs)
 }
 
 // Put2 returns the skiplist node of the item if Put() succeeds
 func (w *Writer) Put2(bs []byte) *skiplist.Node {
-	return w.insert(bs, true)
+	return w.insert(bs, nil, true)
+}
+
+// Set inserts an item with the given key and value.
+// If an item with the same key already exists, its value is replaced
+// atomically as in Upsert(). Err returns the error if the operation cannot
+// be written to the write-ahead log.
+func (w *Writer) Set(key, value []byte) {
+	w.upsert(key, value)
+}
+
+// Upsert inserts an item or replaces the existing item with the same key.
+// Unlike Delete() followed by Put(), the old item is marked dead and the new
+// item is born with the same snapshot number. Hence, a snapshot always observes
+// either the old or the new item. A copy of the replaced item is returned.
+// Nil is also returned if the operation cannot be written to the write-ahead
+// log. Err distinguishes it from an insert.
+func (w *Writer) Upsert(bs []byte) *Item {
+	return w.upsert(bs, nil)
 }
 
-func (w *Writer) insert(bs []byte, isCreate bool) (n *skiplist.Node) {
+func (w *Writer) upsert(key, val []byte) (prev *Item) {
+	sn := w.getCurrSn()
+	if err := w.logOp(walOpSet, sn, key, val); err != nil {
+		return nil
+	}
+
+	old := w.GetNode(key)
+	if old != nil {
+		prev = w.ptrToItem(old.Item())
+		// An item born in the current snapshot is not visible to any
+		// snapshot yet. It has to be removed to make space for the new
+		// item with the same snapshot number.
+		if prev.bornSn == sn {
+			w.deleteNode(old)
+			old = nil
+		}
+	}
+
+	x := w.newKVItem(key, val, w.useMemoryMgmt)
+	x.bornSn = sn
+	if _, success := w.store.Insert2(unsafe.Pointer(x), w.insCmp, nil, w.buf,
+		w.rand.Float32, &w.slSts1); success {
+		w.count++
+	} else {
+		w.freeItem(x)
+		return nil
+	}
+
+	if old != nil {
+		w.deleteNode(old)
+	}
+
+	return prev
+}
+
+func (w *Writer) insert(key, val []byte, isCreate bool) (n *skiplist.Node) {
 	var success bool
-	x := w.newItem(bs, w.useMemoryMgmt)
+	sn := w.getCurrSn()
+	op := walOpPut
+	if !isCreate {
+		op = walOpDeleteMarker
+	}
+
+	// An operation which fails after it is logged fails again on replay
+	if err := w.logOp(op, sn, key, val); err != nil {
+		return nil
+	}
+
+	x := w.newKVItem(key, val, w.useMemoryMgmt)
 	if isCreate {
-		x.bornSn = w.getCurrSn()
+		x.bornSn = sn
 	} else {
-		x.deadSn = w.getCurrSn()
+		x.deadSn = sn
 	}
 	n, success = w.store.Insert2(unsafe.Pointer(x), w.insCmp, w.existCmp, w.buf,
 		w.rand.Float32, &w.slSts1)
@@ -242,7 +314,8 @@ func (w *Writer) insert(bs []byte, isCreate bool) (n *skiplist.Node) {
 }
 
 // Delete an item
-// Delete always succeed if an item exists.
+// Delete always succeed if an item exists unless the operation cannot be
+// written to the write-ahead log. Err returns the log write error.
 func (w *Writer) Delete(bs []byte) (success bool) {
 	_, success = w.Delete2(bs)
 	return
@@ -260,6 +333,14 @@ func (w *Writer) Delete2(bs []byte) (n *skiplist.Node, success bool) {
 // DeleteNode deletes an item by specifying its skiplist Node.
 // Using this API can avoid a O(logn) lookup during Delete().
 func (w *Writer) DeleteNode(x *skiplist.Node) (success bool) {
+	if err := w.logOp(walOpDelete, w.getCurrSn(), (*Item)(x.Item()).Key(), nil); err != nil {
+		return false
+	}
+
+	return w.deleteNode(x)
+}
+
+func (w *Writer) deleteNode(x *skiplist.Node) (success bool) {
 	defer func() {
 		if success {
 			w.count--
@@ -296,7 +377,7 @@ func (w *Writer) DeleteNonExist(bs []byte) bool {
 		return w.DeleteNode(n)
 	}
 
-	return w.insert(bs, false) != nil
+	return w.insert(bs, nil, false) != nil
 }
 
 // GetNode implements lookup of an item and return its skiplist Node
@@ -322,8 +403,13 @@ type Config struct {
 	iterCmp  skiplist.CompareFn
 	existCmp skiplist.CompareFn
 
+	// Keys are ordered bytewise by the default key comparator
+	bytewiseKeyCmp bool
+
 	refreshRate int
 	fileType    FileType
+	keyCmpID    uint32
+	codecID     uint8
 
 	useMemoryMgmt bool
 	useDeltaFiles bool
@@ -331,23 +417,100 @@ type Config struct {
 	freeFun       skiplist.FreeFn
 	blockStoreDir string
 	storageShards int
+	blockSize     int
+	blockCodecID  uint8
+
+	walDir          string
+	walSyncPolicy   WALSyncPolicy
+	walSyncInterval time.Duration
+
+	keyProvider KeyProvider
 }
 
 // SetKeyComparator provides key comparator for the Nitro item data
 func (cfg *Config) SetKeyComparator(cmp KeyCompare) {
+	cfg.bytewiseKeyCmp = false
 	cfg.keyCmp = cmp
 	cfg.insCmp = newInsertCompare(cmp)
 	cfg.iterCmp = newIterCompare(cmp)
 	cfg.existCmp = newExistCompare(cmp)
 }
+
+// SetKeyComparatorID sets an identifier for the key comparator. It is
+// recorded in the backup files which support it to prevent restoring a
+// backup using a different key ordering.
+func (cfg *Config) SetKeyComparatorID(id uint32) {
+	cfg.keyCmpID = id
+}
+
+// SetFileType sets the backup file format. The default RawdbFile format is
+// readable by all the releases, but it cannot store item values. Items with
+// a value need RawdbKVFile or one of the checksummed formats.
+func (cfg *Config) SetFileType(t FileType) {
+	cfg.fileType = t
+}
+
+// SetCompressionCodec sets the codec used by CompressedFile backup format.
+// Codec should be registered using RegisterCodec. Blocks are not compressed
+// unless a codec is set.
+func (cfg *Config) SetCompressionCodec(id uint8) {
+	cfg.codecID = id
+}
+
+// SetBlockStoreDir enables the block store mode in which items are stored in
+// blocks under the directory p by ApplyOps. An existing block store is reopened
+// with the items of the last completed ApplyOps.
 func (cfg *Config) SetBlockStoreDir(p string) {
 	cfg.blockStoreDir = p
 }
 
+// SetBlockSize sets the size of the block store blocks. It should be a power
+// of two between 4KB and 1MB. Larger blocks hold more items per index node,
+// but every write rewrites a whole block. A block store should always be
+// reopened with the block size it was created with.
+func (cfg *Config) SetBlockSize(sz int) {
+	cfg.blockSize = sz
+}
+
+// SetBlockCompressionCodec sets the codec used for compressing the block store
+// blocks. Compressed blocks hold more items than the block size. Blocks are
+// not compressed by default. Codec should be registered using RegisterCodec
+// and it should be registered before reopening a block store.
+func (cfg *Config) SetBlockCompressionCodec(id uint8) {
+	cfg.blockCodecID = id
+}
+
 func (cfg *Config) HasBlockStore() bool {
 	return cfg.blockStoreDir != ""
 }
 
+// SetWAL enables write-ahead logging of writer operations into dir.
+// The logs are replayed by LoadFromDisk on top of the backup and are truncated
+// once a newer backup is complete. The sync interval is used for periodic
+// syncing and a default interval is used if it is zero.
+// Write-ahead log is not supported in block store mode.
+func (cfg *Config) SetWAL(dir string, policy WALSyncPolicy, interval time.Duration) {
+	cfg.walDir = dir
+	cfg.walSyncPolicy = policy
+	cfg.walSyncInterval = interval
+}
+
+// SetEncryption enables encryption at rest of the backup files, the backup
+// streams, the write-ahead log and the block store using AES-GCM with the keys
+// of the key provider. Only ChecksumFile and CompressedFile backup formats
+// support encryption. Hence, other backup file types are replaced with
+// ChecksumFile and StoreToDisk fails if an unencrypted file type is set later.
+func (cfg *Config) SetEncryption(kp KeyProvider) {
+	cfg.keyProvider = kp
+	if kp != nil && cfg.fileType != ChecksumFile && cfg.fileType != CompressedFile {
+		cfg.fileType = ChecksumFile
+	}
+}
+
+func (cfg *Config) HasWAL() bool {
+	return cfg.walDir != "" && !cfg.HasBlockStore()
+}
+
 // UseMemoryMgmt provides custom memory allocator for Nitro items storage
 func (cfg *Config) UseMemoryMgmt(malloc skiplist.MallocFn, free skiplist.FreeFn) {
 	if runtime.GOARCH == "amd64" {
@@ -389,8 +552,28 @@ type Nitro struct {
 	gcchan   chan *skiplist.Node
 	freechan chan *skiplist.Node
 
-	shardWrs []*diskWriter
-	bm       BlockManager
+	shardWrs   []*diskWriter
+	bm         BlockManager
+	crypt      *encryptor
+	wal        *walManager
+	blockCodec Codec
+
+	// Serializes block rewrites of ApplyOps and key rotation
+	batchLock sync.Mutex
+	// Generation of the persisted block index
+	blockIndexGen uint64
+	// Journal of the index changes after the persisted block index
+	indexLog     *os.File
+	indexLogSize int64
+	indexSize    int64
+
+	// Waiters for the termination of access barrier sessions
+	barrierLock  sync.Mutex
+	barrierWaits map[unsafe.Pointer]chan struct{}
+
+	// Reusable buffers for point lookups
+	lookupBufs sync.Pool
+	blockBufs  sync.Pool
 
 	hasShutdown bool
 	shutdownWg1 sync.WaitGroup // GC workers and StoreToDisk task
@@ -401,12 +584,43 @@ type Nitro struct {
 }
 
 // NewWithConfig creates a new Nitro instance based on provided configuration.
+// It panics if the instance cannot be opened. Open returns the error instead.
 func NewWithConfig(cfg Config) *Nitro {
+	m, err := Open(cfg)
+	if err != nil {
+		panic(err)
+	}
+
+	return m
+}
+
+// Open creates a new Nitro instance based on provided configuration. An
+// error is returned if the configuration is invalid or if the block store or
+// the write-ahead log cannot be opened, such as ErrInvalidBlockIndex for a
+// corrupted block store index.
+func Open(cfg Config) (*Nitro, error) {
+	if cfg.blockSize == 0 {
+		cfg.blockSize = defaultBlockSize
+	}
+
+	if cfg.blockSize < minBlockSize || cfg.blockSize > maxBlockSize ||
+		cfg.blockSize&(cfg.blockSize-1) != 0 {
+		return nil, fmt.Errorf("Invalid block size %d", cfg.blockSize)
+	}
+
+	var blockCodec Codec
+	if cfg.blockCodecID != NoCodec {
+		if blockCodec = GetCodec(cfg.blockCodecID); blockCodec == nil {
+			return nil, fmt.Errorf("Unknown block compression codec %d", cfg.blockCodecID)
+		}
+	}
+
 	m := &Nitro{
 		snapshots:   skiplist.New(),
 		gcsnapshots: skiplist.New(),
 		currSn:      1,
 		Config:      cfg,
+		blockCodec:  blockCodec,
 		gcchan:      make(chan *skiplist.Node, gcchanBufSize),
 		id:          int(atomic.AddInt64(&dbInstancesCount, 1)),
 	}
@@ -414,16 +628,28 @@ func NewWithConfig(cfg Config) *Nitro {
 	m.freechan = make(chan *skiplist.Node, gcchanBufSize)
 	m.store = skiplist.NewWithConfig(m.newStoreConfig())
 	m.initSizeFuns()
+	m.lookupBufs.New = func() interface{} {
+		return m.store.MakeBuf()
+	}
+	m.blockBufs.New = func() interface{} {
+		return make([]byte, m.blockSize)
+	}
 
-	buf := dbInstances.MakeBuf()
-	defer dbInstances.FreeBuf(buf)
-	dbInstances.Insert(unsafe.Pointer(m), CompareNitro, buf, &dbInstances.Stats)
+	if cfg.keyProvider != nil {
+		m.crypt = newEncryptor(cfg.keyProvider)
+	}
 
 	if cfg.HasBlockStore() {
 		var err error
-		m.bm, err = newFileBlockManager(cfg.storageShards, cfg.blockStoreDir)
+		m.bm, err = newFileBlockManager(cfg.storageShards, cfg.blockStoreDir,
+			cfg.blockSize, m.crypt)
 		if err != nil {
-			panic(err)
+			return nil, err
+		}
+
+		if err := m.loadBlockIndex(); err != nil {
+			m.bm.Close()
+			return nil, err
 		}
 
 		for i := 0; i < cfg.storageShards; i++ {
@@ -431,8 +657,20 @@ func NewWithConfig(cfg Config) *Nitro {
 		}
 	}
 
-	return m
+	// The write-ahead log is not used with the block store
+	if cfg.HasWAL() {
+		var err error
+		m.wal, err = newWALManager(cfg.walDir, cfg.walSyncPolicy, cfg.walSyncInterval, m.crypt)
+		if err != nil {
+			return nil, err
+		}
+	}
 
+	buf := dbInstances.MakeBuf()
+	defer dbInstances.FreeBuf(buf)
+	dbInstances.Insert(unsafe.Pointer(m), CompareNitro, buf, &dbInstances.Stats)
+
+	return m, nil
 }
 
 func (m *Nitro) newStoreConfig() skiplist.Config {
@@ -449,6 +687,15 @@ func (m *Nitro) newStoreConfig() skiplist.Config {
 
 func (m *Nitro) newBSDestructor() skiplist.BarrierSessionDestructor {
 	return func(ref unsafe.Pointer) {
+		m.barrierLock.Lock()
+		done, ok := m.barrierWaits[ref]
+		delete(m.barrierWaits, ref)
+		m.barrierLock.Unlock()
+		if ok {
+			close(done)
+			return
+		}
+
 		// If gclist is not empty
 		if ref != nil {
 			freelist := (*skiplist.Node)(ref)
@@ -457,6 +704,24 @@ func (m *Nitro) newBSDestructor() skiplist.BarrierSessionDestructor {
 	}
 }
 
+// waitForAccessors blocks until the skiplist accessors which are active at
+// the time of the call have finished. It requires memory management, which
+// activates the access barrier.
+func (m *Nitro) waitForAccessors() {
+	ref := unsafe.Pointer(new(int))
+	done := make(chan struct{})
+
+	m.barrierLock.Lock()
+	if m.barrierWaits == nil {
+		m.barrierWaits = make(map[unsafe.Pointer]chan struct{})
+	}
+	m.barrierWaits[ref] = done
+	m.barrierLock.Unlock()
+
+	m.store.GetAccesBarrier().FlushSession(ref)
+	<-done
+}
+
 func (m *Nitro) initSizeFuns() {
 	m.snapshots.SetItemSizeFunc(SnapshotSize)
 	m.gcsnapshots.SetItemSizeFunc(SnapshotSize)
@@ -474,8 +739,10 @@ func (m *Nitro) MemoryInUse() int64 {
 	return storeStats.Memory + m.snapshots.MemoryInUse() + m.gcsnapshots.MemoryInUse()
 }
 
-// Close shuts down the nitro instance
-func (m *Nitro) Close() {
+// Close shuts down the nitro instance. It returns the first error encountered
+// while closing the write-ahead log or persisting the block store index and
+// free maps. The instance is shut down even if an error is returned.
+func (m *Nitro) Close() (err error) {
 	if m.parentSnap != nil {
 		m.parentSnap.Close()
 	}
@@ -487,6 +754,10 @@ func (m *Nitro) Close() {
 
 	m.hasShutdown = true
 
+	if m.wal != nil {
+		err = m.wal.close()
+	}
+
 	// Acquire gc chan ownership
 	// This will make sure that no other goroutine will write to gcchan
 	for !atomic.CompareAndSwapInt32(&m.isGCRunning, 0, 1) {
@@ -506,6 +777,14 @@ func (m *Nitro) Close() {
 		close(m.freechan)
 		m.shutdownWg2.Wait()
 
+		// Free maps are persisted only if the blocks of garbage collected
+		// index nodes are freed
+		if m.bm != nil {
+			if e := m.closeBlockStore(); e != nil && err == nil {
+				err = e
+			}
+		}
+
 		// Manually free up all nodes
 		iter := m.store.NewIterator(m.iterCmp, buf)
 		defer iter.Close()
@@ -528,6 +807,18 @@ func (m *Nitro) Close() {
 			}
 		}
 	}
+
+	if m.bm != nil {
+		if e := m.closeBlockIndexLog(); e != nil && err == nil {
+			err = e
+		}
+
+		if e := m.bm.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+
+	return err
 }
 
 func (m *Nitro) getCurrSn() uint32 {
@@ -554,6 +845,10 @@ func (m *Nitro) NewWriter() *Writer {
 	m.wlist = w
 	w.dwrCtx.Init()
 
+	if m.wal != nil {
+		w.wal = m.wal.newLog()
+	}
+
 	m.shutdownWg1.Add(1)
 	go m.collectionWorker(w)
 	if m.useMemoryMgmt {
@@ -564,12 +859,24 @@ func (m *Nitro) NewWriter() *Writer {
 	return w
 }
 
+// newRestoreWriter creates a writer for applying the operations restored from
+// disk. These operations are not logged again into the write-ahead log.
+func (m *Nitro) newRestoreWriter() *Writer {
+	w := m.NewWriter()
+	if w.wal != nil {
+		m.wal.closeLog(w.wal)
+		w.wal = nil
+	}
+	return w
+}
+
 // Snapshot describes Nitro immutable snapshot
 type Snapshot struct {
 	sn       uint32
 	refCount int32
 	db       *Nitro
 	count    int64
+	created  time.Time
 
 	gclist *skiplist.Node
 }
@@ -578,7 +885,7 @@ type Snapshot struct {
 func SnapshotSize(p unsafe.Pointer) int {
 	s := (*Snapshot)(p)
 	return int(unsafe.Sizeof(s.sn) + unsafe.Sizeof(s.refCount) + unsafe.Sizeof(s.db) +
-		unsafe.Sizeof(s.count) + unsafe.Sizeof(s.gclist))
+		unsafe.Sizeof(s.count) + unsafe.Sizeof(s.created) + unsafe.Sizeof(s.gclist))
 }
 
 // Count returns the number of items in the Nitro snapshot
@@ -643,6 +950,59 @@ func (s *Snapshot) NewIterator() *Iterator {
 	return s.db.NewIterator(s)
 }
 
+// NewRangeIterator creates a snapshot iterator bounded by lo and hi
+func (s *Snapshot) NewRangeIterator(lo, hi []byte, opts RangeOptions) *Iterator {
+	return s.db.NewRangeIterator(s, lo, hi, opts)
+}
+
+// NewPrefixIterator creates a snapshot iterator over keys with the prefix
+func (s *Snapshot) NewPrefixIterator(prefix []byte) *Iterator {
+	return s.db.NewPrefixIterator(s, prefix)
+}
+
+func (s *Snapshot) isVisible(itm *Item) bool {
+	return itm.bornSn <= s.sn && (itm.deadSn == 0 || itm.deadSn > s.sn)
+}
+
+func (s *Snapshot) skipInvisible(ptr unsafe.Pointer) bool {
+	return ptr != skiplist.MaxItem && !s.isVisible((*Item)(ptr))
+}
+
+// Get looks up the item with the given key in the snapshot and returns its
+// value. Items without a value, such as the items written using Put, are
+// returned as a whole. Unlike a snapshot Iterator, it does not allocate an
+// action buffer or a block buffer for every lookup. The returned bytes are
+// valid as long as the caller holds the snapshot. A key which cannot be read
+// from the block store is not found. GetErr returns such read errors.
+func (s *Snapshot) Get(key []byte) ([]byte, bool) {
+	val, found, _ := s.GetErr(key)
+	return val, found
+}
+
+// GetErr is Get which returns the error encountered while reading the data
+// block of the key, such as a *BlockCorruptionError.
+func (s *Snapshot) GetErr(key []byte) ([]byte, bool, error) {
+	l := s.newLookup()
+	defer l.close()
+
+	return l.get(key)
+}
+
+// MultiGet looks up values for a batch of keys in the snapshot.
+// A nil entry is returned for the keys which are not found or which cannot
+// be read from the block store.
+func (s *Snapshot) MultiGet(keys [][]byte) [][]byte {
+	l := s.newLookup()
+	defer l.close()
+
+	vals := make([][]byte, len(keys))
+	for i, key := range keys {
+		vals[i], _, _ = l.get(key)
+	}
+
+	return vals
+}
+
 // CompareSnapshot implements comparator for snapshots based on snapshot number
 func CompareSnapshot(this, that unsafe.Pointer) int {
 	thisItem := (*Snapshot)(this)
@@ -680,7 +1040,8 @@ func (m *Nitro) NewSnapshot() (*Snapshot, error) {
 		w.count = 0
 	}
 
-	snap := &Snapshot{db: m, sn: m.getCurrSn(), refCount: 2, count: m.ItemsCount()}
+	snap := &Snapshot{db: m, sn: m.getCurrSn(), refCount: 2, count: m.ItemsCount(),
+		created: time.Now()}
 	m.snapshots.Insert(unsafe.Pointer(snap), CompareSnapshot, buf, &m.snapshots.Stats)
 	if m.parentSnap != nil {
 		m.parentSnap.gclist = head
@@ -693,6 +1054,11 @@ func (m *Nitro) NewSnapshot() (*Snapshot, error) {
 		return nil, ErrMaxSnapshotsLimitReached
 	}
 
+	// Record the snapshot time for point-in-time restores
+	if m.wal != nil {
+		m.wal.logSnapshot(snap.sn, snap.created)
+	}
+
 	return snap, nil
 }
 
@@ -735,7 +1101,13 @@ func (m *Nitro) freeWorker(w *Writer) {
 			n = n.GClink
 
 			if m.HasBlockStore() {
-				m.bm.DeleteBlock(blockPtr(dnode.DataPtr))
+				bptr := blockPtr(dnode.DataPtr)
+				if bptr.HasOverflow() {
+					buf := m.blockBufs.Get().([]byte)
+					deleteOverflow(m.bm, bptr, buf)
+					m.blockBufs.Put(buf)
+				}
+				m.bm.DeleteBlock(bptr)
 			}
 
 			itm := (*Item)(dnode.Item())
@@ -808,6 +1180,13 @@ func (m *Nitro) ptrToItem(itmPtr unsafe.Pointer) *Item {
 // This API divides the range of keys in a snapshot into `shards` range partitions
 // Number of concurrent worker threads used can be specified.
 func (m *Nitro) Visitor(snap *Snapshot, callb VisitorCallback, shards int, concurrency int) error {
+	return m.visitor(snap, nil, callb, shards, concurrency)
+}
+
+// visitor visits the items accepted by visible filter or the items visible
+// in the snapshot if filter is not provided.
+func (m *Nitro) visitor(snap *Snapshot, visible func(*Item) bool,
+	callb VisitorCallback, shards int, concurrency int) error {
 	var wg sync.WaitGroup
 
 	wch := make(chan int, shards)
@@ -835,9 +1214,10 @@ func (m *Nitro) Visitor(snap *Snapshot, callb VisitorCallback, shards int, concu
 				}
 				defer itr.Close()
 
+				itr.visible = visible
 				itr.SetRefreshRate(m.refreshRate)
-				itr.Seek(startItem.Bytes())
-				itr.SetEnd(endItem.Bytes())
+				itr.Seek(startItem.Key())
+				itr.SetEnd(endItem.Key())
 
 				for ; itr.Valid(); itr.Next() {
 					itm := (*Item)(itr.GetNode().Item())
@@ -846,6 +1226,7 @@ func (m *Nitro) Visitor(snap *Snapshot, callb VisitorCallback, shards int, concu
 						return
 					}
 				}
+				errors[shard] = itr.Err()
 			}
 		}(&wg)
 	}
@@ -913,7 +1294,21 @@ func (m *Nitro) changeDeltaWrState(state int,
 
 // StoreToDisk backups Nitro snapshot to disk
 // Concurrent threads are used to perform backup and concurrency can be specified.
-func (m *Nitro) StoreToDisk(dir string, snap *Snapshot, concurr int, itmCallback ItemCallback) (err error) {
+func (m *Nitro) StoreToDisk(dir string, snap *Snapshot, concurr int, itmCallback ItemCallback) error {
+	return m.StoreToDiskWithOptions(dir, snap, concurr, itmCallback, BackupOptions{})
+}
+
+// StoreToDiskWithOptions backups Nitro snapshot to disk with progress
+// reporting and cancellation
+func (m *Nitro) StoreToDiskWithOptions(dir string, snap *Snapshot, concurr int,
+	itmCallback ItemCallback, opts BackupOptions) error {
+	return m.StoreToBackupStore(NewDirBackupStore(dir), snap, concurr, itmCallback, opts)
+}
+
+// StoreToBackupStore backups Nitro snapshot to a backup store. The backup
+// manifest is committed once all the backup files are complete.
+func (m *Nitro) StoreToBackupStore(backupStore BackupStore, snap *Snapshot, concurr int,
+	itmCallback ItemCallback, opts BackupOptions) (err error) {
 
 	var snapClosed bool
 	defer func() {
@@ -922,30 +1317,54 @@ func (m *Nitro) StoreToDisk(dir string, snap *Snapshot, concurr int, itmCallback
 		}
 	}()
 
+	sn := snap.sn
+
 	if m.useMemoryMgmt {
 		m.shutdownWg1.Add(1)
 		defer m.shutdownWg1.Done()
 	}
 
-	datadir := filepath.Join(dir, "data")
-	os.MkdirAll(datadir, 0755)
+	// A backup is incomplete until the new manifest is committed
+	if err := beginBackup(backupStore); err != nil {
+		return err
+	}
+
 	shards := runtime.NumCPU()
+	store := newManifestStore(backupStore)
+	manifest := m.newBackupManifest(snap)
+	counts := make([]int64, shards)
 
 	writers := make([]FileWriter, shards)
 	files := make([]string, shards)
+	defer closeFileWriters(writers)
+
+	// Delta files are completed by the deferred termination of delta
+	// processing. Hence, the manifest has to be committed after it.
+	task := newBackupTask(opts, shards, snap.Count())
 	defer func() {
-		for _, w := range writers {
-			if w != nil {
-				w.Close()
+		if err == nil {
+			for _, c := range counts {
+				manifest.ItemsCount += c
 			}
+			err = store.commit(manifest)
 		}
+
+		// Log records up to the backup snapshot are no longer required
+		if err == nil && m.wal != nil {
+			err = m.wal.truncate(sn)
+		}
+
+		if task.isCancelled(err) {
+			closeFileWriters(writers)
+			store.cleanup()
+		}
+		task.stop(err)
 	}()
 
 	for shard := 0; shard < shards; shard++ {
-		w := m.newFileWriter(m.fileType)
+		w := m.newFileWriter(m.fileType, snap.sn)
 		file := fmt.Sprintf("shard-%d", shard)
-		datafile := filepath.Join(datadir, file)
-		if err := w.Open(datafile); err != nil {
+		if err := w.Open(store, "data/"+file); err != nil {
 			return err
 		}
 
@@ -957,21 +1376,12 @@ func (m *Nitro) StoreToDisk(dir string, snap *Snapshot, concurr int, itmCallback
 	if m.useDeltaFiles {
 		deltaWriters := make([]FileWriter, m.numWriters())
 		deltaFiles := make([]string, m.numWriters())
-		defer func() {
-			for _, w := range deltaWriters {
-				if w != nil {
-					w.Close()
-				}
-			}
-		}()
+		defer closeFileWriters(deltaWriters)
 
-		deltadir := filepath.Join(dir, "delta")
-		os.MkdirAll(deltadir, 0755)
 		for id := 0; id < m.numWriters(); id++ {
-			dw := m.newFileWriter(m.fileType)
+			dw := m.newFileWriter(m.fileType, snap.sn)
 			file := fmt.Sprintf("shard-%d", id)
-			deltafile := filepath.Join(deltadir, file)
-			if err = dw.Open(deltafile); err != nil {
+			if err = dw.Open(store, "delta/"+file); err != nil {
 				return err
 			}
 			deltaWriters[id] = dw
@@ -993,9 +1403,18 @@ func (m *Nitro) StoreToDisk(dir string, snap *Snapshot, concurr int, itmCallback
 		snap = &fakeSnap
 
 		defer func() {
-			if err = m.changeDeltaWrState(dwStateTerminate, nil, nil); err == nil {
+			e := m.changeDeltaWrState(dwStateTerminate, nil, nil)
+			if e == nil {
+				e = closeFileWriters(deltaWriters)
+			}
+
+			if e == nil {
 				bs, _ := json.Marshal(deltaFiles)
-				ioutil.WriteFile(filepath.Join(deltadir, "files.json"), bs, 0660)
+				e = store.Commit("delta/files.json", bs)
+			}
+
+			if err == nil {
+				err = e
 			}
 		}()
 	}
@@ -1005,10 +1424,18 @@ func (m *Nitro) StoreToDisk(dir string, snap *Snapshot, concurr int, itmCallback
 			return ErrShutdown
 		}
 
+		if err := task.err(); err != nil {
+			return err
+		}
+
 		w := writers[shard]
 		if err := w.WriteItem(itm); err != nil {
 			return err
 		}
+		counts[shard]++
+		if err := task.add(shard, itm); err != nil {
+			return err
+		}
 
 		if itmCallback != nil {
 			itmCallback(&ItemEntry{itm: itm, n: nil})
@@ -1018,26 +1445,93 @@ func (m *Nitro) StoreToDisk(dir string, snap *Snapshot, concurr int, itmCallback
 	}
 
 	if err = m.Visitor(snap, visitorCallback, shards, concurr); err == nil {
+		if err = closeFileWriters(writers); err != nil {
+			return err
+		}
+
 		bs, _ := json.Marshal(files)
-		ioutil.WriteFile(filepath.Join(datadir, "files.json"), bs, 0660)
+		err = store.Commit("data/files.json", bs)
 	}
 
 	return err
 }
 
-// LoadFromDisk restores Nitro from a disk backup
+// LoadFromDisk restores Nitro from a disk backup. The Nitro instance should
+// be empty. MergeFromDisk merges a backup into an instance with items.
 func (m *Nitro) LoadFromDisk(dir string, concurr int, callb ItemCallback) (*Snapshot, error) {
+	return m.LoadIncrementalFromDisk(dir, nil, concurr, callb)
+}
+
+// LoadFromDiskWithOptions restores Nitro from a disk backup with progress
+// reporting and cancellation. The Nitro instance should be closed if the
+// restore fails.
+func (m *Nitro) LoadFromDiskWithOptions(dir string, concurr int, callb ItemCallback,
+	opts BackupOptions) (*Snapshot, error) {
+	return m.LoadIncrementalFromBackupStore(NewDirBackupStore(dir), nil, concurr, callb, opts)
+}
+
+// LoadIncrementalFromDisk restores Nitro from a full disk backup followed by
+// a chain of incremental backups. Incremental backups should be provided in
+// the order in which they were taken.
+func (m *Nitro) LoadIncrementalFromDisk(dir string, incrDirs []string,
+	concurr int, callb ItemCallback) (*Snapshot, error) {
+
+	incrStores := make([]BackupStore, len(incrDirs))
+	for i, incrDir := range incrDirs {
+		incrStores[i] = NewDirBackupStore(incrDir)
+	}
+
+	return m.LoadIncrementalFromBackupStore(NewDirBackupStore(dir), incrStores, concurr,
+		callb, BackupOptions{})
+}
+
+// LoadFromBackupStore restores Nitro from a backup store
+func (m *Nitro) LoadFromBackupStore(store BackupStore, concurr int, callb ItemCallback,
+	opts BackupOptions) (*Snapshot, error) {
+	return m.LoadIncrementalFromBackupStore(store, nil, concurr, callb, opts)
+}
+
+// LoadIncrementalFromBackupStore restores Nitro from a full backup followed
+// by a chain of incremental backups in the order in which they were taken.
+func (m *Nitro) LoadIncrementalFromBackupStore(store BackupStore, incrStores []BackupStore,
+	concurr int, callb ItemCallback, opts BackupOptions) (snap *Snapshot, err error) {
 	var wg sync.WaitGroup
 	var files []string
 	var bs []byte
-	var err error
-	datadir := filepath.Join(dir, "data")
 
-	if bs, err = ioutil.ReadFile(filepath.Join(datadir, "files.json")); err != nil {
+	manifest, err := ReadBackupManifest(store)
+	if err != nil {
+		return nil, err
+	}
+
+	if manifest.Incremental {
+		return nil, fmt.Errorf("Backup of snapshot %d is an incremental backup", manifest.Snapshot)
+	}
+
+	manifests := []*BackupManifest{manifest}
+	for _, incrStore := range incrStores {
+		incrManifest, err := ReadBackupManifest(incrStore)
+		if err != nil {
+			return nil, err
+		}
+		manifests = append(manifests, incrManifest)
+	}
+
+	target, err := m.resolveRestorePoint(opts.RestorePoint, manifests)
+	if err != nil {
+		return nil, err
+	}
+
+	if bs, err = readObject(store, "data/files.json"); err != nil {
 		return nil, err
 	}
 	json.Unmarshal(bs, &files)
 
+	task := newBackupTask(opts, len(files), manifest.ItemsCount)
+	defer func() {
+		task.stop(err)
+	}()
+
 	var nodeCallb skiplist.NodeCallback
 	wchan := make(chan int)
 	b := skiplist.NewBuilderWithConfig(m.newStoreConfig())
@@ -1063,9 +1557,8 @@ func (m *Nitro) LoadFromDisk(dir string, concurr int, callb ItemCallback) (*Snap
 	for i, file := range files {
 		segments[i] = b.NewSegment()
 		segments[i].SetNodeCallback(nodeCallb)
-		r := m.newFileReader(m.fileType)
-		datafile := filepath.Join(datadir, file)
-		if err := r.Open(datafile); err != nil {
+		r := m.newFileReader(manifest.FileType)
+		if err := r.Open(store, "data/"+file); err != nil {
 			return nil, err
 		}
 
@@ -1081,16 +1574,25 @@ func (m *Nitro) LoadFromDisk(dir string, concurr int, callb ItemCallback) (*Snap
 				r := readers[shard]
 			loop:
 				for {
+					if err := task.err(); err != nil {
+						errors[shard] = err
+						break loop
+					}
+
 					itm, err := r.ReadItem()
 					if err != nil {
 						errors[shard] = err
-						return
+						break loop
 					}
 
 					if itm == nil {
 						break loop
 					}
 					segments[shard].Add(unsafe.Pointer(itm))
+					if err := task.add(shard, itm); err != nil {
+						errors[shard] = err
+						break loop
+					}
 				}
 			}
 		}(&wg)
@@ -1102,23 +1604,27 @@ func (m *Nitro) LoadFromDisk(dir string, concurr int, callb ItemCallback) (*Snap
 	close(wchan)
 	wg.Wait()
 
+	// Items restored so far are freed when the Nitro instance is closed
+	m.store = b.Assemble(segments...)
 	for _, err := range errors {
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	m.store = b.Assemble(segments...)
+	count := int64(m.store.GetStats().NodeCount)
+	if !manifest.Legacy() && count != manifest.ItemsCount {
+		return nil, fmt.Errorf("Backup has %d items, expected %d", count, manifest.ItemsCount)
+	}
 
 	// Delta processing
-	if m.useDeltaFiles {
+	if manifest.DeltaInterleaving {
 		m.DeltaRestoreFailed = 0
 		m.DeltaRestored = 0
 
 		wchan := make(chan int)
-		deltadir := filepath.Join(dir, "delta")
 		var files []string
-		if bs, err := ioutil.ReadFile(filepath.Join(deltadir, "files.json")); err == nil {
+		if bs, err := readObject(store, "delta/files.json"); err == nil {
 			json.Unmarshal(bs, &files)
 		}
 
@@ -1135,9 +1641,8 @@ func (m *Nitro) LoadFromDisk(dir string, concurr int, callb ItemCallback) (*Snap
 		}()
 
 		for i, file := range files {
-			r := m.newFileReader(m.fileType)
-			deltafile := filepath.Join(deltadir, file)
-			if err := r.Open(deltafile); err != nil {
+			r := m.newFileReader(manifest.FileType)
+			if err := r.Open(store, "delta/"+file); err != nil {
 				return nil, err
 			}
 
@@ -1154,10 +1659,15 @@ func (m *Nitro) LoadFromDisk(dir string, concurr int, callb ItemCallback) (*Snap
 					r := readers[shard]
 				loop:
 					for {
+						if err := task.err(); err != nil {
+							errors[shard] = err
+							break loop
+						}
+
 						itm, err := r.ReadItem()
 						if err != nil {
 							errors[shard] = err
-							return
+							break loop
 						}
 
 						if itm == nil {
@@ -1202,6 +1712,36 @@ func (m *Nitro) LoadFromDisk(dir string, concurr int, callb ItemCallback) (*Snap
 
 	stats := m.store.GetStats()
 	m.itemsCount = int64(stats.NodeCount)
+
+	sn := manifest.Snapshot
+
+	if len(incrStores) > 0 {
+		writers := make([]*Writer, concurr)
+		for i := range writers {
+			writers[i] = m.newRestoreWriter()
+		}
+
+		for i, incrStore := range incrStores {
+			if err := task.err(); err != nil {
+				return nil, err
+			}
+
+			if manifests[i+1].Snapshot > target {
+				break
+			}
+
+			if sn, err = m.loadIncremental(incrStore, sn, writers, nodeCallb); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if m.wal != nil {
+		if err := m.replayWAL(sn, target); err != nil {
+			return nil, err
+		}
+	}
+
 	return m.NewSnapshot()
 }
 
@@ -18,6 +18,14 @@ import "math/rand"
 import "sync"
 import "runtime"
 import "encoding/binary"
+import "io/ioutil"
+import "path/filepath"
+import "bytes"
+import "io"
+import "hash/crc32"
+import "encoding/json"
+import "context"
+import "strings"
 import "github.com/t3rm1n4l/nitro/mm"
 
 var testConf Config
@@ -26,6 +34,8 @@ func init() {
 	testConf = DefaultConfig()
 	testConf.UseMemoryMgmt(mm.Malloc, mm.Free)
 	testConf.UseDeltaInterleaving()
+	// Test items have values
+	testConf.SetFileType(RawdbKVFile)
 	Debug(true)
 }
 
@@ -913,3 +923,2844 @@ func TestSimpleGet(t *testing.T) {
 		}
 	}
 }
+
+func TestSnapshotGet(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+	w := db.NewWriter()
+
+	n := 10000
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("%010d", i))
+		w.Set(key, append([]byte("val-"), key...))
+	}
+	snap1, _ := w.NewSnapshot()
+	defer snap1.Close()
+
+	for i := 0; i < n; i += 2 {
+		w.Delete([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap2, _ := w.NewSnapshot()
+	defer snap2.Close()
+
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("%010d", i))
+		if v, ok := snap1.Get(key); !ok || string(v) != "val-"+string(key) {
+			t.Errorf("snap1: expected value for %s, got %s", key, v)
+		}
+
+		_, ok := snap2.Get(key)
+		if ok != (i%2 == 1) {
+			t.Errorf("snap2: unexpected lookup result %v for %s", ok, key)
+		}
+	}
+
+	if _, ok := snap1.Get([]byte("x")); ok {
+		t.Errorf("Expected lookup of a missing key to fail")
+	}
+
+	keys := [][]byte{[]byte(fmt.Sprintf("%010d", 1)), []byte(fmt.Sprintf("%010d", 2)), []byte("x")}
+	vals := snap2.MultiGet(keys)
+	if string(vals[0]) != "val-"+string(keys[0]) || vals[1] != nil || vals[2] != nil {
+		t.Errorf("Unexpected multiget result %q", vals)
+	}
+
+	// Items written using Put pack the key and the value
+	conf := testConf
+	conf.SetKeyComparator(func(a, b []byte) int {
+		return bytes.Compare(bytes.SplitN(a, []byte(":"), 2)[0], bytes.SplitN(b, []byte(":"), 2)[0])
+	})
+	pdb := NewWithConfig(conf)
+	defer pdb.Close()
+	pw := pdb.NewWriter()
+	pw.Put([]byte("put:val"))
+	snap3, _ := pw.NewSnapshot()
+	defer snap3.Close()
+	if v, ok := snap3.Get([]byte("put")); !ok || string(v) != "put:val" {
+		t.Errorf("Expected the Put item, got %q (%v)", v, ok)
+	}
+
+	vals = snap3.MultiGet([][]byte{[]byte("put"), []byte("x")})
+	if string(vals[0]) != "put:val" || vals[1] != nil {
+		t.Errorf("Expected the Put item and nil for a missing key, got %q", vals)
+	}
+}
+
+func TestSnapshotGetBlockStore(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "nitro_blockstore")
+	defer os.RemoveAll(dir)
+
+	conf := testConf
+	conf.SetBlockStoreDir(dir)
+	db := NewWithConfig(conf)
+	defer db.Close()
+
+	tdb := NewWithConfig(testConf)
+	defer tdb.Close()
+	w := tdb.NewWriter()
+	n := 20000
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("%010d", i))
+		w.Set(key, append([]byte("val-"), key...))
+	}
+	tsnap, _ := tdb.NewSnapshot()
+	if _, err := db.ApplyOps(tsnap, 4); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	tsnap.Close()
+
+	snap, _ := db.NewSnapshot()
+	defer snap.Close()
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("%010d", i))
+		if v, ok := snap.Get(key); !ok || string(v) != "val-"+string(key) {
+			t.Errorf("Expected value for %s, got %s", key, v)
+		}
+	}
+
+	itr := snap.NewIterator()
+	i := 0
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		key := fmt.Sprintf("%010d", i)
+		if string(itr.Get()) != key || string(itr.Value()) != "val-"+key {
+			t.Errorf("Expected %s, got %s=%s", key, itr.Get(), itr.Value())
+		}
+		i++
+	}
+	itr.Close()
+
+	if i != n {
+		t.Errorf("Expected %d items, got %d", n, i)
+	}
+
+	if _, ok := snap.Get([]byte("x")); ok {
+		t.Errorf("Expected lookup of a missing key to fail")
+	}
+}
+
+func TestKVItems(t *testing.T) {
+	os.RemoveAll("db.dump")
+	defer os.RemoveAll("db.dump")
+	db := NewWithConfig(testConf)
+	defer db.Close()
+	w := db.NewWriter()
+
+	n := 10000
+	for i := 0; i < n; i++ {
+		w.Set([]byte(fmt.Sprintf("%010d", i)), []byte(fmt.Sprintf("v1-%d", i)))
+	}
+	snap1, _ := w.NewSnapshot()
+	defer snap1.Close()
+
+	for i := 0; i < n; i += 2 {
+		w.Set([]byte(fmt.Sprintf("%010d", i)), []byte(fmt.Sprintf("v2-%d", i)))
+	}
+	snap2, _ := w.NewSnapshot()
+
+	itr := snap2.NewIterator()
+	i := 0
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		version := 1
+		if i%2 == 0 {
+			version = 2
+		}
+		expected := fmt.Sprintf("v%d-%d", version, i)
+		if string(itr.Value()) != expected {
+			t.Errorf("Expected %s, got %s", expected, itr.Value())
+		}
+		i++
+	}
+	itr.Close()
+
+	if i != n {
+		t.Errorf("Expected %d items, got %d", n, i)
+	}
+
+	if v, _ := snap1.Get([]byte(fmt.Sprintf("%010d", 0))); string(v) != "v1-0" {
+		t.Errorf("Expected old value in the older snapshot, got %s", v)
+	}
+
+	if err := db.StoreToDisk("db.dump", snap2, 4, nil); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	db2 := NewWithConfig(testConf)
+	defer db2.Close()
+	snap, err := db2.LoadFromDisk("db.dump", 4, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer snap.Close()
+
+	for i := 0; i < n; i++ {
+		version := 1
+		if i%2 == 0 {
+			version = 2
+		}
+		expected := fmt.Sprintf("v%d-%d", version, i)
+		if v, _ := snap.Get([]byte(fmt.Sprintf("%010d", i))); string(v) != expected {
+			t.Errorf("Expected %s, got %s", expected, v)
+		}
+	}
+}
+
+func TestRawdbFileFormats(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "nitro_rawdb")
+	defer os.RemoveAll(dir)
+
+	db := NewWithConfig(testConf)
+	defer db.Close()
+	store := NewDirBackupStore(dir)
+
+	// Files written before item values were supported
+	fd, _ := store.Create("legacy")
+	fd.Write([]byte{0, 3, 'a', 'b', 'c', 0, 0})
+	fd.Close()
+
+	r := db.newFileReader(RawdbFile)
+	if err := r.Open(store, "legacy"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	itm, err := r.ReadItem()
+	if err != nil || string(itm.Key()) != "abc" || len(itm.Value()) != 0 {
+		t.Errorf("Expected legacy item, got %v (%v)", itm, err)
+	}
+	if itm, err = r.ReadItem(); itm != nil || err != nil {
+		t.Errorf("Expected end of file, got %v (%v)", itm, err)
+	}
+	r.Close()
+
+	// Backups are readable by older releases unless another format is set
+	if conf := DefaultConfig(); conf.fileType != RawdbFile || conf.codecID != NoCodec {
+		t.Errorf("Expected RawdbFile backups, got file type %d, codec %d", conf.fileType, conf.codecID)
+	}
+
+	w := db.newFileWriter(RawdbFile, 0)
+	w.Open(store, "raw")
+	if err := w.WriteItem(db.newKVItem([]byte("k"), []byte("v"), false)); err != ErrItemValueUnsupported {
+		t.Errorf("Expected value unsupported error, got %v", err)
+	}
+	w.Close()
+
+	w = db.newFileWriter(RawdbKVFile, 0)
+	w.Open(store, "kv")
+	w.WriteItem(db.newKVItem([]byte("k"), []byte("v"), false))
+	w.Close()
+
+	r = db.newFileReader(RawdbKVFile)
+	r.Open(store, "kv")
+	if itm, err = r.ReadItem(); err != nil || string(itm.Key()) != "k" || string(itm.Value()) != "v" {
+		t.Errorf("Expected kv item, got %v (%v)", itm, err)
+	}
+	r.Close()
+
+	// Value length larger than the item length
+	fd, _ = store.Create("corrupt")
+	fd.Write([]byte{0, 1, 0, 2, 'k', 0, 0, 0, 0})
+	fd.Close()
+
+	r = db.newFileReader(RawdbKVFile)
+	r.Open(store, "corrupt")
+	if itm, err = r.ReadItem(); itm != nil || err != errInvalidItemLen {
+		t.Errorf("Expected invalid item length error, got %v (%v)", itm, err)
+	}
+	r.Close()
+
+	// Item length larger than the maximum item size is not allocated
+	var lbuf [2 * binary.MaxVarintLen64]byte
+	fd, _ = store.Create("varint-large")
+	n := binary.PutUvarint(lbuf[:], 3<<30)
+	n += binary.PutUvarint(lbuf[n:], 0)
+	fd.Write(lbuf[:n])
+	fd.Close()
+
+	r = db.newFileReader(RawdbVarintFile)
+	r.Open(store, "varint-large")
+	if itm, err = r.ReadItem(); itm != nil || err != errInvalidItemLen {
+		t.Errorf("Expected invalid item length error, got %v (%v)", itm, err)
+	}
+	r.Close()
+
+	// Truncated item
+	fd, _ = store.Create("varint-short")
+	fd.Write([]byte{10, 0, 'a', 'b'})
+	fd.Close()
+
+	r = db.newFileReader(RawdbVarintFile)
+	r.Open(store, "varint-short")
+	if itm, err = r.ReadItem(); itm != nil || err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected unexpected EOF, got %v (%v)", itm, err)
+	}
+	r.Close()
+}
+
+func TestUpsert(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+	w := db.NewWriter()
+
+	n := 10000
+	for i := 0; i < n; i++ {
+		w.Set([]byte(fmt.Sprintf("%010d", i)), []byte("v1"))
+	}
+	snap1, _ := w.NewSnapshot()
+	defer snap1.Close()
+
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("%010d", i))
+		w.Set(key, []byte("v2"))
+		// Replace an item born in the current snapshot
+		w.Set(key, []byte("v3"))
+	}
+
+	key := []byte("new")
+	if prev := w.Upsert(key); prev != nil {
+		t.Errorf("Expected no previous item, got %s", prev.Bytes())
+	}
+	if prev := w.Upsert(key); prev == nil || string(prev.Key()) != "new" {
+		t.Errorf("Expected previous item to be returned")
+	}
+
+	snap2, _ := w.NewSnapshot()
+	defer snap2.Close()
+
+	if c := CountItems(snap1); c != n {
+		t.Errorf("Expected %d items, got %d", n, c)
+	}
+
+	if c := CountItems(snap2); c != n+1 {
+		t.Errorf("Expected %d items, got %d", n+1, c)
+	}
+
+	if c := snap2.Count(); c != int64(n+1) {
+		t.Errorf("Expected snapshot count %d, got %d", n+1, c)
+	}
+
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("%010d", i))
+		if v, _ := snap1.Get(key); string(v) != "v1" {
+			t.Errorf("Expected v1, got %s", v)
+		}
+		if v, _ := snap2.Get(key); string(v) != "v3" {
+			t.Errorf("Expected v3, got %s", v)
+		}
+	}
+}
+
+func verifyReverseScan(t *testing.T, snap *Snapshot) {
+	var keys []string
+	itr := snap.NewIterator()
+	defer itr.Close()
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		keys = append(keys, string(itr.Get()))
+	}
+
+	i := len(keys) - 1
+	for itr.SeekLast(); itr.Valid(); itr.Prev() {
+		if i < 0 || string(itr.Get()) != keys[i] {
+			t.Fatalf("Reverse scan mismatch at %d, got %s", i, itr.Get())
+		}
+		i--
+	}
+
+	if i != -1 {
+		t.Errorf("Reverse scan returned %d items, expected %d", len(keys)-i-1, len(keys))
+	}
+
+	for x := 1; x < len(keys); x += 97 {
+		itr.SeekForPrev([]byte(keys[x]))
+		if !itr.Valid() || string(itr.Get()) != keys[x] {
+			t.Errorf("Expected %s, got %s", keys[x], itr.Get())
+		}
+
+		// Seek in between two keys
+		itr.SeekForPrev([]byte(keys[x] + "a"))
+		if !itr.Valid() || string(itr.Get()) != keys[x] {
+			t.Errorf("Expected %s, got %s", keys[x], itr.Get())
+		}
+
+		itr.Prev()
+		if !itr.Valid() || string(itr.Get()) != keys[x-1] {
+			t.Errorf("Expected %s, got %s", keys[x-1], itr.Get())
+		}
+
+		itr.Next()
+		if !itr.Valid() || string(itr.Get()) != keys[x] {
+			t.Errorf("Expected %s, got %s", keys[x], itr.Get())
+		}
+	}
+
+	itr.SeekForPrev([]byte(""))
+	if itr.Valid() {
+		t.Errorf("Expected invalid iterator, got %s", itr.Get())
+	}
+}
+
+func TestReverseIterator(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+	w := db.NewWriter()
+
+	n := 10000
+	for i := 0; i < n; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap1, _ := w.NewSnapshot()
+	defer snap1.Close()
+
+	for i := 0; i < n; i += 3 {
+		w.Delete([]byte(fmt.Sprintf("%010d", i)))
+	}
+	for i := 1; i < n; i += 3 {
+		w.Upsert([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap2, _ := w.NewSnapshot()
+	defer snap2.Close()
+
+	verifyReverseScan(t, snap1)
+	verifyReverseScan(t, snap2)
+
+	if c := CountItems(snap2); c != n-(n+2)/3 {
+		t.Errorf("Unexpected count %d", c)
+	}
+
+	itr := snap2.NewIterator()
+	itr.SetRefreshRate(10)
+	i := n - 1
+	for itr.SeekLast(); itr.Valid(); itr.Prev() {
+		if i%3 == 0 {
+			i--
+		}
+		if expected := fmt.Sprintf("%010d", i); string(itr.Get()) != expected {
+			t.Fatalf("Expected %s, got %s", expected, itr.Get())
+		}
+		i--
+	}
+	itr.Close()
+}
+
+func TestReverseIteratorBlockStore(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "nitro_blockstore")
+	defer os.RemoveAll(dir)
+
+	conf := testConf
+	conf.SetBlockStoreDir(dir)
+	db := NewWithConfig(conf)
+	defer db.Close()
+
+	tdb := NewWithConfig(testConf)
+	defer tdb.Close()
+	w := tdb.NewWriter()
+	for i := 0; i < 20000; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	tsnap, _ := tdb.NewSnapshot()
+	if _, err := db.ApplyOps(tsnap, 4); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	tsnap.Close()
+
+	snap, _ := db.NewSnapshot()
+	defer snap.Close()
+	verifyReverseScan(t, snap)
+}
+
+func verifyRangeScan(t *testing.T, itr *Iterator, start, end int) {
+	i := start
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		if expected := fmt.Sprintf("%010d", i); string(itr.Get()) != expected {
+			t.Fatalf("Expected %s, got %s", expected, itr.Get())
+		}
+		i++
+	}
+
+	if i != end+1 {
+		t.Errorf("Expected range end %d, got %d", end, i-1)
+	}
+
+	i = end
+	for itr.SeekLast(); itr.Valid(); itr.Prev() {
+		if expected := fmt.Sprintf("%010d", i); string(itr.Get()) != expected {
+			t.Fatalf("Expected %s, got %s", expected, itr.Get())
+		}
+		i--
+	}
+
+	if i != start-1 {
+		t.Errorf("Expected range start %d, got %d", start, i+1)
+	}
+
+	itr.Seek([]byte(""))
+	if !itr.Valid() || string(itr.Get()) != fmt.Sprintf("%010d", start) {
+		t.Errorf("Seek below range returned %s", itr.Get())
+	}
+
+	itr.SeekForPrev([]byte("a"))
+	if !itr.Valid() || string(itr.Get()) != fmt.Sprintf("%010d", end) {
+		t.Errorf("SeekForPrev above range returned %s", itr.Get())
+	}
+
+	itr.Seek([]byte("a"))
+	if itr.Valid() {
+		t.Errorf("Expected invalid iterator, got %s", itr.Get())
+	}
+}
+
+func testRangeIterators(t *testing.T, snap *Snapshot) {
+	lo, hi := []byte(fmt.Sprintf("%010d", 100)), []byte(fmt.Sprintf("%010d", 200))
+
+	itr := snap.NewRangeIterator(lo, hi, RangeOptions{})
+	verifyRangeScan(t, itr, 100, 199)
+	itr.Close()
+
+	itr = snap.NewRangeIterator(lo, hi, RangeOptions{LowExclusive: true, HighInclusive: true})
+	verifyRangeScan(t, itr, 101, 200)
+	itr.Close()
+
+	itr = snap.NewRangeIterator(nil, hi, RangeOptions{})
+	verifyRangeScan(t, itr, 0, 199)
+	itr.Close()
+
+	itr = snap.NewRangeIterator(lo, nil, RangeOptions{LowExclusive: true})
+	verifyRangeScan(t, itr, 101, 9999)
+	itr.Close()
+
+	itr = snap.NewPrefixIterator([]byte("000000012"))
+	verifyRangeScan(t, itr, 120, 129)
+	itr.Close()
+
+	itr = snap.NewPrefixIterator([]byte("0000001"))
+	verifyRangeScan(t, itr, 1000, 1999)
+	itr.Close()
+}
+
+func TestPrefixIteratorCustomComparator(t *testing.T) {
+	conf := testConf
+	conf.SetKeyComparator(func(a, b []byte) int {
+		return bytes.Compare(b, a)
+	})
+
+	db := NewWithConfig(conf)
+	defer db.Close()
+	w := db.NewWriter()
+	for i := 0; i < 10000; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap, _ := w.NewSnapshot()
+	defer snap.Close()
+
+	itr := snap.NewPrefixIterator([]byte("000000012"))
+	defer itr.Close()
+	i := 129
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		if expected := fmt.Sprintf("%010d", i); string(itr.Get()) != expected {
+			t.Fatalf("Expected %s, got %s", expected, itr.Get())
+		}
+		i--
+	}
+
+	if i != 119 {
+		t.Errorf("Expected prefix scan to end at 120, got %d", i+1)
+	}
+
+	itr.SeekLast()
+	if !itr.Valid() || string(itr.Get()) != fmt.Sprintf("%010d", 120) {
+		t.Errorf("Expected SeekLast to find 120")
+	}
+
+	itr.Seek([]byte("a"))
+	if !itr.Valid() || string(itr.Get()) != fmt.Sprintf("%010d", 129) {
+		t.Errorf("Expected Seek to find 129")
+	}
+
+	itr.Seek([]byte(fmt.Sprintf("%010d", 125)))
+	if !itr.Valid() || string(itr.Get()) != fmt.Sprintf("%010d", 125) {
+		t.Errorf("Expected Seek to find 125")
+	}
+
+	itr.SeekForPrev([]byte(""))
+	if !itr.Valid() || string(itr.Get()) != fmt.Sprintf("%010d", 120) {
+		t.Errorf("Expected SeekForPrev to find 120")
+	}
+}
+
+func TestRangeIterator(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+	w := db.NewWriter()
+	for i := 0; i < 10000; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap, _ := w.NewSnapshot()
+	defer snap.Close()
+	testRangeIterators(t, snap)
+
+	dir, _ := ioutil.TempDir("", "nitro_blockstore")
+	defer os.RemoveAll(dir)
+	conf := testConf
+	conf.SetBlockStoreDir(dir)
+	bdb := NewWithConfig(conf)
+	defer bdb.Close()
+	if _, err := bdb.ApplyOps(snap, 4); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	bsnap, _ := bdb.NewSnapshot()
+	defer bsnap.Close()
+	testRangeIterators(t, bsnap)
+}
+
+func TestWAL(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "nitro_wal")
+	defer os.RemoveAll(dir)
+
+	conf := testConf
+	conf.SetWAL(filepath.Join(dir, "wal"), WALSyncPeriodic, time.Millisecond)
+	backup1 := filepath.Join(dir, "backup1")
+	backup2 := filepath.Join(dir, "backup2")
+
+	db := NewWithConfig(conf)
+	defer db.Close()
+	w := db.NewWriter()
+	for i := 0; i < 1000; i++ {
+		w.Set([]byte(fmt.Sprintf("%010d", i)), []byte("v1"))
+	}
+	snap, _ := w.NewSnapshot()
+	if err := db.StoreToDisk(backup1, snap, 4, nil); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	for i := 1000; i < 2000; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap, _ = w.NewSnapshot()
+	snap.Close()
+	for i := 0; i < 100; i++ {
+		w.Delete([]byte(fmt.Sprintf("%010d", i)))
+	}
+	for i := 100; i < 200; i++ {
+		w.Set([]byte(fmt.Sprintf("%010d", i)), []byte("v2"))
+	}
+
+	if err := w.SyncWAL(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	verify := func(snap *Snapshot) {
+		if c := CountItems(snap); c != 1900 {
+			t.Errorf("Expected 1900 items, got %d", c)
+		}
+
+		for i := 0; i < 2000; i++ {
+			val, ok := snap.Get([]byte(fmt.Sprintf("%010d", i)))
+			switch {
+			case i < 100:
+				if ok {
+					t.Errorf("Unexpected item %d", i)
+				}
+			case i < 200:
+				if string(val) != "v2" {
+					t.Errorf("Expected v2 for %d, got %s", i, val)
+				}
+			case i < 1000:
+				if string(val) != "v1" {
+					t.Errorf("Expected v1 for %d, got %s", i, val)
+				}
+			default:
+				if !ok {
+					t.Errorf("Missing item %d", i)
+				}
+			}
+		}
+	}
+
+	// Restore from the older backup and the log without shutting down
+	db2 := NewWithConfig(conf)
+	defer db2.Close()
+	snap, err := db2.LoadFromDisk(backup1, 4, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	verify(snap)
+
+	// A complete backup removes the replayed logs
+	if err := db2.StoreToDisk(backup2, snap, 4, nil); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	w2 := db2.NewWriter()
+	for i := 2000; i < 2100; i++ {
+		w2.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	w2.SyncWAL()
+
+	db3 := NewWithConfig(conf)
+	defer db3.Close()
+	snap, err = db3.LoadFromDisk(backup2, 4, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer snap.Close()
+
+	if c := CountItems(snap); c != 2000 {
+		t.Errorf("Expected 2000 items, got %d", c)
+	}
+
+	if _, ok := snap.Get([]byte(fmt.Sprintf("%010d", 150))); !ok {
+		t.Errorf("Missing item from backup")
+	}
+}
+
+func TestWALWriteFailure(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "nitro_wal")
+	defer os.RemoveAll(dir)
+
+	conf := testConf
+	conf.SetWAL(filepath.Join(dir, "wal"), WALSyncAlways, 0)
+	db := NewWithConfig(conf)
+	defer db.Close()
+	w := db.NewWriter()
+	w.Set([]byte("k1"), []byte("v1"))
+	w.Put([]byte("k2"))
+	if err := w.Err(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// Fail the writes of the log segment
+	w.wal.fd.Close()
+
+	if w.Upsert([]byte("k1")) != nil || w.Err() == nil {
+		t.Errorf("Expected upsert to fail with a log write error, got %v", w.Err())
+	}
+
+	w.Set([]byte("k1"), []byte("v2"))
+	if w.Put2([]byte("k3")) != nil {
+		t.Errorf("Expected put to fail")
+	}
+	if w.Delete([]byte("k2")) {
+		t.Errorf("Expected delete to fail")
+	}
+
+	if w.DeleteNonExist([]byte("k4")) {
+		t.Errorf("Expected delete marker to fail")
+	}
+
+	if err := w.SyncWAL(); err == nil {
+		t.Errorf("Expected log write error")
+	}
+
+	snap, _ := w.NewSnapshot()
+	defer snap.Close()
+	if val, _ := snap.Get([]byte("k1")); string(val) != "v1" {
+		t.Errorf("Expected v1, got %s", val)
+	}
+
+	if _, ok := snap.Get([]byte("k2")); !ok {
+		t.Errorf("Expected k2 to exist")
+	}
+
+	if _, ok := snap.Get([]byte("k3")); ok {
+		t.Errorf("Expected k3 to not exist")
+	}
+
+	if c := CountItems(snap); c != 2 {
+		t.Errorf("Expected 2 items, got %d", c)
+	}
+}
+
+func TestWALCorruption(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "nitro_wal")
+	defer os.RemoveAll(dir)
+
+	conf := testConf
+	conf.SetWAL(filepath.Join(dir, "wal"), WALSyncNone, 0)
+	backup := filepath.Join(dir, "backup")
+
+	db := NewWithConfig(conf)
+	snap, _ := db.NewSnapshot()
+	if err := db.StoreToDisk(backup, snap, 4, nil); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	w := db.NewWriter()
+	n := 100
+	for i := 0; i < n; i++ {
+		w.Set([]byte(fmt.Sprintf("%010d", i)), []byte("v"))
+	}
+	if err := w.SyncWAL(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	db.Close()
+
+	segs, _ := filepath.Glob(filepath.Join(dir, "wal", walLogPrefix+"-*.log"))
+	if len(segs) != 1 {
+		t.Fatalf("Expected one log segment, got %v", segs)
+	}
+	seg := segs[0]
+	bs, _ := ioutil.ReadFile(seg)
+
+	restore := func(data []byte) (int, error) {
+		ioutil.WriteFile(seg, data, 0644)
+		db := NewWithConfig(conf)
+		defer db.Close()
+		snap, err := db.LoadFromDisk(backup, 4, nil)
+		if err != nil {
+			return 0, err
+		}
+		defer snap.Close()
+		return CountItems(snap), nil
+	}
+
+	// Torn writes at the tail end the log
+	torn := append([]byte{}, bs[:len(bs)-3]...)
+	if c, err := restore(torn); err != nil || c != n-1 {
+		t.Errorf("Expected %d items for a torn record, got %d (%v)", n-1, c, err)
+	}
+
+	if c, err := restore(append(torn, make([]byte, 100)...)); err != nil || c != n-1 {
+		t.Errorf("Expected %d items for a torn record followed by zeros, got %d (%v)", n-1, c, err)
+	}
+
+	// Corrupted records followed by valid records
+	corrupt := append([]byte{}, bs...)
+	corrupt[len(corrupt)/2] ^= 0xff
+	if _, err := restore(corrupt); err == nil || !strings.Contains(err.Error(), "corrupted") {
+		t.Errorf("Expected corruption error, got %v", err)
+	}
+
+	corrupt = append([]byte{}, bs...)
+	binary.BigEndian.PutUint32(corrupt[0:4], walRecordEncrypted-1)
+	if _, err := restore(corrupt); err == nil || !strings.Contains(err.Error(), "corrupted") {
+		t.Errorf("Expected corruption error for an invalid record length, got %v", err)
+	}
+}
+
+func TestPointInTimeRestore(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "nitro_wal")
+	defer os.RemoveAll(dir)
+
+	conf := testConf
+	conf.SetWAL(filepath.Join(dir, "wal"), WALSyncPeriodic, time.Millisecond)
+	backup := filepath.Join(dir, "backup")
+
+	db := NewWithConfig(conf)
+	w := db.NewWriter()
+	for i := 0; i < 1000; i++ {
+		w.Set([]byte(fmt.Sprintf("%010d", i)), []byte("v1"))
+	}
+	snap, _ := w.NewSnapshot()
+	t0 := time.Now()
+	if err := db.StoreToDisk(backup, snap, 4, nil); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	for i := 1000; i < 2000; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap, _ = w.NewSnapshot()
+	snA := snap.sn
+	snap.Close()
+
+	for i := 0; i < 100; i++ {
+		w.Delete([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap, _ = w.NewSnapshot()
+	snap.Close()
+	tB := time.Now()
+	time.Sleep(time.Millisecond)
+
+	// Not part of any snapshot
+	for i := 100; i < 200; i++ {
+		w.Set([]byte(fmt.Sprintf("%010d", i)), []byte("v2"))
+	}
+
+	points, err := db.RestorePoints()
+	if err != nil || len(points) != 2 || points[0].Snapshot != snA {
+		t.Fatalf("Unexpected restore points %v (%v)", points, err)
+	}
+	db.Close()
+
+	restore := func(point RestorePoint) error {
+		db := NewWithConfig(conf)
+		defer db.Close()
+		snap, err := db.LoadFromDiskWithOptions(backup, 4, nil, BackupOptions{RestorePoint: point})
+		if err == nil {
+			snap.Close()
+		}
+		return err
+	}
+
+	verify := func(point RestorePoint, count int, deleted bool) {
+		db := NewWithConfig(conf)
+		defer db.Close()
+		snap, err := db.LoadFromDiskWithOptions(backup, 4, nil, BackupOptions{RestorePoint: point})
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		defer snap.Close()
+
+		if c := CountItems(snap); c != count {
+			t.Errorf("Expected %d items, got %d", count, c)
+		}
+
+		if _, ok := snap.Get([]byte(fmt.Sprintf("%010d", 50))); ok == deleted {
+			t.Errorf("Unexpected item 50")
+		}
+
+		if val, _ := snap.Get([]byte(fmt.Sprintf("%010d", 150))); string(val) != "v1" {
+			t.Errorf("Expected v1, got %s", val)
+		}
+	}
+
+	if err := restore(RestorePoint{Time: t0.Add(-time.Hour)}); err != ErrInvalidRestorePoint {
+		t.Errorf("Expected invalid restore point, got %v", err)
+	}
+
+	if err := restore(RestorePoint{Snapshot: snA + 100}); err != ErrInvalidRestorePoint {
+		t.Errorf("Expected invalid restore point, got %v", err)
+	}
+
+	// Restores discard the logged operations after the restore point
+	verify(RestorePoint{Time: tB}, 1900, true)
+	if files, _ := filepath.Glob(filepath.Join(dir, "wal", "*"+walTmpSuffix)); len(files) != 0 {
+		t.Errorf("Unexpected temporary files %v", files)
+	}
+	verify(RestorePoint{Snapshot: snA}, 2000, false)
+	verify(RestorePoint{}, 2000, false)
+}
+
+func TestWALCompactionRecovery(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "nitro_wal")
+	defer os.RemoveAll(dir)
+
+	old := filepath.Join(dir, "wal-0000000000000001.log")
+	tmp := filepath.Join(dir, "wal-0000000000000002.log"+walTmpSuffix)
+	exists := func(path string) bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}
+
+	// Compaction interrupted before the commit
+	ioutil.WriteFile(old, []byte("old"), 0644)
+	ioutil.WriteFile(tmp, []byte("new"), 0644)
+	mgr, err := newWALManager(dir, WALSyncNone, 0, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	mgr.close()
+
+	if !exists(old) || exists(tmp) || exists(strings.TrimSuffix(tmp, walTmpSuffix)) {
+		t.Errorf("Expected the old segment to be retained")
+	}
+
+	// Compaction interrupted after the commit
+	ioutil.WriteFile(tmp, []byte("new"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, walCompactFile), []byte(`["wal-0000000000000001.log"]`), 0644)
+	mgr, err = newWALManager(dir, WALSyncNone, 0, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	mgr.close()
+
+	if exists(old) || exists(tmp) || !exists(strings.TrimSuffix(tmp, walTmpSuffix)) {
+		t.Errorf("Expected the compacted segment to replace the old segment")
+	}
+
+	if exists(filepath.Join(dir, walCompactFile)) {
+		t.Errorf("Expected the compaction file to be removed")
+	}
+
+	// The next segment is numbered after the compacted segment
+	if seg := mgr.nextSegment(walLogPrefix); filepath.Base(seg) != "wal-0000000000000003.log" {
+		t.Errorf("Unexpected segment %s", seg)
+	}
+}
+
+func snapshotItems(snap *Snapshot) map[string]string {
+	items := make(map[string]string)
+	itr := snap.NewIterator()
+	defer itr.Close()
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		items[string(itr.Get())] = string(itr.Value())
+	}
+
+	return items
+}
+
+func TestMergeFromDisk(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "nitro_merge")
+	defer os.RemoveAll(dir)
+
+	db := NewWithConfig(testConf)
+	defer db.Close()
+	w := db.NewWriter()
+	for i := 0; i < 1000; i++ {
+		w.Set([]byte(fmt.Sprintf("%010d", i)), []byte("backup"))
+	}
+	snap, _ := db.NewSnapshot()
+	if err := db.StoreToDisk(dir, snap, 4, nil); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	evenKeys := func(existing, restored *Item) bool {
+		var i int
+		fmt.Sscanf(string(restored.Key()), "%d", &i)
+		return i%2 == 0
+	}
+
+	merge := func(policy MergePolicy, expected MergeStats, value func(int) string) {
+		db := NewWithConfig(testConf)
+		defer db.Close()
+		w := db.NewWriter()
+		for i := 500; i < 1500; i++ {
+			w.Set([]byte(fmt.Sprintf("%010d", i)), []byte("existing"))
+		}
+		snap, _ := db.NewSnapshot()
+		snap.Close()
+
+		stats, err := db.MergeFromDisk(dir, 4, policy)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+
+		if stats != expected {
+			t.Errorf("Expected %v, got %v", expected, stats)
+		}
+
+		snap, _ = db.NewSnapshot()
+		defer snap.Close()
+		if c := CountItems(snap); c != 1500 {
+			t.Errorf("Expected 1500 items, got %d", c)
+		}
+
+		for i := 0; i < 1500; i++ {
+			val, _ := snap.Get([]byte(fmt.Sprintf("%010d", i)))
+			if exp := value(i); string(val) != exp {
+				t.Errorf("Expected %s for %d, got %s", exp, i, val)
+			}
+		}
+	}
+
+	merge(MergeKeepExisting, MergeStats{Inserted: 500, Skipped: 500}, func(i int) string {
+		if i < 500 {
+			return "backup"
+		}
+		return "existing"
+	})
+
+	merge(MergeOverwrite, MergeStats{Inserted: 500, Replaced: 500}, func(i int) string {
+		if i < 1000 {
+			return "backup"
+		}
+		return "existing"
+	})
+
+	merge(evenKeys, MergeStats{Inserted: 500, Replaced: 250, Skipped: 250}, func(i int) string {
+		if i < 500 || (i < 1000 && i%2 == 0) {
+			return "backup"
+		}
+		return "existing"
+	})
+
+	db2 := NewWithConfig(testConf)
+	defer db2.Close()
+	for _, concurr := range []int{0, -1} {
+		if _, err := db2.MergeFromDisk(dir, concurr, nil); err != ErrInvalidConcurrency {
+			t.Errorf("Expected invalid concurrency error for %d, got %v", concurr, err)
+		}
+	}
+}
+
+func TestIncrementalBackup(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "nitro_incr")
+	defer os.RemoveAll(dir)
+	full := filepath.Join(dir, "full")
+	incr1 := filepath.Join(dir, "incr1")
+	incr2 := filepath.Join(dir, "incr2")
+
+	db := NewWithConfig(testConf)
+	defer db.Close()
+	w := db.NewWriter()
+	for i := 0; i < 1000; i++ {
+		w.Set([]byte(fmt.Sprintf("%010d", i)), []byte("v1"))
+	}
+
+	snap0, _ := db.NewSnapshot()
+	defer snap0.Close()
+	snap0.Open()
+	if err := db.StoreToDisk(full, snap0, 4, nil); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	for i := 0; i < 100; i++ {
+		w.Delete([]byte(fmt.Sprintf("%010d", i)))
+	}
+	for i := 100; i < 200; i++ {
+		w.Set([]byte(fmt.Sprintf("%010d", i)), []byte("v2"))
+	}
+	for i := 1000; i < 1100; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	for i := 2000; i < 2010; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap, _ := db.NewSnapshot()
+	snap.Close()
+	for i := 2000; i < 2010; i++ {
+		w.Delete([]byte(fmt.Sprintf("%010d", i)))
+	}
+
+	snap1, _ := db.NewSnapshot()
+	defer snap1.Close()
+	if err := db.StoreIncremental(incr1, snap0, snap1, 4); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	for i := 0; i < 50; i++ {
+		w.Set([]byte(fmt.Sprintf("%010d", i)), []byte("v3"))
+	}
+	for i := 1000; i < 1050; i++ {
+		w.Delete([]byte(fmt.Sprintf("%010d", i)))
+	}
+
+	snap2, _ := db.NewSnapshot()
+	defer snap2.Close()
+	if err := db.StoreIncremental(incr2, snap1, snap2, 4); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	db2 := NewWithConfig(testConf)
+	defer db2.Close()
+	rsnap, err := db2.LoadIncrementalFromDisk(full, []string{incr1, incr2}, 4, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer rsnap.Close()
+
+	expected, got := snapshotItems(snap2), snapshotItems(rsnap)
+	if len(expected) != len(got) {
+		t.Errorf("Expected %d items, got %d", len(expected), len(got))
+	}
+
+	for k, v := range expected {
+		if got[k] != v {
+			t.Errorf("Expected %s=%s, got %s", k, v, got[k])
+		}
+	}
+
+	if c := int(rsnap.Count()); c != len(expected) {
+		t.Errorf("Expected count %d, got %d", len(expected), c)
+	}
+
+	db3 := NewWithConfig(testConf)
+	defer db3.Close()
+	if _, err := db3.LoadIncrementalFromDisk(full, []string{incr2}, 4, nil); err != ErrIncrementalChain {
+		t.Errorf("Expected chain error, got %v", err)
+	}
+}
+
+func TestChecksumFile(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "nitro_backup")
+	defer os.RemoveAll(dir)
+
+	conf := testConf
+	conf.SetFileType(ChecksumFile)
+	conf.SetKeyComparatorID(1)
+
+	db := NewWithConfig(conf)
+	defer db.Close()
+	w := db.NewWriter()
+	n := 100000
+	for i := 0; i < n; i++ {
+		w.Set([]byte(fmt.Sprintf("%010d", i)), []byte(fmt.Sprintf("val-%d", i)))
+	}
+	snap, _ := db.NewSnapshot()
+	if err := db.StoreToDisk(dir, snap, 4, nil); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	db2 := NewWithConfig(conf)
+	defer db2.Close()
+	snap, err := db2.LoadFromDisk(dir, 4, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if c := CountItems(snap); c != n {
+		t.Errorf("Expected %d items, got %d", n, c)
+	}
+	if val, _ := snap.Get([]byte(fmt.Sprintf("%010d", 100))); string(val) != "val-100" {
+		t.Errorf("Unexpected value %s", val)
+	}
+	snap.Close()
+
+	// Restore using a different key comparator
+	conf2 := conf
+	conf2.SetKeyComparatorID(2)
+	db3 := NewWithConfig(conf2)
+	defer db3.Close()
+	if _, err := db3.LoadFromDisk(dir, 4, nil); err != ErrComparatorMismatch {
+		t.Errorf("Expected comparator mismatch, got %v", err)
+	}
+
+	// Find the largest shard and corrupt it
+	var shard string
+	var size int64
+	files, _ := filepath.Glob(filepath.Join(dir, "data", "shard-*"))
+	for _, f := range files {
+		if fi, _ := os.Stat(f); fi.Size() > size {
+			shard, size = f, fi.Size()
+		}
+	}
+
+	bs, _ := ioutil.ReadFile(shard)
+	check := func(expected string) {
+		db := NewWithConfig(conf)
+		defer db.Close()
+		_, err := db.LoadFromDisk(dir, 4, nil)
+		cerr, ok := err.(*CorruptionError)
+		if !ok {
+			t.Fatalf("Expected corruption error, got %v", err)
+		}
+
+		if cerr.Path != shard || cerr.Reason != expected {
+			t.Errorf("Unexpected corruption error %v", cerr)
+		}
+	}
+
+	// Flip a byte within the payload of the first block
+	corrupted := append([]byte(nil), bs...)
+	corrupted[checksumFileHdrSize+100] ^= 0xff
+	ioutil.WriteFile(shard, corrupted, 0755)
+	check("block checksum mismatch")
+
+	ioutil.WriteFile(shard, bs[:len(bs)-10], 0755)
+	check("truncated footer")
+
+	ioutil.WriteFile(shard, bs[:len(bs)/2], 0755)
+	check("truncated block")
+
+	// Version 1 files are not readable
+	corrupted = append([]byte(nil), bs...)
+	binary.BigEndian.PutUint16(corrupted[4:6], 1)
+	binary.BigEndian.PutUint32(corrupted[16:20], crc32.Checksum(corrupted[:16], crc32cTable))
+	ioutil.WriteFile(shard, corrupted, 0755)
+	db4 := NewWithConfig(conf)
+	defer db4.Close()
+	if _, err := db4.LoadFromDisk(dir, 4, nil); err == nil || !strings.Contains(err.Error(), "unsupported version 1") {
+		t.Errorf("Expected unsupported version error, got %v", err)
+	}
+}
+
+func TestCompressedFile(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "nitro_backup")
+	defer os.RemoveAll(dir)
+
+	conf := testConf
+	conf.SetFileType(CompressedFile)
+	conf.SetCompressionCodec(FlateCodec)
+
+	db := NewWithConfig(conf)
+	defer db.Close()
+	w := db.NewWriter()
+	n := 100000
+	for i := 0; i < n; i++ {
+		w.Set([]byte(fmt.Sprintf("%010d", i)), []byte(fmt.Sprintf(`{"id": %d, "name": "item"}`, i)))
+	}
+	snap, _ := db.NewSnapshot()
+	if err := db.StoreToDisk(dir, snap, 4, nil); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	var size int64
+	files, _ := filepath.Glob(filepath.Join(dir, "data", "shard-*"))
+	for _, f := range files {
+		fi, _ := os.Stat(f)
+		size += fi.Size()
+	}
+
+	if size > int64(n*20) {
+		t.Errorf("Expected compressed backup, got %d bytes", size)
+	}
+
+	db2 := NewWithConfig(conf)
+	defer db2.Close()
+	snap, err := db2.LoadFromDisk(dir, 4, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer snap.Close()
+
+	if c := CountItems(snap); c != n {
+		t.Errorf("Expected %d items, got %d", n, c)
+	}
+
+	if val, _ := snap.Get([]byte(fmt.Sprintf("%010d", 100))); string(val) != `{"id": 100, "name": "item"}` {
+		t.Errorf("Unexpected value %s", val)
+	}
+}
+
+func largeItemKV(i int) ([]byte, []byte) {
+	key := []byte(fmt.Sprintf("%010d", i))
+	if i%3 == 0 {
+		key = append(key, bytes.Repeat([]byte("k"), 70000)...)
+	}
+
+	val := bytes.Repeat([]byte{byte(i)}, (i%5)*50000)
+	return key, val
+}
+
+func verifyLargeItems(t *testing.T, snap *Snapshot, n int) {
+	itr := snap.NewIterator()
+	defer itr.Close()
+	i := 0
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		key, val := largeItemKV(i)
+		if !bytes.Equal(itr.Get(), key) || !bytes.Equal(itr.Value(), val) {
+			t.Errorf("Item mismatch at %d", i)
+		}
+
+		// Items without a value are returned as a whole
+		if len(val) == 0 {
+			val = key
+		}
+
+		if v, ok := snap.Get(key); !ok || !bytes.Equal(v, val) {
+			t.Errorf("Lookup mismatch at %d", i)
+		}
+		i++
+	}
+
+	if i != n {
+		t.Errorf("Expected %d items, got %d", n, i)
+	}
+}
+
+func TestLargeItems(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "nitro_large")
+	defer os.RemoveAll(dir)
+
+	tdb := NewWithConfig(testConf)
+	defer tdb.Close()
+	w := tdb.NewWriter()
+	n := 100
+	for i := 0; i < n; i++ {
+		w.Set(largeItemKV(i))
+	}
+	tsnap, _ := tdb.NewSnapshot()
+	defer tsnap.Close()
+
+	tsnap.Open()
+	if err := tdb.StoreToDisk(filepath.Join(dir, "raw"), tsnap, 4, nil); err != ErrItemTooLarge {
+		t.Errorf("Expected item too large error, got %v", err)
+	}
+
+	for _, ft := range []FileType{RawdbVarintFile, ChecksumFile} {
+		conf := testConf
+		conf.SetFileType(ft)
+		db := NewWithConfig(conf)
+		w := db.NewWriter()
+		for i := 0; i < n; i++ {
+			w.Set(largeItemKV(i))
+		}
+		snap, _ := db.NewSnapshot()
+		backup := filepath.Join(dir, fmt.Sprintf("backup-%d", ft))
+		if err := db.StoreToDisk(backup, snap, 4, nil); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		snap.Close()
+		db.Close()
+
+		db2 := NewWithConfig(conf)
+		snap, err := db2.LoadFromDisk(backup, 4, nil)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		verifyLargeItems(t, snap, n)
+		snap.Close()
+		db2.Close()
+	}
+
+	conf := testConf
+	conf.SetBlockStoreDir(dir)
+	db := NewWithConfig(conf)
+	defer db.Close()
+	if _, err := db.ApplyOps(tsnap, 4); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// Rewrite the blocks holding overflow items
+	for i := n; i < 2*n; i++ {
+		w.Set(largeItemKV(i))
+	}
+	tsnap2, _ := tdb.NewSnapshot()
+	defer tsnap2.Close()
+	if _, err := db.ApplyOps(tsnap2, 4); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	snap, _ := db.NewSnapshot()
+	defer snap.Close()
+	verifyLargeItems(t, snap, 2*n)
+}
+
+func TestBlockSize(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "nitro_blocksize")
+	defer os.RemoveAll(dir)
+
+	tdb := NewWithConfig(testConf)
+	defer tdb.Close()
+	w := tdb.NewWriter()
+	n := 1000
+	for i := 0; i < n; i++ {
+		if i%10 == 0 {
+			w.Set(largeItemKV(i))
+		} else {
+			w.Put([]byte(fmt.Sprintf("%010d", i)))
+		}
+	}
+	tsnap, _ := tdb.NewSnapshot()
+	defer tsnap.Close()
+
+	conf := testConf
+	conf.SetBlockStoreDir(dir)
+	conf.SetBlockSize(64 * 1024)
+	db := NewWithConfig(conf)
+	if _, err := db.ApplyOps(tsnap, 4); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	snap, _ := db.NewSnapshot()
+	itr := snap.NewIterator()
+	i := 0
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		key, val := []byte(fmt.Sprintf("%010d", i)), []byte(nil)
+		if i%10 == 0 {
+			key, val = largeItemKV(i)
+		}
+
+		if !bytes.Equal(itr.Get(), key) || !bytes.Equal(itr.Value(), val) {
+			t.Errorf("Item mismatch at %d", i)
+		}
+		i++
+	}
+	itr.Close()
+	snap.Close()
+	db.Close()
+
+	if i != n {
+		t.Errorf("Expected %d items, got %d", n, i)
+	}
+
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("Expected block size mismatch to fail")
+			}
+		}()
+
+		conf.SetBlockSize(4096)
+		NewWithConfig(conf).Close()
+	}()
+
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("Expected invalid block size to fail")
+			}
+		}()
+
+		conf.SetBlockStoreDir("")
+		conf.SetBlockSize(3000)
+		NewWithConfig(conf).Close()
+	}()
+}
+
+func TestBlockStoreReopen(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "nitro_blockstore_reopen")
+	defer os.RemoveAll(dir)
+
+	n := 5000
+	key := func(i int) []byte {
+		return []byte(fmt.Sprintf("%010d", i))
+	}
+
+	val := func(i, v int) []byte {
+		if i%100 == 0 {
+			return bytes.Repeat([]byte{byte(v)}, 10000)
+		}
+		return []byte(fmt.Sprintf("v%d-%d", v, i))
+	}
+
+	apply := func(db *Nitro, fn func(w *Writer)) {
+		tdb := NewWithConfig(testConf)
+		defer tdb.Close()
+		fn(tdb.NewWriter())
+		tsnap, _ := tdb.NewSnapshot()
+		defer tsnap.Close()
+		if _, err := db.ApplyOps(tsnap, 4); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+
+	verify := func(db *Nitro, expected func(i int) []byte, max int) {
+		snap, _ := db.NewSnapshot()
+		defer snap.Close()
+		itr := snap.NewIterator()
+		defer itr.Close()
+
+		itr.SeekFirst()
+		for i := 0; i < max; i++ {
+			v := expected(i)
+			if !itr.Valid() || !bytes.Equal(itr.Get(), key(i)) || !bytes.Equal(itr.Value(), v) {
+				t.Fatalf("Item mismatch at %d", i)
+			}
+			itr.Next()
+		}
+
+		if itr.Valid() {
+			t.Errorf("Unexpected item %s", itr.Get())
+		}
+	}
+
+	state1 := func(i int) []byte {
+		return val(i, 1)
+	}
+
+	state2 := func(i int) []byte {
+		if i%3 == 0 {
+			return val(i, 2)
+		}
+		return val(i, 1)
+	}
+
+	conf := testConf
+	conf.SetBlockStoreDir(dir)
+	db := NewWithConfig(conf)
+	apply(db, func(w *Writer) {
+		for i := 0; i < n; i++ {
+			w.Set(key(i), val(i, 1))
+		}
+	})
+	db.Close()
+
+	db = NewWithConfig(conf)
+	verify(db, state1, n)
+	apply(db, func(w *Writer) {
+		for i := 0; i < n; i += 3 {
+			w.Set(key(i), val(i, 2))
+		}
+	})
+	verify(db, state2, n)
+	db.Close()
+
+	db = NewWithConfig(conf)
+	verify(db, state2, n)
+	db.Close()
+
+	// ApplyOps journals the index changes instead of rewriting the index.
+	// Crashes are simulated using copies of the files.
+	index2, _ := ioutil.ReadFile(filepath.Join(dir, blockIndexFile))
+	db = NewWithConfig(conf)
+	apply(db, func(w *Writer) {
+		for i := n; i < 2*n; i++ {
+			w.Set(key(i), val(i, 3))
+		}
+	})
+
+	if index, _ := ioutil.ReadFile(filepath.Join(dir, blockIndexFile)); !bytes.Equal(index, index2) {
+		t.Errorf("Expected the block index not to be rewritten by ApplyOps")
+	}
+
+	copyFiles := func(name string) string {
+		dst := filepath.Join(dir, name)
+		os.MkdirAll(dst, 0755)
+		files, _ := filepath.Glob(filepath.Join(dir, "blockstore*"))
+		for _, f := range files {
+			bs, _ := ioutil.ReadFile(f)
+			ioutil.WriteFile(filepath.Join(dst, filepath.Base(f)), bs, 0755)
+		}
+		return dst
+	}
+
+	journalDir := copyFiles("journal")
+	crashDir := copyFiles("crash")
+	db.Close()
+
+	jconf := testConf
+	jconf.SetBlockStoreDir(journalDir)
+	db = NewWithConfig(jconf)
+	verify(db, func(i int) []byte {
+		if i >= n {
+			return val(i, 3)
+		}
+		return state2(i)
+	}, 2*n)
+	db.Close()
+
+	// Blocks of a torn journal record are discarded
+	logFile := filepath.Join(crashDir, blockIndexLogFile)
+	bs, _ := ioutil.ReadFile(logFile)
+	if len(bs) == 0 {
+		t.Fatalf("Expected index changes to be journaled")
+	}
+	ioutil.WriteFile(logFile, bs[:len(bs)-1], 0755)
+
+	conf.SetBlockStoreDir(crashDir)
+	db = NewWithConfig(conf)
+	verify(db, state2, n)
+	apply(db, func(w *Writer) {
+		for i := 1; i < n; i += 3 {
+			w.Set(key(i), val(i, 3))
+		}
+	})
+	db.Close()
+
+	db = NewWithConfig(conf)
+	defer db.Close()
+	verify(db, func(i int) []byte {
+		if i%3 == 1 {
+			return val(i, 3)
+		}
+		return state2(i)
+	}, n)
+}
+
+func TestOpenError(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "nitro_open")
+	defer os.RemoveAll(dir)
+
+	conf := testConf
+	conf.SetBlockStoreDir(filepath.Join(dir, "blockstore"))
+	db := NewWithConfig(conf)
+	tdb := NewWithConfig(testConf)
+	w := tdb.NewWriter()
+	for i := 0; i < 1000; i++ {
+		w.Set([]byte(fmt.Sprintf("%010d", i)), []byte("v"))
+	}
+	tsnap, _ := tdb.NewSnapshot()
+	if _, err := db.ApplyOps(tsnap, 1); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	tsnap.Close()
+	tdb.Close()
+	db.Close()
+
+	// Corrupted block index
+	index := filepath.Join(dir, "blockstore", blockIndexFile)
+	bs, _ := ioutil.ReadFile(index)
+	corrupt := append([]byte{}, bs...)
+	corrupt[len(corrupt)/2] ^= 0xff
+	ioutil.WriteFile(index, corrupt, 0644)
+	if db, err := Open(conf); db != nil || err != ErrInvalidBlockIndex {
+		t.Errorf("Expected invalid block index error, got %v", err)
+	}
+
+	func() {
+		defer func() {
+			if r := recover(); r != ErrInvalidBlockIndex {
+				t.Errorf("Expected invalid block index panic, got %v", r)
+			}
+		}()
+		NewWithConfig(conf)
+	}()
+
+	// Write-ahead log directory which cannot be created
+	ioutil.WriteFile(index, bs, 0644)
+	walFile := filepath.Join(dir, "wal")
+	ioutil.WriteFile(walFile, nil, 0644)
+	wconf := testConf
+	wconf.SetWAL(walFile, WALSyncNone, 0)
+	if db, err := Open(wconf); db != nil || err == nil {
+		t.Errorf("Expected write-ahead log error")
+	}
+
+	db, err := Open(conf)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer db.Close()
+	snap, _ := db.NewSnapshot()
+	defer snap.Close()
+	if c := CountItems(snap); c != 1000 {
+		t.Errorf("Expected 1000 items, got %d", c)
+	}
+}
+
+func TestBlockStoreFreeMaps(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "nitro_blockstore_freemaps")
+	defer os.RemoveAll(dir)
+
+	n := 10000
+	apply := func(db *Nitro, v int) {
+		tdb := NewWithConfig(testConf)
+		defer tdb.Close()
+		w := tdb.NewWriter()
+		for i := 0; i < n; i++ {
+			w.Set([]byte(fmt.Sprintf("%010d", i)), []byte(fmt.Sprintf("v%d-%d", v, i)))
+		}
+		tsnap, _ := tdb.NewSnapshot()
+		defer tsnap.Close()
+		if _, err := db.ApplyOps(tsnap, 4); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+
+	sumStats := func(db *Nitro) (total, free int64) {
+		for _, s := range db.BlockStoreStats() {
+			total += s.TotalBlocks
+			free += s.FreeBlocks
+		}
+		return
+	}
+
+	conf := testConf
+	conf.SetBlockStoreDir(dir)
+	db := NewWithConfig(conf)
+	apply(db, 1)
+	apply(db, 2)
+	db.Close()
+
+	db = NewWithConfig(conf)
+	total, free := sumStats(db)
+	db.Close()
+	if free == 0 || free >= total {
+		t.Errorf("Expected free blocks, got %d of %d", free, total)
+	}
+
+	// Free blocks are found by traversing the index without free maps
+	maps, _ := filepath.Glob(filepath.Join(dir, "blockstore-*.free"))
+	if len(maps) != conf.storageShards {
+		t.Errorf("Expected %d free maps, got %d", conf.storageShards, len(maps))
+	}
+
+	for _, f := range maps {
+		os.Remove(f)
+	}
+
+	db = NewWithConfig(conf)
+	if total2, free2 := sumStats(db); total2 != total || free2 != free {
+		t.Errorf("Expected %d free blocks of %d, got %d of %d", free, total, free2, total2)
+	}
+
+	apply(db, 3)
+	if _, free2 := sumStats(db); free2 >= free {
+		t.Errorf("Expected free blocks to be reused, got %d free blocks", free2)
+	}
+	db.Close()
+
+	db = NewWithConfig(conf)
+	defer db.Close()
+	snap, _ := db.NewSnapshot()
+	defer snap.Close()
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("%010d", i))
+		if v, ok := snap.Get(key); !ok || string(v) != fmt.Sprintf("v3-%d", i) {
+			t.Fatalf("Expected value for %s, got %s", key, v)
+		}
+	}
+}
+
+func TestBlockStoreCompaction(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "nitro_blockstore_compaction")
+	defer os.RemoveAll(dir)
+
+	n := 10000
+	apply := func(db *Nitro, v int) {
+		tdb := NewWithConfig(testConf)
+		defer tdb.Close()
+		w := tdb.NewWriter()
+		for i := 0; i < n; i++ {
+			w.Set([]byte(fmt.Sprintf("%010d", i)), []byte(fmt.Sprintf("v%d-%d", v, i)))
+		}
+		tsnap, _ := tdb.NewSnapshot()
+		defer tsnap.Close()
+		if _, err := db.ApplyOps(tsnap, 4); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+
+	verify := func(db *Nitro) {
+		snap, _ := db.NewSnapshot()
+		defer snap.Close()
+		for i := 0; i < n; i++ {
+			key := []byte(fmt.Sprintf("%010d", i))
+			if v, ok := snap.Get(key); !ok || string(v) != fmt.Sprintf("v2-%d", i) {
+				t.Fatalf("Expected value for %s, got %s", key, v)
+			}
+		}
+	}
+
+	sumStats := func(db *Nitro) (total, free int64) {
+		for _, s := range db.BlockStoreStats() {
+			total += s.TotalBlocks
+			free += s.FreeBlocks
+		}
+		return
+	}
+
+	conf := testConf
+	conf.SetBlockStoreDir(dir)
+	db := NewWithConfig(conf)
+	apply(db, 1)
+	apply(db, 2)
+	db.Close()
+
+	// Replaced blocks at the head of the files are free
+	db = NewWithConfig(conf)
+	total, free := sumStats(db)
+
+	done := make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				verify(db)
+			}
+		}
+	}()
+
+	var progress []CompactionStats
+	stats, err := db.CompactBlockStore(CompactionOptions{
+		RateLimiter:      NewRateLimiter(0, 1000000),
+		MinFragmentation: 0.1,
+		Progress: func(s CompactionStats) {
+			progress = append(progress, s)
+		},
+	})
+	close(done)
+
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if stats.BlocksMoved == 0 || stats.FilesCompacted == 0 ||
+		stats.FilesCompacted != len(progress) {
+		t.Errorf("Unexpected compaction stats %v", stats)
+	}
+
+	total2, free2 := sumStats(db)
+	if total2 >= total || free2 >= free ||
+		stats.BytesReclaimed != (total-total2)*int64(conf.blockSize) {
+		t.Errorf("Expected files to shrink, got %d of %d free blocks, was %d of %d (%v)",
+			free2, total2, free, total, stats)
+	}
+
+	verify(db)
+	db.Close()
+
+	db = NewWithConfig(conf)
+	defer db.Close()
+	verify(db)
+
+	// Moved blocks are never appended to the files
+	fbm := db.bm.(*fileBlockManager)
+	total, free = sumStats(db)
+	if _, err := fbm.writeBlockBelow(make([]byte, conf.blockSize), 0, 0); err != errNoFreeBlock {
+		t.Errorf("Expected no free block error, got %v", err)
+	}
+
+	if total2, free2 := sumStats(db); total2 != total || free2 != free {
+		t.Errorf("Expected %d of %d free blocks, got %d of %d", free, total, free2, total2)
+	}
+
+	conf = testConf
+	conf.useMemoryMgmt = false
+	conf.SetBlockStoreDir(filepath.Join(dir, "nomm"))
+	os.MkdirAll(filepath.Join(dir, "nomm"), 0755)
+	db2 := NewWithConfig(conf)
+	defer db2.Close()
+	if _, err := db2.CompactBlockStore(CompactionOptions{}); err != ErrCompactionUnsupported {
+		t.Errorf("Expected compaction unsupported error, got %v", err)
+	}
+}
+
+func TestBlockStoreCloseError(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "nitro_blockstore_close")
+	defer os.RemoveAll(dir)
+
+	conf := testConf
+	conf.SetBlockStoreDir(dir)
+	db := NewWithConfig(conf)
+
+	tdb := NewWithConfig(testConf)
+	defer tdb.Close()
+	w := tdb.NewWriter()
+	for i := 0; i < 1000; i++ {
+		w.Set([]byte(fmt.Sprintf("%010d", i)), []byte(fmt.Sprintf("val-%d", i)))
+	}
+	tsnap, _ := tdb.NewSnapshot()
+	defer tsnap.Close()
+	if _, err := db.ApplyOps(tsnap, 4); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// The block index cannot be persisted
+	os.RemoveAll(dir)
+	ioutil.WriteFile(dir, nil, 0644)
+	if err := db.Close(); err == nil {
+		t.Errorf("Expected close to fail")
+	}
+}
+
+func TestBlockStoreCorruption(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "nitro_blockstore_corruption")
+	defer os.RemoveAll(dir)
+
+	conf := testConf
+	conf.SetBlockStoreDir(dir)
+	db := NewWithConfig(conf)
+
+	tdb := NewWithConfig(testConf)
+	w := tdb.NewWriter()
+	for i := 0; i < 1000; i++ {
+		w.Set([]byte(fmt.Sprintf("%010d", i)), []byte(fmt.Sprintf("val-%d", i)))
+	}
+	w.Set([]byte("large"), bytes.Repeat([]byte("x"), 3*defaultBlockSize))
+	tsnap, _ := tdb.NewSnapshot()
+	if _, err := db.ApplyOps(tsnap, 1); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	tsnap.Close()
+	tdb.Close()
+
+	// First data block and the last overflow block of the large item
+	var overflow blockPtr
+	buf := db.store.MakeBuf()
+	itr := db.store.NewIterator(db.iterCmp, buf)
+	itr.SeekFirst()
+	first := blockPtr(itr.GetNode().DataPtr)
+	for ; itr.Valid(); itr.Next() {
+		if bptr := blockPtr(itr.GetNode().DataPtr); bptr.HasOverflow() {
+			ptrs, err := overflowBlocks(db.bm, bptr, make([]byte, defaultBlockSize))
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			overflow = ptrs[len(ptrs)-1]
+		}
+	}
+	itr.Close()
+	db.store.FreeBuf(buf)
+	db.Close()
+
+	if overflow == 0 {
+		t.Fatalf("Expected an overflow block")
+	}
+
+	for _, bptr := range []blockPtr{first, overflow} {
+		fd, err := os.OpenFile(filepath.Join(dir, fmt.Sprintf("blockstore-%d.data", bptr.Shard())), os.O_RDWR, 0)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+
+		var b [1]byte
+		off := bptr.Offset() + overflowBlockHdrSize + 10
+		fd.ReadAt(b[:], off)
+		b[0] ^= 0xff
+		fd.WriteAt(b[:], off)
+		fd.Close()
+	}
+
+	isCorruption := func(err error, bptr blockPtr) bool {
+		cerr, ok := err.(*BlockCorruptionError)
+		return ok && cerr.Shard == bptr.Shard() && cerr.Offset == bptr.Offset()
+	}
+
+	db = NewWithConfig(conf)
+	defer db.Close()
+	snap, _ := db.NewSnapshot()
+	defer snap.Close()
+
+	it := snap.NewIterator()
+	it.SeekFirst()
+	if it.Valid() || !isCorruption(it.Err(), first) {
+		t.Errorf("Expected corruption error for block %d:%d, got %v", first.Shard(), first.Offset(), it.Err())
+	}
+	it.Close()
+
+	it = snap.NewRangeIterator([]byte("large"), nil, RangeOptions{})
+	it.SeekFirst()
+	if it.Valid() || !isCorruption(it.Err(), overflow) {
+		t.Errorf("Expected corruption error for overflow block %d:%d, got %v",
+			overflow.Shard(), overflow.Offset(), it.Err())
+	}
+	it.Close()
+
+	if _, found, err := snap.GetErr([]byte(fmt.Sprintf("%010d", 0))); found || !isCorruption(err, first) {
+		t.Errorf("Expected corruption error, got %v", err)
+	}
+
+	if _, found, err := snap.GetErr([]byte("large")); found || !isCorruption(err, overflow) {
+		t.Errorf("Expected corruption error for overflow block, got %v", err)
+	}
+
+	if _, found := snap.Get([]byte(fmt.Sprintf("%010d", 0))); found {
+		t.Errorf("Expected corrupted item not to be found")
+	}
+
+	tdb = NewWithConfig(testConf)
+	defer tdb.Close()
+	tdb.NewWriter().Set([]byte(fmt.Sprintf("%010d", 1)), []byte("new"))
+	tsnap, _ = tdb.NewSnapshot()
+	defer tsnap.Close()
+	if _, err := db.ApplyOps(tsnap, 1); !isCorruption(err, first) {
+		t.Errorf("Expected corruption error from ApplyOps, got %v", err)
+	}
+}
+
+func TestBlockCompression(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "nitro_block_compression")
+	defer os.RemoveAll(dir)
+
+	n := 10000
+	// Incompressible values make the entries of a block not fit once the
+	// block is compressed
+	value := func(i, v int) []byte {
+		val := []byte(fmt.Sprintf(`{"id": %d, "version": %d, "name": "item-%d", "tags": ["cold", "json"]}`, i, v, i))
+		if i%1000 >= 500 && i%1000 < 700 {
+			rnd := rand.New(rand.NewSource(int64(i*10 + v)))
+			for j := 0; j < 60; j++ {
+				val = append(val, byte(rnd.Int()))
+			}
+		}
+		return val
+	}
+
+	apply := func(db *Nitro, v, step int) BatchOpStats {
+		tdb := NewWithConfig(testConf)
+		defer tdb.Close()
+		w := tdb.NewWriter()
+		for i := 0; i < n; i += step {
+			w.Set([]byte(fmt.Sprintf("%010d", i)), value(i, v))
+		}
+		w.Set([]byte(fmt.Sprintf("%010d-large", v)), bytes.Repeat(value(0, v), 200))
+		tsnap, _ := tdb.NewSnapshot()
+		defer tsnap.Close()
+		stats, err := db.ApplyOps(tsnap, 4)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		return stats
+	}
+
+	verify := func(db *Nitro) {
+		snap, _ := db.NewSnapshot()
+		defer snap.Close()
+		keys := make([][]byte, n)
+		for i := range keys {
+			keys[i] = []byte(fmt.Sprintf("%010d", i))
+		}
+
+		for i, val := range snap.MultiGet(keys) {
+			v := 1
+			if i%3 == 0 {
+				v = 2
+			}
+			if !bytes.Equal(val, value(i, v)) {
+				t.Fatalf("Expected value for %d, got %s", i, val)
+			}
+		}
+
+		count := 0
+		itr := snap.NewIterator()
+		for itr.SeekFirst(); itr.Valid(); itr.Next() {
+			count++
+		}
+		if itr.Err() != nil || count != n+2 {
+			t.Errorf("Expected %d items, got %d (%v)", n+2, count, itr.Err())
+		}
+		itr.Close()
+	}
+
+	conf := testConf
+	conf.SetBlockStoreDir(filepath.Join(dir, "raw"))
+	os.MkdirAll(conf.blockStoreDir, 0755)
+	rdb := NewWithConfig(conf)
+	rawStats := apply(rdb, 1, 1)
+	rdb.Close()
+
+	conf.SetBlockStoreDir(filepath.Join(dir, "compressed"))
+	conf.SetBlockCompressionCodec(FlateCodec)
+	os.MkdirAll(conf.blockStoreDir, 0755)
+	db := NewWithConfig(conf)
+	stats := apply(db, 1, 1)
+	if stats.BlocksWritten*3 > rawStats.BlocksWritten {
+		t.Errorf("Expected less blocks, got %d compressed and %d uncompressed blocks",
+			stats.BlocksWritten, rawStats.BlocksWritten)
+	}
+
+	// Compressed blocks are rewritten
+	apply(db, 2, 3)
+	verify(db)
+
+	buf := db.store.MakeBuf()
+	itr := db.store.NewIterator(db.iterCmp, buf)
+	itr.SeekFirst()
+	bptr := blockPtr(itr.GetNode().DataPtr)
+	itr.Close()
+	db.store.FreeBuf(buf)
+	bs := make([]byte, conf.blockSize)
+	if err := db.bm.ReadBlock(bptr, bs); err != nil || bs[2] != FlateCodec {
+		t.Errorf("Expected compressed block, got codec %d (%v)", bs[2], err)
+	}
+	db.Close()
+
+	db = NewWithConfig(conf)
+	verify(db)
+	if _, err := db.CompactBlockStore(CompactionOptions{}); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+	verify(db)
+	db.Close()
+
+	// Compressed blocks are readable without compression of new blocks
+	conf.SetBlockCompressionCodec(NoCodec)
+	db = NewWithConfig(conf)
+	defer db.Close()
+	verify(db)
+}
+
+func containsPlaintext(t *testing.T, pattern string, plain []byte) bool {
+	files, _ := filepath.Glob(pattern)
+	if len(files) == 0 {
+		t.Fatalf("No files found for %s", pattern)
+	}
+
+	for _, file := range files {
+		if bs, _ := ioutil.ReadFile(file); bytes.Contains(bs, plain) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestEncryption(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "nitro_encryption")
+	defer os.RemoveAll(dir)
+
+	ring := NewKeyRing()
+	if err := ring.AddKey(1, bytes.Repeat([]byte{1}, 32), true); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	plain := bytes.Repeat([]byte("k"), 1000)
+	n := 30
+	for _, ft := range []FileType{ChecksumFile, CompressedFile} {
+		conf := testConf
+		conf.SetFileType(ft)
+		conf.SetEncryption(ring)
+		db := NewWithConfig(conf)
+		w := db.NewWriter()
+		for i := 0; i < n; i++ {
+			w.Set(largeItemKV(i))
+		}
+		snap, _ := db.NewSnapshot()
+		backup := filepath.Join(dir, fmt.Sprintf("backup-%d", ft))
+		if err := db.StoreToDisk(backup, snap, 4, nil); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		db.Close()
+
+		if containsPlaintext(t, filepath.Join(backup, "data", "shard-*"), plain) {
+			t.Errorf("Found plaintext in backup files")
+		}
+
+		if report, err := VerifyBackup(backup, nil); err != nil || report.OK() {
+			t.Errorf("Expected encrypted backup verification to fail without keys (%v)", err)
+		}
+
+		report, err := VerifyEncryptedBackupStore(NewDirBackupStore(backup), nil, ring)
+		if err != nil || !report.OK() || report.ItemsCount != int64(n) {
+			t.Errorf("Expected encrypted backup to be verified, got %+v (%v)", report, err)
+		}
+
+		db2 := NewWithConfig(conf)
+		snap, err = db2.LoadFromDisk(backup, 4, nil)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		verifyLargeItems(t, snap, n)
+		snap.Close()
+
+		// Encrypted blocks are bound to their file
+		store := NewDirBackupStore(backup)
+		bs, _ := ioutil.ReadFile(filepath.Join(backup, "data", "shard-0"))
+		store.Commit("data/shard-moved", bs)
+		r := db2.newFileReader(ft)
+		if err := r.Open(store, "data/shard-moved"); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if _, err := r.ReadItem(); err == nil || !strings.Contains(err.Error(), "block decryption failed") {
+			t.Errorf("Expected moved encrypted blocks to fail decryption, got %v", err)
+		}
+		r.Close()
+		db2.Close()
+
+		conf.SetEncryption(nil)
+		db3 := NewWithConfig(conf)
+		if _, err := db3.LoadFromDisk(backup, 4, nil); err == nil {
+			t.Errorf("Expected encrypted backup to fail without keys")
+		}
+		db3.Close()
+	}
+
+	// Default file type is replaced by an encrypted file type
+	conf := testConf
+	conf.SetEncryption(ring)
+	db := NewWithConfig(conf)
+	snap, _ := db.NewSnapshot()
+	if err := db.StoreToDisk(filepath.Join(dir, "default"), snap, 4, nil); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+	db.Close()
+
+	rconf := conf
+	rconf.SetFileType(RawdbKVFile)
+	db = NewWithConfig(rconf)
+	snap, _ = db.NewSnapshot()
+	if err := db.StoreToDisk(filepath.Join(dir, "raw"), snap, 4, nil); err != ErrEncryptionUnsupported {
+		t.Errorf("Expected unsupported encryption, got %v", err)
+	}
+	db.Close()
+
+	// Encrypted block store with key rotation
+	tdb := NewWithConfig(testConf)
+	defer tdb.Close()
+	w := tdb.NewWriter()
+	for i := 0; i < n; i++ {
+		w.Set(largeItemKV(i))
+	}
+	tsnap, _ := tdb.NewSnapshot()
+	defer tsnap.Close()
+
+	bsDir := filepath.Join(dir, "blockstore")
+	os.MkdirAll(bsDir, 0755)
+	conf.SetBlockStoreDir(bsDir)
+	db = NewWithConfig(conf)
+	if _, err := db.ApplyOps(tsnap, 4); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if containsPlaintext(t, filepath.Join(bsDir, "blockstore-*.data"), plain) {
+		t.Errorf("Found plaintext in block store files")
+	}
+
+	if c, err := db.RotateBlockKeys(); err != nil || c != 0 {
+		t.Errorf("Expected no blocks to rotate, got %d (%v)", c, err)
+	}
+
+	ring.AddKey(2, bytes.Repeat([]byte{2}, 16), true)
+	if c, err := db.RotateBlockKeys(); err != nil || c == 0 {
+		t.Errorf("Expected blocks to be rotated, got %d (%v)", c, err)
+	}
+
+	if c, err := db.RotateBlockKeys(); err != nil || c != 0 {
+		t.Errorf("Expected all blocks to be rotated, got %d (%v)", c, err)
+	}
+
+	snap, _ = db.NewSnapshot()
+	verifyLargeItems(t, snap, n)
+	snap.Close()
+	db.Close()
+
+	if containsPlaintext(t, filepath.Join(bsDir, blockIndexFile), plain) {
+		t.Errorf("Found plaintext in block store index")
+	}
+
+	db = NewWithConfig(conf)
+	defer db.Close()
+	snap, _ = db.NewSnapshot()
+	defer snap.Close()
+	verifyLargeItems(t, snap, n)
+}
+
+func TestEncryptionWALAndStream(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "nitro_encryption")
+	defer os.RemoveAll(dir)
+
+	ring := NewKeyRing()
+	ring.AddKey(1, bytes.Repeat([]byte{1}, 32), true)
+
+	plain := bytes.Repeat([]byte("k"), 1000)
+	n := 30
+	conf := testConf
+	conf.SetEncryption(ring)
+	conf.SetWAL(filepath.Join(dir, "wal"), WALSyncAlways, 0)
+	db := NewWithConfig(conf)
+	defer db.Close()
+	snap, _ := db.NewSnapshot()
+	backup := filepath.Join(dir, "backup")
+	if err := db.StoreToDisk(backup, snap, 4, nil); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	w := db.NewWriter()
+	for i := 0; i < n; i++ {
+		w.Set(largeItemKV(i))
+	}
+
+	if containsPlaintext(t, filepath.Join(dir, "wal", "wal-*.log"), plain) {
+		t.Errorf("Found plaintext in write-ahead log")
+	}
+
+	// A new key is used for the next log segments
+	ring.AddKey(2, bytes.Repeat([]byte{2}, 16), true)
+	snap, _ = db.NewSnapshot()
+	var buf bytes.Buffer
+	if err := db.StoreToStream(&buf, snap, 4); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if bytes.Contains(buf.Bytes(), plain) {
+		t.Errorf("Found plaintext in backup stream")
+	}
+
+	db2 := NewWithConfig(conf)
+	defer db2.Close()
+	snap, err := db2.LoadFromStream(bytes.NewReader(buf.Bytes()), 4)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	verifyLargeItems(t, snap, n)
+	snap.Close()
+
+	pconf := testConf
+	db3 := NewWithConfig(pconf)
+	defer db3.Close()
+	if _, err := db3.LoadFromStream(bytes.NewReader(buf.Bytes()), 4); err == nil {
+		t.Errorf("Expected encrypted stream to fail without keys")
+	}
+
+	// Frames cannot be reordered or moved to another shard
+	bs := buf.Bytes()
+	hdrSize := streamHdrSize + 4
+	frameLen := func(off int) int {
+		return streamFrameHdrSize + int(binary.BigEndian.Uint32(bs[off+4:off+8]))
+	}
+	l1 := frameLen(hdrSize)
+	s1 := binary.BigEndian.Uint32(bs[hdrSize:])
+	s2 := binary.BigEndian.Uint32(bs[hdrSize+l1:])
+	if s2 == streamEndShard {
+		t.Fatalf("Expected more than one frame")
+	}
+	l2 := frameLen(hdrSize + l1)
+
+	tampered := append([]byte(nil), bs[:hdrSize]...)
+	if s1 == s2 {
+		tampered = append(tampered, bs[hdrSize+l1:hdrSize+l1+l2]...)
+		tampered = append(tampered, bs[hdrSize:hdrSize+l1]...)
+	} else {
+		tampered = append(tampered, bs[hdrSize:hdrSize+l1]...)
+		binary.BigEndian.PutUint32(tampered[hdrSize:], s2)
+		tampered = append(tampered, bs[hdrSize+l1:hdrSize+l1+l2]...)
+	}
+	tampered = append(tampered, bs[hdrSize+l1+l2:]...)
+
+	db4 := NewWithConfig(conf)
+	if _, err := db4.LoadFromStream(bytes.NewReader(tampered), 4); err != ErrInvalidStream {
+		t.Errorf("Expected invalid stream error, got %v", err)
+	}
+	db4.Close()
+
+	// Replay the encrypted log on top of the empty backup
+	db5 := NewWithConfig(conf)
+	defer db5.Close()
+	snap, err = db5.LoadFromDisk(backup, 4, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	verifyLargeItems(t, snap, n)
+	snap.Close()
+
+	pconf.SetWAL(filepath.Join(dir, "wal"), WALSyncAlways, 0)
+	db6 := NewWithConfig(pconf)
+	defer db6.Close()
+	if _, err := db6.RestorePoints(); err == nil {
+		t.Errorf("Expected encrypted log to fail without keys")
+	}
+}
+
+func TestStreamBackup(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+	w := db.NewWriter()
+	n := 100000
+	for i := 0; i < n; i++ {
+		w.Set([]byte(fmt.Sprintf("%010d", i)), []byte(fmt.Sprintf("val-%d", i)))
+	}
+	snap, _ := db.NewSnapshot()
+
+	var buf bytes.Buffer
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(db.StoreToStream(io.MultiWriter(pw, &buf), snap, 4))
+	}()
+
+	db2 := NewWithConfig(testConf)
+	defer db2.Close()
+	snap2, err := db2.LoadFromStream(pr, 4)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer snap2.Close()
+
+	itr := snap2.NewIterator()
+	i := 0
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		key := fmt.Sprintf("%010d", i)
+		if string(itr.Get()) != key || string(itr.Value()) != fmt.Sprintf("val-%d", i) {
+			t.Errorf("Expected %s, got %s=%s", key, itr.Get(), itr.Value())
+		}
+		i++
+	}
+	itr.Close()
+
+	if i != n {
+		t.Errorf("Expected %d items, got %d", n, i)
+	}
+
+	bs := buf.Bytes()
+	corrupted := append([]byte(nil), bs...)
+	corrupted[len(bs)/2] ^= 0xff
+	db3 := NewWithConfig(testConf)
+	defer db3.Close()
+	if _, err := db3.LoadFromStream(bytes.NewReader(corrupted), 4); err != ErrInvalidStream {
+		t.Errorf("Expected invalid stream error, got %v", err)
+	}
+
+	db4 := NewWithConfig(testConf)
+	defer db4.Close()
+	if _, err := db4.LoadFromStream(bytes.NewReader(bs[:len(bs)-20]), 4); err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected unexpected EOF error, got %v", err)
+	}
+
+	if _, err := db4.LoadFromStream(bytes.NewReader(bs), 0); err != ErrInvalidConcurrency {
+		t.Errorf("Expected invalid concurrency error, got %v", err)
+	}
+
+	// Sizes are validated before the allocations
+	tooManyShards := append([]byte(nil), bs...)
+	binary.BigEndian.PutUint32(tooManyShards[16:20], streamMaxShards+1)
+	if _, err := db4.LoadFromStream(bytes.NewReader(tooManyShards), 4); err != ErrInvalidStream {
+		t.Errorf("Expected invalid stream error, got %v", err)
+	}
+
+	largeFrame := append([]byte(nil), bs...)
+	binary.BigEndian.PutUint32(largeFrame[streamHdrSize+4:], 0xffffffff)
+	if _, err := db4.LoadFromStream(bytes.NewReader(largeFrame), 4); err != ErrInvalidStream {
+		t.Errorf("Expected invalid stream error, got %v", err)
+	}
+}
+
+func TestBackupStore(t *testing.T) {
+	conf := testConf
+	conf.SetFileType(ChecksumFile)
+	db := NewWithConfig(conf)
+	defer db.Close()
+	w := db.NewWriter()
+	n := 10000
+	for i := 0; i < n; i++ {
+		w.Set([]byte(fmt.Sprintf("%010d", i)), []byte(fmt.Sprintf("val-%d", i)))
+	}
+	snap, _ := db.NewSnapshot()
+	snap.Open()
+
+	store := NewMemBackupStore()
+	if err := db.StoreToBackupStore(store, snap, 4, nil, BackupOptions{}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	for i := 0; i < n; i += 2 {
+		w.Delete([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap2, _ := db.NewSnapshot()
+	defer snap2.Close()
+
+	incrStore := NewMemBackupStore()
+	if err := db.StoreIncrementalToBackupStore(incrStore, snap, snap2, 4); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	snap.Close()
+
+	names, _ := store.List("data/")
+	if len(names) != runtime.NumCPU()+1 {
+		t.Errorf("Unexpected backup objects %v", names)
+	}
+
+	db2 := NewWithConfig(conf)
+	defer db2.Close()
+	rsnap, err := db2.LoadIncrementalFromBackupStore(store, []BackupStore{incrStore}, 4, nil, BackupOptions{})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer rsnap.Close()
+
+	if c := CountItems(rsnap); c != n/2 {
+		t.Errorf("Expected %d items, got %d", n/2, c)
+	}
+
+	// A backup without a manifest cannot be restored
+	store.Delete("data/files.json")
+	db3 := NewWithConfig(conf)
+	defer db3.Close()
+	if _, err := db3.LoadFromBackupStore(store, 4, nil, BackupOptions{}); err != ErrBackupObjectNotFound {
+		t.Errorf("Expected object not found error, got %v", err)
+	}
+
+	dir, _ := ioutil.TempDir("", "nitro_store")
+	defer os.RemoveAll(dir)
+	dstore := NewDirBackupStore(dir)
+	if err := dstore.Commit("data/files.json", []byte("[]")); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if names, _ := dstore.List(""); len(names) != 1 || names[0] != "data/files.json" {
+		t.Errorf("Unexpected backup objects %v", names)
+	}
+}
+
+func TestBackupManifest(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "nitro_backup")
+	defer os.RemoveAll(dir)
+
+	conf := testConf
+	conf.SetFileType(ChecksumFile)
+	db := NewWithConfig(conf)
+	defer db.Close()
+	w := db.NewWriter()
+	n := 10000
+	for i := 0; i < n; i++ {
+		w.Set([]byte(fmt.Sprintf("%010d", i)), []byte(fmt.Sprintf("val-%d", i)))
+	}
+	snap, _ := db.NewSnapshot()
+	sn := snap.sn
+	if err := db.StoreToDisk(dir, snap, 4, nil); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	store := NewDirBackupStore(dir)
+	manifest, err := ReadBackupManifest(store)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if manifest.Snapshot != sn || manifest.ItemsCount != int64(n) ||
+		manifest.FileType != ChecksumFile || !manifest.DeltaInterleaving {
+		t.Errorf("Unexpected manifest %+v", manifest)
+	}
+
+	if len(manifest.Files) != runtime.NumCPU()+db.numWriters() {
+		t.Errorf("Expected data and delta files, got %+v", manifest.Files)
+	}
+
+	for _, fi := range manifest.Files {
+		bs, _ := ioutil.ReadFile(filepath.Join(dir, fi.Name))
+		if int64(len(bs)) != fi.Size || crc32.Checksum(bs, crc32cTable) != fi.Checksum {
+			t.Errorf("File %s does not match manifest %+v", fi.Name, fi)
+		}
+	}
+
+	// Truncated backup file
+	shard := filepath.Join(dir, manifest.Files[0].Name)
+	bs, _ := ioutil.ReadFile(shard)
+	ioutil.WriteFile(shard, bs[:len(bs)-1], 0755)
+	db2 := NewWithConfig(conf)
+	defer db2.Close()
+	if _, err := db2.LoadFromDisk(dir, 4, nil); err == nil {
+		t.Errorf("Expected error for truncated backup file")
+	}
+
+	// Interrupted backup
+	store.Commit(backupMarkerFile, nil)
+	os.Remove(filepath.Join(dir, "manifest.json"))
+	db3 := NewWithConfig(conf)
+	defer db3.Close()
+	if _, err := db3.LoadFromDisk(dir, 4, nil); err != ErrIncompleteBackup {
+		t.Errorf("Expected incomplete backup error, got %v", err)
+	}
+}
+
+// writeLegacyBackupFile writes keys in the [2 byte len][item bytes] format
+// of the backup files written before backup manifests were introduced
+func writeLegacyBackupFile(t *testing.T, path string, keys []string) {
+	var buf bytes.Buffer
+	for _, k := range append(keys[:len(keys):len(keys)], "") {
+		binary.Write(&buf, binary.BigEndian, uint16(len(k)))
+		buf.WriteString(k)
+	}
+
+	os.MkdirAll(filepath.Dir(path), 0755)
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0660); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+}
+
+func TestLegacyBackup(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "nitro_backup")
+	defer os.RemoveAll(dir)
+
+	// Layout of a backup written by StoreToDisk before backup manifests
+	n := 1000
+	var keys []string
+	for i := 0; i < n; i++ {
+		keys = append(keys, fmt.Sprintf("%010d", i))
+	}
+	writeLegacyBackupFile(t, filepath.Join(dir, "data", "shard-0"), keys[:n/2])
+	writeLegacyBackupFile(t, filepath.Join(dir, "data", "shard-1"), keys[n/2:])
+	writeLegacyBackupFile(t, filepath.Join(dir, "delta", "shard-0"), []string{"delta"})
+	ioutil.WriteFile(filepath.Join(dir, "data", "files.json"), []byte(`["shard-0","shard-1"]`), 0660)
+	ioutil.WriteFile(filepath.Join(dir, "delta", "files.json"), []byte(`["shard-0"]`), 0660)
+
+	manifest, err := ReadBackupManifest(NewDirBackupStore(dir))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if !manifest.Legacy() || manifest.FileType != RawdbFile || !manifest.DeltaInterleaving {
+		t.Errorf("Unexpected manifest %+v", manifest)
+	}
+
+	db := NewWithConfig(testConf)
+	defer db.Close()
+	snap, err := db.LoadFromDisk(dir, 2, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if c := CountItems(snap); c != n+1 {
+		t.Errorf("Expected %d items, got %d", n+1, c)
+	}
+
+	if _, ok := snap.Get([]byte(keys[n/2])); !ok {
+		t.Errorf("Expected key %s", keys[n/2])
+	}
+	snap.Close()
+
+	report, err := VerifyBackup(dir, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if !report.OK() || report.ItemsCount != int64(n) || report.DeltaCount != 1 {
+		t.Errorf("Unexpected report %+v", report)
+	}
+
+	db2 := NewWithConfig(testConf)
+	defer db2.Close()
+	stats, err := db2.MergeFromDisk(dir, 2, nil)
+	if err != nil || stats.Inserted != int64(n+1) {
+		t.Errorf("Unexpected merge %+v, %v", stats, err)
+	}
+
+	// A backup which is being written is incomplete
+	NewDirBackupStore(dir).Commit(backupMarkerFile, nil)
+	db3 := NewWithConfig(testConf)
+	defer db3.Close()
+	if _, err := db3.LoadFromDisk(dir, 2, nil); err != ErrIncompleteBackup {
+		t.Errorf("Expected incomplete backup error, got %v", err)
+	}
+}
+
+func TestVerifyBackup(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "nitro_backup")
+	defer os.RemoveAll(dir)
+
+	db := NewWithConfig(testConf)
+	defer db.Close()
+	w := db.NewWriter()
+	n := 10000
+	for i := 0; i < n; i++ {
+		w.Set([]byte(fmt.Sprintf("%010d", i)), []byte(fmt.Sprintf("val-%d", i)))
+	}
+	snap, _ := db.NewSnapshot()
+	if err := db.StoreToDisk(dir, snap, 4, nil); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	report, err := VerifyBackup(dir, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if !report.OK() || report.ItemsCount != int64(n) {
+		t.Errorf("Unexpected report %+v", report)
+	}
+
+	var count int
+	VisitBackup(NewDirBackupStore(dir), func(file string, itm *Item) error {
+		count++
+		return nil
+	})
+	if count != n {
+		t.Errorf("Expected %d items, got %d", n, count)
+	}
+
+	// Shard files in the reverse order
+	var files []string
+	bs, _ := ioutil.ReadFile(filepath.Join(dir, "data", "files.json"))
+	json.Unmarshal(bs, &files)
+	for i, j := 0, len(files)-1; i < j; i, j = i+1, j-1 {
+		files[i], files[j] = files[j], files[i]
+	}
+	bs, _ = json.Marshal(files)
+	ioutil.WriteFile(filepath.Join(dir, "data", "files.json"), bs, 0660)
+
+	// Corrupted shard file
+	shard := filepath.Join(dir, "data", files[0])
+	bs, _ = ioutil.ReadFile(shard)
+	bs[len(bs)/2] ^= 0xff
+	ioutil.WriteFile(shard, bs, 0755)
+
+	report, err = VerifyBackup(dir, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if report.OK() || (len(files) > 1 && len(report.Problems) < 2) {
+		t.Errorf("Expected problems, got %v", report.Problems)
+	}
+}
+
+func TestBackupProgress(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "nitro_backup")
+	defer os.RemoveAll(dir)
+
+	db := NewWithConfig(testConf)
+	defer db.Close()
+	w := db.NewWriter()
+	n := 100000
+	for i := 0; i < n; i++ {
+		w.Set([]byte(fmt.Sprintf("%010d", i)), []byte(fmt.Sprintf("val-%d", i)))
+	}
+
+	var last BackupProgress
+	opts := BackupOptions{
+		Progress:         func(p BackupProgress) { last = p },
+		ProgressInterval: time.Millisecond,
+	}
+
+	snap, _ := db.NewSnapshot()
+	if err := db.StoreToDiskWithOptions(dir, snap, 4, nil, opts); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if !last.Done || last.Items != int64(n) || last.TotalItems != int64(n) || last.Remaining() != 0 {
+		t.Errorf("Unexpected progress %+v", last)
+	}
+
+	db2 := NewWithConfig(testConf)
+	defer db2.Close()
+	last = BackupProgress{}
+	snap2, err := db2.LoadFromDiskWithOptions(dir, 4, nil, opts)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	snap2.Close()
+
+	if !last.Done || last.Items != int64(n) || len(last.Shards) != runtime.NumCPU() {
+		t.Errorf("Unexpected progress %+v", last)
+	}
+
+	// Cancel the backup once items are being written
+	dir2, _ := ioutil.TempDir("", "nitro_backup")
+	defer os.RemoveAll(dir2)
+	ctx, cancel := context.WithCancel(context.Background())
+	var count int32
+	callb := func(*ItemEntry) {
+		if atomic.AddInt32(&count, 1) == 1000 {
+			cancel()
+		}
+	}
+
+	snap, _ = db.NewSnapshot()
+	if err := db.StoreToDiskWithOptions(dir2, snap, 4, callb, BackupOptions{Context: ctx}); err != context.Canceled {
+		t.Fatalf("Expected cancellation, got %v", err)
+	}
+
+	if names, _ := NewDirBackupStore(dir2).List(""); len(names) != 0 {
+		t.Errorf("Expected cancelled backup to be removed, found %v", names)
+	}
+
+	db3 := NewWithConfig(testConf)
+	defer db3.Close()
+	if _, err := db3.LoadFromDiskWithOptions(dir, 4, nil, BackupOptions{Context: ctx}); err != context.Canceled {
+		t.Errorf("Expected cancellation, got %v", err)
+	}
+}
+
+func TestBackupRateLimit(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "nitro_backup")
+	defer os.RemoveAll(dir)
+
+	db := NewWithConfig(testConf)
+	defer db.Close()
+	w := db.NewWriter()
+	n := 20000
+	for i := 0; i < n; i++ {
+		w.Set([]byte(fmt.Sprintf("%010d", i)), []byte(fmt.Sprintf("val-%d", i)))
+	}
+
+	limiter := NewRateLimiter(0, int64(n))
+	opts := BackupOptions{RateLimiter: limiter}
+
+	t0 := time.Now()
+	snap, _ := db.NewSnapshot()
+	snap.Open()
+	if err := db.StoreToDiskWithOptions(dir, snap, 4, nil, opts); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if dur := time.Since(t0); dur < 700*time.Millisecond {
+		t.Errorf("Expected backup to be rate limited, took %v", dur)
+	}
+
+	db2 := NewWithConfig(testConf)
+	defer db2.Close()
+	t0 = time.Now()
+	snap2, err := db2.LoadFromDiskWithOptions(dir, 4, nil, opts)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	snap2.Close()
+
+	if dur := time.Since(t0); dur < 700*time.Millisecond {
+		t.Errorf("Expected restore to be rate limited, took %v", dur)
+	}
+
+	// Lift the limits of a slow backup while it is running
+	dir2, _ := ioutil.TempDir("", "nitro_backup")
+	defer os.RemoveAll(dir2)
+	limiter.SetLimits(1024, int64(n/100))
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		limiter.SetLimits(0, 0)
+	}()
+
+	t0 = time.Now()
+	if err := db.StoreToDiskWithOptions(dir2, snap, 4, nil, opts); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if dur := time.Since(t0); dur > 5*time.Second {
+		t.Errorf("Expected limits to be lifted, took %v", dur)
+	}
+
+	if b, i := limiter.Limits(); b != 0 || i != 0 {
+		t.Errorf("Unexpected limits %d, %d", b, i)
+	}
+
+	// A rate limited backup can be cancelled while waiting
+	dir3, _ := ioutil.TempDir("", "nitro_backup")
+	defer os.RemoveAll(dir3)
+	limiter.SetLimits(1024, 0)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	snap, _ = db.NewSnapshot()
+	opts.Context = ctx
+	if err := db.StoreToDiskWithOptions(dir3, snap, 4, nil, opts); err != context.DeadlineExceeded {
+		t.Errorf("Expected cancellation, got %v", err)
+	}
+}
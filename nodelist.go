@@ -30,7 +30,7 @@ func NewNodeList(head *skiplist.Node) *NodeList {
 func (l *NodeList) Keys() (keys [][]byte) {
 	node := l.head
 	for node != nil {
-		key := (*Item)(node.Item()).Bytes()
+		key := (*Item)(node.Item()).Key()
 		keys = append(keys, key)
 		node = node.GetLink()
 	}
@@ -43,7 +43,7 @@ func (l *NodeList) Remove(key []byte) *skiplist.Node {
 	var prev *skiplist.Node
 	node := l.head
 	for node != nil {
-		nodeKey := (*Item)(node.Item()).Bytes()
+		nodeKey := (*Item)(node.Item()).Key()
 		if bytes.Equal(nodeKey, key) {
 			if prev == nil {
 				l.head = node.GetLink()
@@ -0,0 +1,191 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultProgressInterval = time.Second
+
+	// Items are taken from the rate limiter in batches
+	rateLimitBatchItems = 1000
+	rateLimitBatchBytes = 64 * 1024
+)
+
+// BackupOptions control a backup or restore operation
+type BackupOptions struct {
+	// Context cancels the operation. A cancelled backup removes the
+	// files written so far.
+	Context context.Context
+	// Progress is called periodically and once the operation completes
+	Progress func(BackupProgress)
+	// ProgressInterval is the interval between progress reports
+	ProgressInterval time.Duration
+	// RateLimiter limits the items and item data bytes written by the shard
+	// writers of a backup or read by the shard readers of a restore
+	RateLimiter *RateLimiter
+	// RestorePoint selects the snapshot restored from the backups and the
+	// write-ahead log. Incremental backups after the restore point are not
+	// applied. By default, all the logged operations are restored.
+	RestorePoint RestorePoint
+}
+
+// ShardProgress reports the items and item data bytes processed by a shard
+type ShardProgress struct {
+	Items int64
+	Bytes int64
+}
+
+// BackupProgress describes the progress of a backup or restore operation
+type BackupProgress struct {
+	Shards []ShardProgress
+	Items  int64
+	Bytes  int64
+	// Expected number of items. For a backup, it is the item count of the
+	// snapshot. For a restore, it is the item count of the backup manifest.
+	TotalItems int64
+	Elapsed    time.Duration
+	Done       bool
+}
+
+// Remaining returns the estimated time to completion based on the rate of
+// processed items
+func (p BackupProgress) Remaining() time.Duration {
+	if p.Done || p.Items == 0 || p.Items >= p.TotalItems {
+		return 0
+	}
+
+	rate := float64(p.Elapsed) / float64(p.Items)
+	return time.Duration(rate * float64(p.TotalItems-p.Items))
+}
+
+// backupTask tracks the progress and cancellation of a backup or restore
+type backupTask struct {
+	opts    BackupOptions
+	shards  []ShardProgress
+	pending []ShardProgress
+	total   int64
+	t0      time.Time
+
+	stopch chan struct{}
+	wg     sync.WaitGroup
+}
+
+func newBackupTask(opts BackupOptions, shards int, total int64) *backupTask {
+	if opts.Context == nil {
+		opts.Context = context.Background()
+	}
+
+	if opts.ProgressInterval <= 0 {
+		opts.ProgressInterval = defaultProgressInterval
+	}
+
+	t := &backupTask{
+		opts:    opts,
+		shards:  make([]ShardProgress, shards),
+		pending: make([]ShardProgress, shards),
+		total:   total,
+		t0:      time.Now(),
+		stopch:  make(chan struct{}),
+	}
+
+	t.wg.Add(1)
+	go t.run()
+	return t
+}
+
+func (t *backupTask) run() {
+	defer t.wg.Done()
+
+	ticker := time.NewTicker(t.opts.ProgressInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			t.report(false)
+		case <-t.stopch:
+			return
+		}
+	}
+}
+
+func (t *backupTask) report(done bool) {
+	if t.opts.Progress == nil {
+		return
+	}
+
+	p := BackupProgress{
+		Shards:     make([]ShardProgress, len(t.shards)),
+		TotalItems: t.total,
+		Elapsed:    time.Since(t.t0),
+		Done:       done,
+	}
+
+	for i := range t.shards {
+		p.Shards[i].Items = atomic.LoadInt64(&t.shards[i].Items)
+		p.Shards[i].Bytes = atomic.LoadInt64(&t.shards[i].Bytes)
+		p.Items += p.Shards[i].Items
+		p.Bytes += p.Shards[i].Bytes
+	}
+
+	t.opts.Progress(p)
+}
+
+// add accounts an item processed by a shard and waits for the rate limiter.
+// A shard should be processed by one goroutine at a time.
+func (t *backupTask) add(shard int, itm *Item) error {
+	atomic.AddInt64(&t.shards[shard].Items, 1)
+	atomic.AddInt64(&t.shards[shard].Bytes, int64(itm.dataLen))
+
+	if t.opts.RateLimiter == nil {
+		return nil
+	}
+
+	p := &t.pending[shard]
+	p.Items++
+	p.Bytes += int64(itm.dataLen)
+	if p.Items < rateLimitBatchItems && p.Bytes < rateLimitBatchBytes {
+		return nil
+	}
+
+	items, bytes := p.Items, p.Bytes
+	p.Items, p.Bytes = 0, 0
+	return t.opts.RateLimiter.Wait(t.opts.Context, items, bytes)
+}
+
+// err returns the context error once the operation is cancelled
+func (t *backupTask) err() error {
+	select {
+	case <-t.opts.Context.Done():
+		return t.opts.Context.Err()
+	default:
+		return nil
+	}
+}
+
+func (t *backupTask) isCancelled(err error) bool {
+	return err != nil && err == t.opts.Context.Err()
+}
+
+// stop ends progress reporting. The final report is sent if the operation
+// completed successfully.
+func (t *backupTask) stop(err error) {
+	close(t.stopch)
+	t.wg.Wait()
+	if err == nil {
+		t.report(true)
+	}
+}
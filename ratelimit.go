@@ -0,0 +1,138 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const maxRateLimitWait = 100 * time.Millisecond
+
+// RateLimiter limits the bytes and items processed per second. A single
+// limiter can be shared by concurrent backups and restores. The limits can
+// be changed while they are running.
+type RateLimiter struct {
+	sync.Mutex
+	bytesPerSec int64
+	itemsPerSec int64
+
+	// Available tokens. Negative values are owed by waiting callers.
+	bytes float64
+	items float64
+	last  time.Time
+}
+
+// NewRateLimiter creates a rate limiter. A zero limit means unlimited.
+func NewRateLimiter(bytesPerSec, itemsPerSec int64) *RateLimiter {
+	return &RateLimiter{
+		bytesPerSec: bytesPerSec,
+		itemsPerSec: itemsPerSec,
+		last:        time.Now(),
+	}
+}
+
+// SetLimits changes the limits. A zero limit means unlimited.
+func (r *RateLimiter) SetLimits(bytesPerSec, itemsPerSec int64) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.refill(time.Now())
+	r.bytesPerSec = bytesPerSec
+	r.itemsPerSec = itemsPerSec
+	if bytesPerSec == 0 {
+		r.bytes = 0
+	}
+
+	if itemsPerSec == 0 {
+		r.items = 0
+	}
+}
+
+// Limits returns the current bytes and items per second limits
+func (r *RateLimiter) Limits() (bytesPerSec, itemsPerSec int64) {
+	r.Lock()
+	defer r.Unlock()
+	return r.bytesPerSec, r.itemsPerSec
+}
+
+// refill adds the tokens accumulated since the last call. At most one
+// second worth of tokens can be accumulated.
+func (r *RateLimiter) refill(now time.Time) {
+	elapsed := now.Sub(r.last).Seconds()
+	r.last = now
+
+	if r.bytesPerSec > 0 {
+		r.bytes += elapsed * float64(r.bytesPerSec)
+		if r.bytes > float64(r.bytesPerSec) {
+			r.bytes = float64(r.bytesPerSec)
+		}
+	}
+
+	if r.itemsPerSec > 0 {
+		r.items += elapsed * float64(r.itemsPerSec)
+		if r.items > float64(r.itemsPerSec) {
+			r.items = float64(r.itemsPerSec)
+		}
+	}
+}
+
+// delay returns the duration until the owed tokens are refilled
+func (r *RateLimiter) delay() time.Duration {
+	r.Lock()
+	defer r.Unlock()
+
+	var wait float64
+	r.refill(time.Now())
+	if r.bytesPerSec > 0 && r.bytes < 0 {
+		wait = -r.bytes / float64(r.bytesPerSec)
+	}
+
+	if r.itemsPerSec > 0 && r.items < 0 {
+		if w := -r.items / float64(r.itemsPerSec); w > wait {
+			wait = w
+		}
+	}
+
+	return time.Duration(wait * float64(time.Second))
+}
+
+// Wait takes the items and bytes from the limits and blocks until they are
+// refilled or the context is done. The wait is rechecked periodically to
+// pick up changes of the limits.
+func (r *RateLimiter) Wait(ctx context.Context, items, bytes int64) error {
+	r.Lock()
+	r.refill(time.Now())
+	if r.bytesPerSec > 0 {
+		r.bytes -= float64(bytes)
+	}
+
+	if r.itemsPerSec > 0 {
+		r.items -= float64(items)
+	}
+	r.Unlock()
+
+	for wait := r.delay(); wait > 0; wait = r.delay() {
+		if wait > maxRateLimitWait {
+			wait = maxRateLimitWait
+		}
+
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
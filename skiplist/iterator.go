@@ -81,11 +81,36 @@ func (it *Iterator) SeekPrev(itm unsafe.Pointer, skip func(unsafe.Pointer) bool)
 	}
 }
 
+// SeekLast moves cursor to the last item
+func (it *Iterator) SeekLast() {
+	it.valid = true
+	it.deleted = false
+	it.prev = nil
+	it.curr = it.s.findLast(&it.s.Stats)
+}
+
+// SeekForPrev moves iterator to the provided item or the last item less than
+// the provided item.
+func (it *Iterator) SeekForPrev(itm unsafe.Pointer) bool {
+	it.valid = true
+	it.deleted = false
+	found := it.s.findPath(itm, it.cmp, it.buf, &it.s.Stats) != nil
+	if found {
+		it.prev = it.buf.preds[0]
+		it.curr = it.buf.succs[0]
+	} else {
+		it.prev = nil
+		it.curr = it.buf.preds[0]
+	}
+
+	return found
+}
+
 // Valid returns true when iterator reaches the end
 // If the specified item is not found, start with the predecessor node
 // This is used for implementing disk block based storage
 func (it *Iterator) Valid() bool {
-	if it.valid && it.curr == it.s.tail {
+	if it.valid && (it.curr == it.s.tail || it.curr == it.s.head) {
 		it.valid = false
 	}
 
@@ -147,6 +172,25 @@ retry:
 	}
 }
 
+// Prev moves iterator to the previous item
+func (it *Iterator) Prev() {
+	it.PrevWithCmp(it.cmp)
+}
+
+// PrevWithCmp moves iterator to the previous item by using a custom comparator
+// to locate the predecessor of the current item. The skiplist does not keep
+// backward links, hence the predecessor is found through a lookup.
+func (it *Iterator) PrevWithCmp(cmp CompareFn) {
+	it.deleted = false
+	if !it.Valid() {
+		return
+	}
+
+	it.s.findPath(it.curr.Item(), cmp, it.buf, &it.s.Stats)
+	it.prev = nil
+	it.curr = it.buf.preds[0]
+}
+
 // Close is a destructor
 func (it *Iterator) Close() {
 	it.s.barrier.Release(it.bs)
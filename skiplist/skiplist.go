@@ -242,6 +242,65 @@ retry:
 	return
 }
 
+// findLast returns the last node in the skiplist or the head node if the
+// skiplist is empty.
+func (s *Skiplist) findLast(sts *Stats) *Node {
+retry:
+	prev := s.head
+	level := int(atomic.LoadInt32(&s.level))
+	for i := level; i >= 0; i-- {
+		curr, _ := prev.getNext(i)
+		for curr != s.tail {
+			next, deleted := curr.getNext(i)
+			if deleted {
+				if !s.helpDelete(i, prev, curr, next, sts) {
+					sts.AddUint64(&sts.readConflicts, 1)
+					goto retry
+				}
+
+				curr, _ = prev.getNext(i)
+				continue
+			}
+
+			prev = curr
+			curr = next
+		}
+	}
+
+	return prev
+}
+
+// FindNode returns the first node which holds an item greater than or equal
+// to the lookup item and its predecessor at the bottom level. Nodes for which
+// skipItm returns true are ignored. A nil prev or curr is returned in place of
+// the skiplist head and tail nodes. The caller should hold an access barrier
+// session while using the returned nodes.
+func (s *Skiplist) FindNode(itm unsafe.Pointer, cmp CompareFn,
+	skipItm func(unsafe.Pointer) bool, buf *ActionBuffer, sts *Stats) (prev, curr *Node) {
+
+	s.findPath2(itm, cmp, skipItm, buf, sts)
+	if prev = buf.preds[0]; prev == s.head {
+		prev = nil
+	}
+
+	if curr = buf.succs[0]; curr == s.tail {
+		curr = nil
+	}
+
+	return
+}
+
+// NextNode returns the successor of a node at the bottom level or nil if the
+// node is the last node in the skiplist.
+func (s *Skiplist) NextNode(n *Node) *Node {
+	next, _ := n.getNext(0)
+	if next == s.tail {
+		return nil
+	}
+
+	return next
+}
+
 // Insert adds an item into the skiplist
 func (s *Skiplist) Insert(itm unsafe.Pointer, cmp CompareFn,
 	buf *ActionBuffer, sts *Stats) (success bool) {
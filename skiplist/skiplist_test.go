@@ -48,6 +48,173 @@ func TestInsert(t *testing.T) {
 	}
 }
 
+func intItem(v int) unsafe.Pointer {
+	itm := intKeyItem(v)
+	return unsafe.Pointer(&itm)
+}
+
+func itemInt(itm unsafe.Pointer) int {
+	return int(*(*intKeyItem)(itm))
+}
+
+func TestReverseIterator(t *testing.T) {
+	s := New()
+	cmp := CompareInt
+	buf := s.MakeBuf()
+	defer s.FreeBuf(buf)
+
+	itr := s.NewIterator(cmp, buf)
+	defer itr.Close()
+
+	if itr.SeekLast(); itr.Valid() {
+		t.Errorf("Expected no last item in an empty skiplist")
+	}
+
+	if s.findLast(&s.Stats) != s.head {
+		t.Errorf("Expected head node to be last in an empty skiplist")
+	}
+
+	n := 1000
+	for i := 0; i < n; i++ {
+		s.Insert(intItem(i*2), cmp, buf, &s.Stats)
+	}
+
+	// Deleted items at the end are skipped
+	for i := n - 10; i < n; i++ {
+		s.Delete(intItem(i*2), cmp, buf, &s.Stats)
+	}
+	n -= 10
+
+	if last := s.findLast(&s.Stats); itemInt(last.Item()) != (n-1)*2 {
+		t.Errorf("Expected last item %d, got %d", (n-1)*2, itemInt(last.Item()))
+	}
+
+	count := 0
+	for itr.SeekLast(); itr.Valid(); itr.Prev() {
+		if v := itemInt(itr.Get()); v != (n-1-count)*2 {
+			t.Errorf("Expected %d, got %d", (n-1-count)*2, v)
+		}
+		count++
+	}
+
+	if count != n {
+		t.Errorf("Expected count = %d, got %d", n, count)
+	}
+
+	// SeekForPrev positions at the item or the last item less than it
+	if !itr.SeekForPrev(intItem(100)) || itemInt(itr.Get()) != 100 {
+		t.Errorf("Expected to find 100")
+	}
+
+	if itr.SeekForPrev(intItem(101)) || !itr.Valid() || itemInt(itr.Get()) != 100 {
+		t.Errorf("Expected 100 as the item before 101")
+	}
+
+	if itr.Prev(); !itr.Valid() || itemInt(itr.Get()) != 98 {
+		t.Errorf("Expected 98 before 100")
+	}
+
+	if itr.SeekForPrev(intItem(n * 4)); !itr.Valid() || itemInt(itr.Get()) != (n-1)*2 {
+		t.Errorf("Expected last item before an item past the end")
+	}
+
+	if itr.SeekForPrev(intItem(-1)); itr.Valid() {
+		t.Errorf("Expected no item before the first item")
+	}
+
+	if itr.SeekForPrev(intItem(0)); !itr.Valid() || itemInt(itr.Get()) != 0 {
+		t.Errorf("Expected to find the first item")
+	}
+
+	if itr.Prev(); itr.Valid() {
+		t.Errorf("Expected no item before the first item")
+	}
+
+	// The predecessor is located using the custom comparator, which
+	// compares items by their tens
+	tensCmp := func(this, that unsafe.Pointer) int {
+		return itemInt(this)/10 - itemInt(that)/10
+	}
+
+	itr.SeekForPrev(intItem(56))
+	if itr.PrevWithCmp(tensCmp); !itr.Valid() || itemInt(itr.Get()) != 48 {
+		t.Errorf("Expected 48 as the item before the tens of 56")
+	}
+}
+
+func TestReverseIteratorConcurrent(t *testing.T) {
+	var wg sync.WaitGroup
+	s := New()
+	cmp := CompareInt
+	buf := s.MakeBuf()
+	defer s.FreeBuf(buf)
+
+	// Items which are multiples of 4 are deleted and odd items are
+	// inserted while iterating. Other items should always be found.
+	n := 20000
+	for i := 0; i < n; i += 2 {
+		s.Insert(intItem(i), cmp, buf, &s.Stats)
+	}
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		buf := s.MakeBuf()
+		defer s.FreeBuf(buf)
+		for i := 1; i < n; i += 2 {
+			s.Insert(intItem(i), cmp, buf, &s.Stats)
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+		buf := s.MakeBuf()
+		defer s.FreeBuf(buf)
+		for i := n - 4; i >= 0; i -= 4 {
+			s.Delete(intItem(i), cmp, buf, &s.Stats)
+		}
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	for iters := 0; ; iters++ {
+		select {
+		case <-done:
+			if iters > 0 {
+				return
+			}
+		default:
+		}
+
+		itr := s.NewIterator(cmp, buf)
+		prev := n
+		for itr.SeekLast(); itr.Valid(); itr.Prev() {
+			v := itemInt(itr.Get())
+			if v >= prev {
+				t.Fatalf("Expected items in descending order, got %d after %d", v, prev)
+			}
+
+			// Retained items between the previous item and this
+			// item should not be skipped
+			for x := prev - 1; x > v; x-- {
+				if x%4 == 2 {
+					t.Fatalf("Item %d was skipped", x)
+				}
+			}
+			prev = v
+		}
+		itr.Close()
+
+		if prev > 2 {
+			t.Fatalf("Expected iteration to reach the first items, stopped at %d", prev)
+		}
+	}
+}
+
 func doInsert(sl *Skiplist, wg *sync.WaitGroup, n int, isRand bool) {
 	defer wg.Done()
 	buf := sl.MakeBuf()
@@ -0,0 +1,400 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"runtime"
+	"sync"
+	"unsafe"
+
+	"github.com/t3rm1n4l/nitro/skiplist"
+)
+
+// Backup stream format
+// header: [4 byte magic][4 byte version][4 byte key comparator id][4 byte sn][4 byte shards]
+// frame:  [4 byte shard][4 byte payload len][4 byte crc32c][payload]
+// end:    [4 byte 0xffffffff][8 byte items count]
+//
+// A frame payload holds the items of a shard encoded with varint lengths.
+// Frames of different shards are interleaved in the stream, but the frames
+// of a shard are in key order.
+//
+// A frame is flushed once it reaches the frame size. Hence, a frame is larger
+// only if it ends with a large item. A stream backup fails with
+// ErrItemTooLarge if a frame would exceed the maximum frame size.
+//
+// Encrypted streams are written with version 2 and the header is followed by
+// a 4 byte key id. Their frame payloads are encrypted using the key and bound
+// to the shard and the frame number within the shard. The checksum covers the
+// encrypted payload.
+const (
+	streamMagic        = 0x4e545253
+	streamVersion      = 1
+	streamEncVersion   = 2
+	streamHdrSize      = 20
+	streamFrameHdrSize = 12
+	streamFrameSize    = 64 * 1024
+	streamMaxFrameSize = 64 * 1024 * 1024
+	streamMaxShards    = 1024
+	streamEndShard     = 0xffffffff
+)
+
+var (
+	// ErrInvalidStream means the backup stream is malformed or corrupted
+	ErrInvalidStream = errors.New("Invalid backup stream")
+
+	// ErrInvalidConcurrency means the concurrency is not a positive number
+	ErrInvalidConcurrency = errors.New("Concurrency should be positive")
+)
+
+type streamWriter struct {
+	sync.Mutex
+	w     *bufio.Writer
+	count uint64
+}
+
+func (sw *streamWriter) writeFrame(shard int, payload []byte) error {
+	var hdr [streamFrameHdrSize]byte
+	binary.BigEndian.PutUint32(hdr[0:4], uint32(shard))
+	binary.BigEndian.PutUint32(hdr[4:8], uint32(len(payload)))
+	binary.BigEndian.PutUint32(hdr[8:12], crc32.Checksum(payload, crc32cTable))
+
+	sw.Lock()
+	defer sw.Unlock()
+
+	if _, err := sw.w.Write(hdr[:]); err != nil {
+		return err
+	}
+
+	_, err := sw.w.Write(payload)
+	return err
+}
+
+// StoreToStream writes a backup of the snapshot into a single stream.
+// Items of the shards produced by the visitor are multiplexed into frames.
+// Like StoreToDisk, the snapshot is closed once the backup is complete.
+func (m *Nitro) StoreToStream(w io.Writer, snap *Snapshot, concurr int) error {
+	defer snap.Close()
+
+	if m.useMemoryMgmt {
+		m.shutdownWg1.Add(1)
+		defer m.shutdownWg1.Done()
+	}
+
+	if concurr <= 0 {
+		return ErrInvalidConcurrency
+	}
+
+	shards := runtime.NumCPU()
+	if shards > streamMaxShards {
+		shards = streamMaxShards
+	}
+
+	sw := &streamWriter{w: bufio.NewWriterSize(w, DiskBlockSize)}
+
+	var hdr [streamHdrSize + 4]byte
+	hdrSize, version := streamHdrSize, uint32(streamVersion)
+	var keyID uint32
+	if m.crypt != nil {
+		var err error
+		if keyID, err = m.crypt.currentKey(); err != nil {
+			return err
+		}
+		binary.BigEndian.PutUint32(hdr[20:24], keyID)
+		hdrSize, version = streamHdrSize+4, streamEncVersion
+	}
+
+	binary.BigEndian.PutUint32(hdr[0:4], streamMagic)
+	binary.BigEndian.PutUint32(hdr[4:8], version)
+	binary.BigEndian.PutUint32(hdr[8:12], m.keyCmpID)
+	binary.BigEndian.PutUint32(hdr[12:16], snap.sn)
+	binary.BigEndian.PutUint32(hdr[16:20], uint32(shards))
+	if _, err := sw.w.Write(hdr[:hdrSize]); err != nil {
+		return err
+	}
+
+	bufs := make([]bytes.Buffer, shards)
+	counts := make([]uint64, shards)
+	frames := make([]int64, shards)
+	encBufs := make([][]byte, shards)
+	sealBufs := make([][]byte, shards)
+	for i := range encBufs {
+		encBufs[i] = make([]byte, varintEncodeBufSize)
+	}
+
+	flush := func(shard int) error {
+		payload := bufs[shard].Bytes()
+		if m.crypt != nil {
+			var ad [12]byte
+			var err error
+			sealBufs[shard], err = m.crypt.seal(sealBufs[shard][:0], keyID, payload,
+				locationAD(ad[:], shard, frames[shard]))
+			if err != nil {
+				return err
+			}
+			payload = sealBufs[shard]
+		}
+
+		frames[shard]++
+		if err := sw.writeFrame(shard, payload); err != nil {
+			return err
+		}
+
+		bufs[shard].Reset()
+		return nil
+	}
+
+	visitorCallback := func(itm *Item, shard int) error {
+		if m.hasShutdown {
+			return ErrShutdown
+		}
+
+		buf := &bufs[shard]
+		if err := m.encodeItemVarint(itm, encBufs[shard], buf); err != nil {
+			return err
+		}
+		counts[shard]++
+
+		if buf.Len() > streamMaxFrameSize {
+			return ErrItemTooLarge
+		}
+
+		if buf.Len() >= streamFrameSize {
+			return flush(shard)
+		}
+
+		return nil
+	}
+
+	if err := m.Visitor(snap, visitorCallback, shards, concurr); err != nil {
+		return err
+	}
+
+	for shard := range bufs {
+		if bufs[shard].Len() > 0 {
+			if err := flush(shard); err != nil {
+				return err
+			}
+		}
+		sw.count += counts[shard]
+	}
+
+	var end [12]byte
+	binary.BigEndian.PutUint32(end[0:4], streamEndShard)
+	binary.BigEndian.PutUint64(end[4:12], sw.count)
+	if _, err := sw.w.Write(end[:]); err != nil {
+		return err
+	}
+
+	return sw.w.Flush()
+}
+
+// LoadFromStream restores a backup written by StoreToStream. The frames of
+// every shard are decoded by a worker and added to a skiplist builder segment.
+func (m *Nitro) LoadFromStream(r io.Reader, concurr int) (*Snapshot, error) {
+	var wg sync.WaitGroup
+
+	if concurr <= 0 {
+		return nil, ErrInvalidConcurrency
+	}
+
+	br := bufio.NewReaderSize(r, DiskBlockSize)
+
+	var hdr [streamHdrSize]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		return nil, err
+	}
+
+	if binary.BigEndian.Uint32(hdr[0:4]) != streamMagic {
+		return nil, ErrInvalidStream
+	}
+
+	var encrypted bool
+	switch v := binary.BigEndian.Uint32(hdr[4:8]); v {
+	case streamVersion:
+	case streamEncVersion:
+		var kid [4]byte
+		if _, err := io.ReadFull(br, kid[:]); err != nil {
+			return nil, err
+		}
+
+		if m.crypt == nil {
+			return nil, fmt.Errorf("Backup stream is encrypted with key %d", binary.BigEndian.Uint32(kid[:]))
+		}
+		encrypted = true
+	default:
+		return nil, fmt.Errorf("Unsupported backup stream version %d", v)
+	}
+
+	if binary.BigEndian.Uint32(hdr[8:12]) != m.keyCmpID {
+		return nil, ErrComparatorMismatch
+	}
+
+	sn := binary.BigEndian.Uint32(hdr[12:16])
+	shards := int(binary.BigEndian.Uint32(hdr[16:20]))
+	if shards == 0 || shards > streamMaxShards {
+		return nil, ErrInvalidStream
+	}
+
+	maxFrameSize := uint32(streamMaxFrameSize)
+	if encrypted {
+		maxFrameSize += encryptionOverhead
+	}
+
+	b := skiplist.NewBuilderWithConfig(m.newStoreConfig())
+	b.SetItemSizeFunc(ItemSize)
+	segments := make([]*skiplist.Segment, shards)
+	counts := make([]uint64, shards)
+	frames := make([]int64, shards)
+	errors := make([]error, shards)
+	for i := range segments {
+		segments[i] = b.NewSegment()
+	}
+
+	// Frames of a shard are always decoded by the same worker to retain
+	// the order of items in the segment
+	type frame struct {
+		shard   int
+		payload []byte
+	}
+
+	fchans := make([]chan frame, concurr)
+	for i := range fchans {
+		fchans[i] = make(chan frame, 1)
+		wg.Add(1)
+		go func(wg *sync.WaitGroup, fchan chan frame) {
+			defer wg.Done()
+
+			for f := range fchan {
+				if errors[f.shard] != nil {
+					continue
+				}
+
+				payload := f.payload
+				if encrypted {
+					var ad [12]byte
+					var err error
+					payload, err = m.crypt.open(nil, payload, locationAD(ad[:], f.shard, frames[f.shard]))
+					if err != nil {
+						if err == errDecryptionFailed {
+							err = ErrInvalidStream
+						}
+						errors[f.shard] = err
+						continue
+					}
+				}
+				frames[f.shard]++
+
+				pr := bytes.NewReader(payload)
+				for pr.Len() > 0 {
+					itm, err := m.decodeItemVarint(pr)
+					if err != nil || itm == nil {
+						errors[f.shard] = ErrInvalidStream
+						break
+					}
+
+					segments[f.shard].Add(unsafe.Pointer(itm))
+					counts[f.shard]++
+				}
+			}
+		}(&wg, fchans[i])
+	}
+
+	readFrames := func() (uint64, error) {
+		var fhdr [streamFrameHdrSize]byte
+		for {
+			if _, err := io.ReadFull(br, fhdr[0:4]); err != nil {
+				return 0, err
+			}
+
+			shard := binary.BigEndian.Uint32(fhdr[0:4])
+			if shard == streamEndShard {
+				var end [8]byte
+				if _, err := io.ReadFull(br, end[:]); err != nil {
+					return 0, err
+				}
+
+				return binary.BigEndian.Uint64(end[:]), nil
+			}
+
+			if int(shard) >= shards {
+				return 0, ErrInvalidStream
+			}
+
+			if _, err := io.ReadFull(br, fhdr[4:12]); err != nil {
+				return 0, err
+			}
+
+			// The length is checked before the allocation since the
+			// checksum can be verified only after reading the payload
+			l := binary.BigEndian.Uint32(fhdr[4:8])
+			if l > maxFrameSize {
+				return 0, ErrInvalidStream
+			}
+
+			payload := make([]byte, l)
+			if _, err := io.ReadFull(br, payload); err != nil {
+				return 0, err
+			}
+
+			if crc32.Checksum(payload, crc32cTable) != binary.BigEndian.Uint32(fhdr[8:12]) {
+				return 0, ErrInvalidStream
+			}
+
+			fchans[int(shard)%concurr] <- frame{shard: int(shard), payload: payload}
+		}
+	}
+
+	count, err := readFrames()
+	for _, fchan := range fchans {
+		close(fchan)
+	}
+	wg.Wait()
+
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var total uint64
+	for shard, err := range errors {
+		if err != nil {
+			return nil, err
+		}
+		total += counts[shard]
+	}
+
+	if total != count {
+		return nil, ErrInvalidStream
+	}
+
+	m.store = b.Assemble(segments...)
+	stats := m.store.GetStats()
+	m.itemsCount = int64(stats.NodeCount)
+
+	if m.wal != nil {
+		if err := m.replayWAL(sn, math.MaxUint32); err != nil {
+			return nil, err
+		}
+	}
+
+	return m.NewSnapshot()
+}
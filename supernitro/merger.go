@@ -7,9 +7,10 @@ import (
 )
 
 type Iterator struct {
-	iters []*nitro.Iterator
-	h     itmHeap
-	curr  []byte
+	iters   []*nitro.Iterator
+	h       itmHeap
+	curr    []byte
+	currVal []byte
 }
 
 func newMergeIterator(iters []*nitro.Iterator) *Iterator {
@@ -19,33 +20,44 @@ func newMergeIterator(iters []*nitro.Iterator) *Iterator {
 type itmVal struct {
 	iter *nitro.Iterator
 	itm  []byte
+	val  []byte
 	prio int
 }
 
-type itmHeap []itmVal
+// itmHeap orders items in ascending order of keys or in descending order
+// for reverse iteration. Items from lower priority value iterators (newer
+// stores) come first for the same key.
+type itmHeap struct {
+	vals    []itmVal
+	reverse bool
+}
+
+func (h *itmHeap) Len() int { return len(h.vals) }
 
-func (h itmHeap) Len() int { return len(h) }
+func (h *itmHeap) Less(i, j int) bool {
+	val := bytes.Compare(h.vals[i].itm, h.vals[j].itm)
+	if val == 0 {
+		return h.vals[i].prio < h.vals[j].prio
+	}
 
-func (h itmHeap) Less(i, j int) bool {
-	val := bytes.Compare(h[i].itm, h[j].itm)
-	if val == 0 && h[i].prio-h[j].prio < 0 {
-		return true
+	if h.reverse {
+		return val > 0
 	}
 
 	return val < 0
 }
 
-func (h itmHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *itmHeap) Swap(i, j int) { h.vals[i], h.vals[j] = h.vals[j], h.vals[i] }
 
 func (h *itmHeap) Push(x interface{}) {
-	*h = append(*h, x.(itmVal))
+	h.vals = append(h.vals, x.(itmVal))
 }
 
 func (h *itmHeap) Pop() interface{} {
-	old := *h
+	old := h.vals
 	n := len(old)
 	x := old[n-1]
-	*h = old[0 : n-1]
+	h.vals = old[0 : n-1]
 	return x
 }
 
@@ -54,22 +66,43 @@ func (it *Iterator) SeekFirst() {
 }
 
 func (it *Iterator) Seek(itm []byte) {
-	it.curr = nil
-	it.h = nil
-	for prio, subIt := range it.iters {
+	it.init(false, func(subIt *nitro.Iterator) {
 		if itm == nil {
 			subIt.SeekFirst()
 		} else {
 			subIt.Seek(itm)
 		}
+	})
+}
+
+func (it *Iterator) SeekLast() {
+	it.SeekForPrev(nil)
+}
+
+func (it *Iterator) SeekForPrev(itm []byte) {
+	it.init(true, func(subIt *nitro.Iterator) {
+		if itm == nil {
+			subIt.SeekLast()
+		} else {
+			subIt.SeekForPrev(itm)
+		}
+	})
+}
+
+func (it *Iterator) init(reverse bool, seek func(*nitro.Iterator)) {
+	it.curr = nil
+	it.h = itmHeap{reverse: reverse}
+	for prio, subIt := range it.iters {
+		seek(subIt)
 		if subIt.Valid() {
 			itm := append([]byte(nil), subIt.Get()...)
-			it.h = append(it.h, itmVal{iter: subIt, itm: itm, prio: prio})
+			val := append([]byte(nil), subIt.Value()...)
+			it.h.vals = append(it.h.vals, itmVal{iter: subIt, itm: itm, val: val, prio: prio})
 		}
 	}
 
 	heap.Init(&it.h)
-	it.Next()
+	it.advance()
 }
 
 func (it *Iterator) Valid() bool {
@@ -80,30 +113,66 @@ func (it *Iterator) Get() []byte {
 	return it.curr
 }
 
+func (it *Iterator) Value() []byte {
+	return it.currVal
+}
+
 func (it *Iterator) Next() {
-	var next []byte
-	for next = it.next(); it.curr != nil && bytes.Equal(next, it.curr); next = it.next() {
+	if it.h.reverse && it.curr != nil {
+		// Change of direction. Position all iterators after current item
+		curr := it.curr
+		if it.Seek(curr); it.curr != nil && bytes.Equal(it.curr, curr) {
+			it.advance()
+		}
+		return
+	}
+
+	it.advance()
+}
+
+func (it *Iterator) Prev() {
+	if !it.h.reverse && it.curr != nil {
+		// Change of direction. Position all iterators before current item
+		curr := it.curr
+		if it.SeekForPrev(curr); it.curr != nil && bytes.Equal(it.curr, curr) {
+			it.advance()
+		}
+		return
+	}
+
+	it.advance()
+}
+
+func (it *Iterator) advance() {
+	var next, nextVal []byte
+	for next, nextVal = it.next(); it.curr != nil && bytes.Equal(next, it.curr); next, nextVal = it.next() {
 	}
 
 	it.curr = next
+	it.currVal = nextVal
 }
 
-func (it *Iterator) next() []byte {
+func (it *Iterator) next() ([]byte, []byte) {
 	if it.h.Len() == 0 {
-		return nil
+		return nil, nil
 	}
 
 	o := heap.Pop(&it.h)
 	hi := o.(itmVal)
-	curr := hi.itm
-	hi.iter.Next()
+	curr, currVal := hi.itm, hi.val
+	if it.h.reverse {
+		hi.iter.Prev()
+	} else {
+		hi.iter.Next()
+	}
 	if hi.iter.Valid() {
 		// Make explicit copy. Iterator may share the buffer
 		hi.itm = append([]byte(nil), hi.iter.Get()...)
+		hi.val = append([]byte(nil), hi.iter.Value()...)
 		heap.Push(&it.h, hi)
 	}
 
-	return curr
+	return curr, currVal
 }
 
 func (it *Iterator) Close() {
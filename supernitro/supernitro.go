@@ -93,6 +93,22 @@ func (m *SuperNitro) NewIterator(snap *Snapshot) *Iterator {
 	return newMergeIterator(iters)
 }
 
+func (m *SuperNitro) NewRangeIterator(snap *Snapshot, lo, hi []byte, opts nitro.RangeOptions) *Iterator {
+	var iters []*nitro.Iterator
+	for _, snap := range snap.snaps {
+		iters = append(iters, snap.NewRangeIterator(lo, hi, opts))
+	}
+	return newMergeIterator(iters)
+}
+
+func (m *SuperNitro) NewPrefixIterator(snap *Snapshot, prefix []byte) *Iterator {
+	var iters []*nitro.Iterator
+	for _, snap := range snap.snaps {
+		iters = append(iters, snap.NewPrefixIterator(prefix))
+	}
+	return newMergeIterator(iters)
+}
+
 func (m *SuperNitro) execMerge(msnap *nitro.Snapshot, store *nitro.Nitro) {
 	fmt.Println("execMerge")
 	go func() {
@@ -207,6 +223,10 @@ func (w *Writer) Put(bs []byte) bool {
 	return w.mw.Put2(bs) != nil
 }
 
+func (w *Writer) Set(key, value []byte) {
+	w.mw.Set(key, value)
+}
+
 func (w *Writer) Delete(bs []byte) bool {
 	return w.mw.DeleteNonExist(bs)
 }
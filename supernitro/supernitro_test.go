@@ -9,6 +9,8 @@ import (
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/t3rm1n4l/nitro"
 )
 
 /*
@@ -272,3 +274,81 @@ func TestSimpleGet(t *testing.T) {
 		}
 	}
 }
+
+func TestMergeIteratorReverse(t *testing.T) {
+	var iters []*nitro.Iterator
+	var expected []string
+	for x := 0; x < 3; x++ {
+		db := nitro.New()
+		defer db.Close()
+		w := db.NewWriter()
+		for i := x; i < 3000; i += x + 1 {
+			w.Put([]byte(fmt.Sprintf("%010d", i)))
+		}
+		snap, _ := db.NewSnapshot()
+		defer snap.Close()
+		iters = append(iters, snap.NewIterator())
+	}
+
+	it := newMergeIterator(iters)
+	defer it.Close()
+	for it.SeekFirst(); it.Valid(); it.Next() {
+		expected = append(expected, string(it.Get()))
+	}
+
+	i := len(expected) - 1
+	for it.SeekLast(); it.Valid(); it.Prev() {
+		if string(it.Get()) != expected[i] {
+			t.Fatalf("Expected %s, got %s", expected[i], it.Get())
+		}
+		i--
+	}
+
+	if i != -1 {
+		t.Errorf("Expected %d items in reverse scan", len(expected))
+	}
+
+	it.SeekForPrev([]byte(expected[100] + "a"))
+	if string(it.Get()) != expected[100] {
+		t.Errorf("Expected %s, got %s", expected[100], it.Get())
+	}
+
+	it.Next()
+	if string(it.Get()) != expected[101] {
+		t.Errorf("Expected %s, got %s", expected[101], it.Get())
+	}
+
+	it.Prev()
+	if string(it.Get()) != expected[100] {
+		t.Errorf("Expected %s, got %s", expected[100], it.Get())
+	}
+}
+
+func TestMergeRangeIterator(t *testing.T) {
+	var iters []*nitro.Iterator
+	for x := 0; x < 3; x++ {
+		db := nitro.New()
+		defer db.Close()
+		w := db.NewWriter()
+		for i := x; i < 3000; i += 3 {
+			w.Put([]byte(fmt.Sprintf("%010d", i)))
+		}
+		snap, _ := db.NewSnapshot()
+		defer snap.Close()
+		iters = append(iters, snap.NewPrefixIterator([]byte("000000012")))
+	}
+
+	it := newMergeIterator(iters)
+	defer it.Close()
+	i := 120
+	for it.SeekFirst(); it.Valid(); it.Next() {
+		if exp := fmt.Sprintf("%010d", i); string(it.Get()) != exp {
+			t.Fatalf("Expected %s, got %s", exp, it.Get())
+		}
+		i++
+	}
+
+	if i != 130 {
+		t.Errorf("Expected 10 items, got %d", i-120)
+	}
+}
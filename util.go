@@ -32,7 +32,7 @@ func (m *Nitro) partitionPivots(snap *Snapshot, nsplits int) []*Item {
 	pivotPtrs := m.store.GetRangeSplitItems(nsplits)
 	for _, itmPtr := range pivotPtrs {
 		itm := m.ptrToItem(itmPtr)
-		tmpIter.Seek(itm.Bytes())
+		tmpIter.Seek(itm.Key())
 		if tmpIter.Valid() {
 			prevItm := pivotItems[len(pivotItems)-1]
 			// Find bigger item than prev pivot
@@ -0,0 +1,252 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// BackupReport is the result of a backup verification
+type BackupReport struct {
+	Manifest *BackupManifest
+
+	// Items found in the data, deletes and delta files
+	ItemsCount   int64
+	DeletesCount int64
+	DeltaCount   int64
+
+	Problems []string
+}
+
+// OK returns true if no problems were found in the backup
+func (r *BackupReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+func (r *BackupReport) addProblem(format string, args ...interface{}) {
+	r.Problems = append(r.Problems, fmt.Sprintf(format, args...))
+}
+
+// newBackupReader returns an instance which can decode the backup files.
+// Items are allocated from the go heap. Encrypted backup files can be decoded
+// only if the key provider is given.
+func newBackupReader(manifest *BackupManifest, kp KeyProvider) *Nitro {
+	m := &Nitro{}
+	m.fileType = manifest.FileType
+	m.keyCmpID = manifest.KeyComparatorID
+	if kp != nil {
+		m.crypt = newEncryptor(kp)
+	}
+	return m
+}
+
+// backupFiles returns the names of the backup files in a backup directory
+func backupFiles(store BackupStore, dir string) ([]string, error) {
+	var files []string
+	bs, err := readObject(store, dir+"/files.json")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(bs, &files); err != nil {
+		return nil, fmt.Errorf("Invalid %s/files.json (%v)", dir, err)
+	}
+
+	for i, file := range files {
+		files[i] = dir + "/" + file
+	}
+
+	return files, nil
+}
+
+// VisitBackup calls fn for every item of a backup in the order of the
+// backup files. Items of the data files are followed by the delta files.
+func VisitBackup(store BackupStore, fn func(file string, itm *Item) error) error {
+	return VisitEncryptedBackup(store, nil, fn)
+}
+
+// VisitEncryptedBackup is VisitBackup for a backup encrypted using the keys
+// of the key provider
+func VisitEncryptedBackup(store BackupStore, kp KeyProvider, fn func(file string, itm *Item) error) error {
+	manifest, err := ReadBackupManifest(store)
+	if err != nil {
+		return err
+	}
+
+	dirs := []string{"data"}
+	if manifest.Incremental {
+		dirs = append(dirs, "deletes")
+	} else if manifest.DeltaInterleaving {
+		dirs = append(dirs, "delta")
+	}
+
+	m := newBackupReader(manifest, kp)
+	for _, dir := range dirs {
+		files, err := backupFiles(store, dir)
+		if err != nil {
+			return err
+		}
+
+		for _, file := range files {
+			if err := m.visitBackupFile(store, file, fn); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (m *Nitro) visitBackupFile(store BackupStore, file string, fn func(string, *Item) error) error {
+	r := m.newFileReader(m.fileType)
+	if err := r.Open(store, file); err != nil {
+		return err
+	}
+	defer r.Close()
+
+	for {
+		itm, err := r.ReadItem()
+		if err != nil {
+			return err
+		}
+
+		if itm == nil {
+			return nil
+		}
+
+		if err := fn(file, itm); err != nil {
+			return err
+		}
+	}
+}
+
+// VerifyBackup checks a disk backup without restoring it. The key comparator
+// should be the one used by the Nitro instance which took the backup. If cmp
+// is nil, the default key comparator is used.
+func VerifyBackup(dir string, cmp KeyCompare) (*BackupReport, error) {
+	return VerifyBackupStore(NewDirBackupStore(dir), cmp)
+}
+
+// VerifyBackupStore checks a backup in a backup store. An error is returned
+// if the backup cannot be verified at all. Otherwise, the problems found are
+// listed in the report.
+//
+// The sizes and checksums of the backup files are compared with the manifest.
+// Items of data and deletes files should be sorted and unique within a file
+// and across the files. Items of delta files are only decoded.
+func VerifyBackupStore(store BackupStore, cmp KeyCompare) (*BackupReport, error) {
+	return VerifyEncryptedBackupStore(store, cmp, nil)
+}
+
+// VerifyEncryptedBackupStore is VerifyBackupStore for a backup encrypted using
+// the keys of the key provider. The items of encrypted backup files are
+// decrypted and checked like the items of plain backup files.
+func VerifyEncryptedBackupStore(store BackupStore, cmp KeyCompare, kp KeyProvider) (*BackupReport, error) {
+	if cmp == nil {
+		cmp = defaultKeyCmp
+	}
+
+	manifest, err := ReadBackupManifest(store)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &BackupReport{Manifest: manifest}
+	for _, fi := range manifest.Files {
+		if err := verifyBackupFile(store, fi); err != nil {
+			report.addProblem("%s: %v", fi.Name, err)
+		}
+	}
+
+	m := newBackupReader(manifest, kp)
+	verifyDir := func(dir string, sorted bool) int64 {
+		var count int64
+		var prev []byte
+		var prevFile string
+
+		files, err := backupFiles(store, dir)
+		if err != nil {
+			report.addProblem("%s: %v", dir, err)
+			return 0
+		}
+
+		for _, file := range files {
+			err := m.visitBackupFile(store, file, func(file string, itm *Item) error {
+				count++
+				if !sorted {
+					return nil
+				}
+
+				key := itm.Key()
+				if prev != nil && cmp(prev, key) >= 0 {
+					if prevFile == file {
+						report.addProblem("%s: item %d is out of order", file, count)
+					} else {
+						report.addProblem("%s: first item overlaps with %s", file, prevFile)
+					}
+				}
+
+				prev = append(prev[:0], key...)
+				prevFile = file
+				return nil
+			})
+
+			if err != nil {
+				report.addProblem("%s: %v", file, err)
+			}
+		}
+
+		return count
+	}
+
+	report.ItemsCount = verifyDir("data", true)
+	if !manifest.Legacy() && report.ItemsCount != manifest.ItemsCount {
+		report.addProblem("data: found %d items, expected %d", report.ItemsCount, manifest.ItemsCount)
+	}
+
+	if manifest.Incremental {
+		report.DeletesCount = verifyDir("deletes", true)
+		if report.DeletesCount != manifest.DeletesCount {
+			report.addProblem("deletes: found %d items, expected %d",
+				report.DeletesCount, manifest.DeletesCount)
+		}
+	} else if manifest.DeltaInterleaving {
+		report.DeltaCount = verifyDir("delta", false)
+	}
+
+	return report, nil
+}
+
+func verifyBackupFile(store BackupStore, fi BackupFileInfo) error {
+	obj, err := store.Open(fi.Name)
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+
+	crc := crc32.New(crc32cTable)
+	size, err := io.Copy(crc, obj)
+	if err != nil {
+		return err
+	}
+
+	if size != fi.Size {
+		return fmt.Errorf("size %d does not match manifest size %d", size, fi.Size)
+	}
+
+	if crc.Sum32() != fi.Checksum {
+		return fmt.Errorf("checksum %08x does not match manifest checksum %08x", crc.Sum32(), fi.Checksum)
+	}
+
+	return nil
+}
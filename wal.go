@@ -0,0 +1,1004 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// WALSyncPolicy specifies when the write-ahead log records are synced to disk
+type WALSyncPolicy int
+
+const (
+	// WALSyncNone writes out the buffered records periodically and leaves
+	// syncing to the operating system.
+	WALSyncNone WALSyncPolicy = iota
+	// WALSyncPeriodic group commits the records of all writers by syncing
+	// the logs periodically.
+	WALSyncPeriodic
+	// WALSyncAlways syncs the log on every write.
+	WALSyncAlways
+)
+
+const (
+	defaultWALSyncInterval = 10 * time.Millisecond
+	walBufSize             = 256 * 1024
+	walRecordHdrSize       = 8
+	walRecordEncrypted     = 1 << 31
+	// Records hold an item and the operation, snapshot number and key length
+	walMaxRecordSize = maxItemSize + 1 + 4 + binary.MaxVarintLen64 + encryptionOverhead
+)
+
+type walOp uint8
+
+const (
+	walOpPut walOp = iota + 1
+	walOpSet
+	walOpDelete
+	walOpDeleteMarker
+	walOpSnapshot
+)
+
+const (
+	walLogPrefix      = "wal"
+	snapshotLogPrefix = "snap"
+	walTmpSuffix      = ".tmp"
+	walCompactFile    = "compact.json"
+)
+
+// ErrInvalidRestorePoint means the restore point is not covered by the
+// backups and the write-ahead log
+var ErrInvalidRestorePoint = errors.New("Restore point is not available")
+
+// RestorePoint selects the snapshot restored from a backup and the
+// write-ahead log. The zero value restores all the logged operations.
+type RestorePoint struct {
+	// Snapshot number to restore
+	Snapshot uint32
+	// Time restores the latest snapshot created at or before it
+	Time time.Time
+}
+
+func (p RestorePoint) isLatest() bool {
+	return p.Snapshot == 0 && p.Time.IsZero()
+}
+
+// Write-ahead log record format
+// [4 byte payload len][4 byte crc32][payload]
+// payload: [1 byte op][4 byte sn][uvarint key len][key][value]
+//
+// If encryption is enabled, the payload is encrypted using the key which was
+// current when the segment was started and the top bit of the payload length
+// is set. The checksum covers the encrypted payload.
+//
+// Snapshot records are written to separate snapshot log segments. The value
+// of a snapshot record is the creation time in unix nanoseconds.
+type walRecord struct {
+	op  walOp
+	sn  uint32
+	key []byte
+	val []byte
+}
+
+type walSegment struct {
+	path  string
+	maxSn uint32
+}
+
+// walManager owns the write-ahead log segments of a Nitro instance.
+// Every writer appends to its own log segment and a new segment is
+// started after each backup so that the segments covered by the backup
+// can be removed. The snapshot times are appended to a snapshot log.
+type walManager struct {
+	sync.Mutex
+	dir      string
+	policy   WALSyncPolicy
+	interval time.Duration
+	crypt    *encryptor
+	seq      uint64
+
+	logs   []*walLog
+	snaps  *walLog
+	sealed []walSegment
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+type walLog struct {
+	sync.Mutex
+	mgr    *walManager
+	prefix string
+	path   string
+	fd     *os.File
+	w      *bufio.Writer
+	buf    []byte
+	ebuf   []byte
+	keyID  uint32
+	maxSn  uint32
+	dirty  bool
+	tmp    bool
+	err    error
+}
+
+func newWALManager(dir string, policy WALSyncPolicy, interval time.Duration,
+	crypt *encryptor) (*walManager, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	mgr := &walManager{
+		dir:      dir,
+		policy:   policy,
+		interval: interval,
+		crypt:    crypt,
+		stop:     make(chan struct{}),
+	}
+
+	if mgr.interval <= 0 {
+		mgr.interval = defaultWALSyncInterval
+	}
+
+	if err := mgr.recoverCompaction(); err != nil {
+		return nil, err
+	}
+
+	// Continue segment numbering after the existing segments
+	for _, prefix := range []string{walLogPrefix, snapshotLogPrefix} {
+		segs, err := mgr.listSegments(prefix)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, seg := range segs {
+			var seq uint64
+			if _, err := fmt.Sscanf(filepath.Base(seg), prefix+"-%d.log", &seq); err == nil && seq > mgr.seq {
+				mgr.seq = seq
+			}
+		}
+	}
+
+	mgr.snaps = mgr.newLogWithPrefix(snapshotLogPrefix)
+
+	if mgr.policy != WALSyncAlways {
+		mgr.wg.Add(1)
+		go mgr.syncWorker()
+	}
+
+	return mgr, nil
+}
+
+func (mgr *walManager) listSegments(prefix string) ([]string, error) {
+	segs, err := filepath.Glob(filepath.Join(mgr.dir, prefix+"-*.log"))
+	sort.Strings(segs)
+	return segs, err
+}
+
+func (mgr *walManager) newLog() *walLog {
+	return mgr.newLogWithPrefix(walLogPrefix)
+}
+
+func (mgr *walManager) newLogWithPrefix(prefix string) *walLog {
+	mgr.Lock()
+	defer mgr.Unlock()
+
+	l := &walLog{mgr: mgr, prefix: prefix}
+	mgr.logs = append(mgr.logs, l)
+	return l
+}
+
+// closeLog seals the log and stops syncing it
+func (mgr *walManager) closeLog(l *walLog) error {
+	mgr.Lock()
+	defer mgr.Unlock()
+
+	for i, x := range mgr.logs {
+		if x == l {
+			mgr.logs = append(mgr.logs[:i], mgr.logs[i+1:]...)
+			break
+		}
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	return l.seal()
+}
+
+func (mgr *walManager) nextSegment(prefix string) string {
+	seq := atomic.AddUint64(&mgr.seq, 1)
+	return filepath.Join(mgr.dir, fmt.Sprintf("%s-%016d.log", prefix, seq))
+}
+
+// logSnapshot records the creation time of a snapshot. A failure only loses
+// the restore point and not the logged operations. Hence, it is not returned
+// to the snapshot creator.
+func (mgr *walManager) logSnapshot(sn uint32, t time.Time) {
+	var val [8]byte
+	binary.BigEndian.PutUint64(val[:], uint64(t.UnixNano()))
+	mgr.snaps.append(walOpSnapshot, sn, nil, val[:])
+}
+
+// restorePoints returns the snapshots recorded in the snapshot log in the
+// order of snapshot numbers
+func (mgr *walManager) restorePoints() ([]RestorePoint, error) {
+	var points []RestorePoint
+	segs, err := mgr.listSegments(snapshotLogPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, seg := range segs {
+		err := readWALSegment(seg, i, mgr.crypt, func(rec *walRecord) error {
+			if rec.op == walOpSnapshot && len(rec.val) == 8 {
+				t := time.Unix(0, int64(binary.BigEndian.Uint64(rec.val)))
+				points = append(points, RestorePoint{Snapshot: rec.sn, Time: t})
+			}
+			return nil
+		})
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Slice(points, func(i, j int) bool {
+		return points[i].Snapshot < points[j].Snapshot
+	})
+
+	return points, nil
+}
+
+func (mgr *walManager) syncWorker() {
+	defer mgr.wg.Done()
+
+	ticker := time.NewTicker(mgr.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-mgr.stop:
+			return
+		case <-ticker.C:
+			mgr.Lock()
+			for _, l := range mgr.logs {
+				l.Lock()
+				l.sync(mgr.policy == WALSyncPeriodic)
+				l.Unlock()
+			}
+			mgr.Unlock()
+		}
+	}
+}
+
+// truncate removes the log segments whose records are all covered by
+// a backup of snapshot sn. Active segments are sealed to allow the removal.
+func (mgr *walManager) truncate(sn uint32) error {
+	mgr.Lock()
+	defer mgr.Unlock()
+
+	for _, l := range mgr.logs {
+		l.Lock()
+		l.seal()
+		l.Unlock()
+	}
+
+	var err error
+	var sealed []walSegment
+	for _, seg := range mgr.sealed {
+		if seg.maxSn <= sn {
+			if rerr := os.Remove(seg.path); rerr != nil && !os.IsNotExist(rerr) {
+				err = rerr
+				sealed = append(sealed, seg)
+			}
+		} else {
+			sealed = append(sealed, seg)
+		}
+	}
+	mgr.sealed = sealed
+
+	return err
+}
+
+func (mgr *walManager) close() error {
+	close(mgr.stop)
+	mgr.wg.Wait()
+
+	mgr.Lock()
+	defer mgr.Unlock()
+
+	var err error
+	for _, l := range mgr.logs {
+		l.Lock()
+		if serr := l.seal(); serr != nil {
+			err = serr
+		}
+		l.Unlock()
+	}
+
+	return err
+}
+
+// append writes a record to the log. Once a write fails, the log is left
+// in an unknown state and the error is returned for all the later records.
+func (l *walLog) append(op walOp, sn uint32, key, val []byte) error {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.err != nil {
+		return l.err
+	}
+
+	if len(key)+len(val) > maxItemSize {
+		return ErrItemTooLarge
+	}
+
+	if l.fd == nil {
+		if l.mgr.crypt != nil {
+			keyID, err := l.mgr.crypt.currentKey()
+			if err != nil {
+				l.err = err
+				return err
+			}
+			l.keyID = keyID
+		}
+
+		path := l.mgr.nextSegment(l.prefix)
+		if l.tmp {
+			path += walTmpSuffix
+		}
+
+		fd, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			l.err = err
+			return err
+		}
+		l.path = path
+		l.fd = fd
+		l.w = bufio.NewWriterSize(fd, walBufSize)
+		l.maxSn = 0
+	}
+
+	rec := encodeWALRecord(l.buf[:0], op, sn, key, val)
+	l.buf = rec
+	if l.mgr.crypt != nil {
+		var err error
+		if rec, err = l.encrypt(rec); err != nil {
+			l.err = err
+			return err
+		}
+	}
+
+	if _, err := l.w.Write(rec); err != nil {
+		l.err = err
+		return err
+	}
+
+	l.dirty = true
+	if sn > l.maxSn {
+		l.maxSn = sn
+	}
+
+	if l.mgr.policy == WALSyncAlways {
+		return l.sync(true)
+	}
+
+	return nil
+}
+
+func (l *walLog) sync(fsync bool) error {
+	if l.fd != nil && l.dirty && l.err == nil {
+		if err := l.w.Flush(); err != nil {
+			l.err = err
+		} else if fsync {
+			l.err = l.fd.Sync()
+		}
+		l.dirty = false
+	}
+
+	return l.err
+}
+
+// seal closes the current segment of the log. The next append starts
+// a new segment.
+func (l *walLog) seal() error {
+	if l.fd == nil {
+		return l.err
+	}
+
+	l.mgr.sealed = append(l.mgr.sealed, walSegment{path: l.path, maxSn: l.maxSn})
+	return l.closeSegment()
+}
+
+// closeSegment syncs and closes the current segment of the log
+func (l *walLog) closeSegment() error {
+	l.sync(true)
+	if err := l.fd.Close(); err != nil && l.err == nil {
+		l.err = err
+	}
+
+	l.fd = nil
+	l.w = nil
+	return l.err
+}
+
+// Compaction of the log after a point-in-time restore replaces all the
+// segments. The compacted segments are written into temporary files and
+// the names of the replaced segments are committed into the compaction file.
+// Then, the temporary files are renamed and the replaced segments are
+// removed. A compaction interrupted after the commit is completed when the
+// log is reopened. Otherwise, the temporary files are removed.
+func (mgr *walManager) commitCompaction(replaced []string) error {
+	names := make([]string, len(replaced))
+	for i, seg := range replaced {
+		names[i] = filepath.Base(seg)
+	}
+
+	bs, err := json.Marshal(names)
+	if err != nil {
+		return err
+	}
+
+	store := &dirBackupStore{dir: mgr.dir}
+	if err := store.Commit(walCompactFile, bs); err != nil {
+		return err
+	}
+
+	return mgr.finishCompaction(names)
+}
+
+func (mgr *walManager) finishCompaction(replaced []string) error {
+	tmps, err := filepath.Glob(filepath.Join(mgr.dir, "*.log"+walTmpSuffix))
+	if err != nil {
+		return err
+	}
+
+	for _, tmp := range tmps {
+		if err := os.Rename(tmp, strings.TrimSuffix(tmp, walTmpSuffix)); err != nil {
+			return err
+		}
+	}
+
+	if err := syncDir(mgr.dir); err != nil {
+		return err
+	}
+
+	for _, name := range replaced {
+		if err := os.Remove(filepath.Join(mgr.dir, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if err := syncDir(mgr.dir); err != nil {
+		return err
+	}
+
+	if err := os.Remove(filepath.Join(mgr.dir, walCompactFile)); err != nil {
+		return err
+	}
+
+	return syncDir(mgr.dir)
+}
+
+// recoverCompaction completes a committed compaction or removes the
+// temporary files of an incomplete compaction
+func (mgr *walManager) recoverCompaction() error {
+	bs, err := ioutil.ReadFile(filepath.Join(mgr.dir, walCompactFile))
+	if err == nil {
+		var replaced []string
+		if err := json.Unmarshal(bs, &replaced); err != nil {
+			return fmt.Errorf("Invalid write-ahead log compaction file (%v)", err)
+		}
+
+		return mgr.finishCompaction(replaced)
+	}
+
+	if !os.IsNotExist(err) {
+		return err
+	}
+
+	tmps, err := filepath.Glob(filepath.Join(mgr.dir, "*.log"+walTmpSuffix))
+	if err != nil {
+		return err
+	}
+
+	for _, tmp := range tmps {
+		if err := os.Remove(tmp); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// encrypt returns the record with its payload encrypted
+func (l *walLog) encrypt(rec []byte) ([]byte, error) {
+	var err error
+	l.ebuf = append(l.ebuf[:0], rec[:walRecordHdrSize]...)
+	l.ebuf, err = l.mgr.crypt.seal(l.ebuf, l.keyID, rec[walRecordHdrSize:], nil)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := l.ebuf[walRecordHdrSize:]
+	binary.BigEndian.PutUint32(l.ebuf[0:4], uint32(len(payload))|walRecordEncrypted)
+	binary.BigEndian.PutUint32(l.ebuf[4:8], crc32.ChecksumIEEE(payload))
+	return l.ebuf, nil
+}
+
+func encodeWALRecord(buf []byte, op walOp, sn uint32, key, val []byte) []byte {
+	var hdr [walRecordHdrSize + 1 + 4 + binary.MaxVarintLen64]byte
+	n := walRecordHdrSize
+	hdr[n] = byte(op)
+	binary.BigEndian.PutUint32(hdr[n+1:n+5], sn)
+	n += 5
+	n += binary.PutUvarint(hdr[n:], uint64(len(key)))
+
+	buf = append(buf, hdr[:n]...)
+	buf = append(buf, key...)
+	buf = append(buf, val...)
+
+	payload := buf[walRecordHdrSize:]
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(payload))
+	return buf
+}
+
+type walReader struct {
+	fd    *os.File
+	r     *bufio.Reader
+	hdr   [walRecordHdrSize]byte
+	seq   int
+	crypt *encryptor
+	// Segment size and the offset of the next record
+	size int64
+	off  int64
+}
+
+func newWALReader(path string, seq int, crypt *encryptor) (*walReader, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+
+	return &walReader{fd: fd, r: bufio.NewReaderSize(fd, walBufSize), seq: seq, crypt: crypt,
+		size: fi.Size()}, nil
+}
+
+// next returns the next record from the log segment or nil at the end.
+// A torn record at the tail is treated as the end of the log since it could
+// not have been synced before a crash. A record is torn if it was not
+// written completely or if nothing but zeros follow it. Other invalid
+// records are reported as corruption.
+func (r *walReader) next() (*walRecord, error) {
+	off := r.off
+	if _, err := io.ReadFull(r.r, r.hdr[:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, nil
+		}
+		return nil, err
+	}
+	r.off += walRecordHdrSize
+
+	l := binary.BigEndian.Uint32(r.hdr[0:4])
+	encrypted := l&walRecordEncrypted != 0
+	l &^= walRecordEncrypted
+	if l > walMaxRecordSize {
+		return r.invalidRecord(off)
+	}
+
+	if int64(l) > r.size-r.off {
+		return nil, nil
+	}
+
+	payload := make([]byte, l)
+	if _, err := io.ReadFull(r.r, payload); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, nil
+		}
+		return nil, err
+	}
+	r.off += int64(l)
+
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(r.hdr[4:8]) {
+		return r.invalidRecord(off)
+	}
+
+	// A record with a valid checksum was written completely. Hence, a
+	// decryption failure is not a torn write.
+	if encrypted {
+		if r.crypt == nil {
+			return nil, fmt.Errorf("Write-ahead log %s is encrypted", r.fd.Name())
+		}
+
+		var err error
+		if payload, err = r.crypt.open(nil, payload, nil); err != nil {
+			if err == errDecryptionFailed {
+				err = fmt.Errorf("Write-ahead log %s record decryption failed", r.fd.Name())
+			}
+			return nil, err
+		}
+	}
+
+	if len(payload) < 5 {
+		return r.invalidRecord(off)
+	}
+
+	rec := &walRecord{op: walOp(payload[0]), sn: binary.BigEndian.Uint32(payload[1:5])}
+	klen, n := binary.Uvarint(payload[5:])
+	if n <= 0 || uint64(len(payload)-5-n) < klen {
+		return r.invalidRecord(off)
+	}
+
+	rec.key = payload[5+n : 5+n+int(klen)]
+	rec.val = payload[5+n+int(klen):]
+	return rec, nil
+}
+
+// invalidRecord returns the end of the log if the invalid record at offset
+// off is the last record of the segment or if it is followed by zeros, which
+// are left behind by writes which were not synced. Otherwise, the segment is
+// corrupted.
+func (r *walReader) invalidRecord(off int64) (*walRecord, error) {
+	for r.off < r.size {
+		b, err := r.r.ReadByte()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		if b != 0 {
+			return nil, fmt.Errorf("Write-ahead log %s is corrupted at offset %d", r.fd.Name(), off)
+		}
+		r.off++
+	}
+
+	return nil, nil
+}
+
+func (r *walReader) close() error {
+	return r.fd.Close()
+}
+
+func readWALSegment(path string, seq int, crypt *encryptor, fn func(*walRecord) error) error {
+	r, err := newWALReader(path, seq, crypt)
+	if err != nil {
+		return err
+	}
+	defer r.close()
+
+	for {
+		rec, err := r.next()
+		if err != nil || rec == nil {
+			return err
+		}
+
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+}
+
+type walHeapItem struct {
+	rec *walRecord
+	r   *walReader
+}
+
+// walHeap merges the records of log segments in the order of snapshot
+// numbers. Records of a segment are already in order.
+type walHeap []walHeapItem
+
+func (h walHeap) Len() int { return len(h) }
+
+func (h walHeap) Less(i, j int) bool {
+	if h[i].rec.sn == h[j].rec.sn {
+		return h[i].r.seq < h[j].r.seq
+	}
+	return h[i].rec.sn < h[j].rec.sn
+}
+
+func (h walHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *walHeap) Push(x interface{}) {
+	*h = append(*h, x.(walHeapItem))
+}
+
+func (h *walHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[0 : n-1]
+	return x
+}
+
+// replayWAL applies the log records newer than snapshot sn of the backup
+// up to the target snapshot. Snapshot numbering is continued after the
+// latest replayed snapshot.
+//
+// For a point-in-time restore, the replayed records are compacted into new
+// log segments and the records after the target are removed. Otherwise,
+// they would be replayed again along with the newer operations.
+func (m *Nitro) replayWAL(sn uint32, target uint32) error {
+	mgr := m.wal
+	segs, err := mgr.listSegments(walLogPrefix)
+	if err != nil {
+		return err
+	}
+
+	snapSegs, err := mgr.listSegments(snapshotLogPrefix)
+	if err != nil {
+		return err
+	}
+
+	var dl, sl *walLog
+	compact := target != math.MaxUint32
+	if compact {
+		dl = &walLog{mgr: mgr, prefix: walLogPrefix, tmp: true}
+		sl = &walLog{mgr: mgr, prefix: snapshotLogPrefix, tmp: true}
+	}
+
+	var h walHeap
+	readers := make([]*walReader, len(segs))
+	maxSns := make([]uint32, len(segs))
+	defer func() {
+		for _, r := range readers {
+			if r != nil {
+				r.close()
+			}
+		}
+	}()
+
+	for i, seg := range segs {
+		r, err := newWALReader(seg, i, mgr.crypt)
+		if err != nil {
+			return err
+		}
+		readers[i] = r
+
+		rec, err := r.next()
+		if err != nil {
+			return err
+		}
+
+		if rec != nil {
+			h = append(h, walHeapItem{rec: rec, r: r})
+		}
+	}
+
+	w := m.newRestoreWriter()
+	maxSn, lastSn := sn, uint32(0)
+	heap.Init(&h)
+	for h.Len() > 0 {
+		hi := heap.Pop(&h).(walHeapItem)
+		if rec := hi.rec; rec.sn > sn && rec.sn <= target {
+			// Keep the operations of different snapshot intervals in
+			// separate intervals. Otherwise, a deleted restored item
+			// collides with an item inserted again with the same key.
+			if lastSn != 0 && rec.sn != lastSn {
+				atomic.AddUint32(&m.currSn, 1)
+			}
+			lastSn = rec.sn
+
+			switch rec.op {
+			case walOpPut:
+				w.insert(rec.key, rec.val, true)
+			case walOpSet:
+				w.upsert(rec.key, rec.val)
+			case walOpDelete:
+				w.Delete(rec.key)
+			case walOpDeleteMarker:
+				w.DeleteNonExist(rec.key)
+			}
+
+			if compact {
+				if err := dl.append(rec.op, rec.sn, rec.key, rec.val); err != nil {
+					return err
+				}
+			}
+		}
+
+		if hi.rec.sn <= target {
+			if hi.rec.sn > maxSns[hi.r.seq] {
+				maxSns[hi.r.seq] = hi.rec.sn
+			}
+
+			if hi.rec.sn > maxSn {
+				maxSn = hi.rec.sn
+			}
+		}
+
+		rec, err := hi.r.next()
+		if err != nil {
+			return err
+		}
+
+		if rec != nil {
+			hi.rec = rec
+			heap.Push(&h, hi)
+		}
+	}
+
+	snapMaxSns := make([]uint32, len(snapSegs))
+	for i, seg := range snapSegs {
+		err := readWALSegment(seg, i, mgr.crypt, func(rec *walRecord) error {
+			if rec.sn <= target {
+				if rec.sn > snapMaxSns[i] {
+					snapMaxSns[i] = rec.sn
+				}
+
+				if compact {
+					return sl.append(rec.op, rec.sn, rec.key, rec.val)
+				}
+			}
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if maxSn+1 > m.getCurrSn() {
+		atomic.StoreUint32(&m.currSn, maxSn+1)
+	}
+
+	mgr.Lock()
+	defer mgr.Unlock()
+
+	if compact {
+		var compacted []walSegment
+		for _, l := range []*walLog{dl, sl} {
+			if l.fd != nil {
+				compacted = append(compacted, walSegment{
+					path:  strings.TrimSuffix(l.path, walTmpSuffix),
+					maxSn: l.maxSn,
+				})
+
+				if err := l.closeSegment(); err != nil {
+					return err
+				}
+			}
+		}
+
+		if err := mgr.commitCompaction(append(segs, snapSegs...)); err != nil {
+			return err
+		}
+
+		mgr.sealed = append(mgr.sealed, compacted...)
+		return nil
+	}
+
+	for i, seg := range segs {
+		mgr.sealed = append(mgr.sealed, walSegment{path: seg, maxSn: maxSns[i]})
+	}
+
+	for i, seg := range snapSegs {
+		mgr.sealed = append(mgr.sealed, walSegment{path: seg, maxSn: snapMaxSns[i]})
+	}
+
+	return nil
+}
+
+// RestorePoints returns the snapshots recorded in the write-ahead log in the
+// order of snapshot numbers. The latest backup along with the log can be
+// restored to any of these snapshots.
+func (m *Nitro) RestorePoints() ([]RestorePoint, error) {
+	if m.wal == nil {
+		return nil, nil
+	}
+
+	return m.wal.restorePoints()
+}
+
+// resolveRestorePoint returns the snapshot number of the restore point. The
+// snapshots of the backups and the snapshots recorded in the log are
+// available.
+func (m *Nitro) resolveRestorePoint(point RestorePoint, manifests []*BackupManifest) (uint32, error) {
+	if point.isLatest() {
+		return math.MaxUint32, nil
+	}
+
+	var points []RestorePoint
+	for _, manifest := range manifests {
+		points = append(points, RestorePoint{Snapshot: manifest.Snapshot, Time: manifest.SnapshotTime})
+	}
+
+	if m.wal != nil {
+		logged, err := m.wal.restorePoints()
+		if err != nil {
+			return 0, err
+		}
+		points = append(points, logged...)
+	}
+
+	base := manifests[0].Snapshot
+	target, found := base, false
+	for _, p := range points {
+		if p.Snapshot < base {
+			continue
+		}
+
+		if point.Snapshot != 0 {
+			found = found || p.Snapshot == point.Snapshot
+		} else if !p.Time.After(point.Time) {
+			found = true
+			if p.Snapshot > target {
+				target = p.Snapshot
+			}
+		}
+	}
+
+	if !found {
+		return 0, ErrInvalidRestorePoint
+	}
+
+	if point.Snapshot != 0 {
+		target = point.Snapshot
+	}
+
+	return target, nil
+}
+
+// Err returns the first write-ahead log error which failed an operation of
+// the writer. An operation is not applied if it cannot be logged. Unlike
+// SyncWAL, it does not flush the log.
+func (w *Writer) Err() error {
+	return w.walErr
+}
+
+// SyncWAL flushes and syncs the write-ahead log of the writer. It returns
+// the first error encountered while writing the log. Once the log cannot be
+// written, the later operations of the writer are not applied.
+func (w *Writer) SyncWAL() error {
+	if w.wal == nil {
+		return nil
+	}
+
+	w.wal.Lock()
+	defer w.wal.Unlock()
+	return w.wal.sync(true)
+}
+
+// logOp writes the operation to the write-ahead log before it is applied.
+// The operation should not be applied if it cannot be logged.
+func (w *Writer) logOp(op walOp, sn uint32, key, val []byte) error {
+	if w.wal != nil {
+		if err := w.wal.append(op, sn, key, val); err != nil {
+			if w.walErr == nil {
+				w.walErr = err
+			}
+			return err
+		}
+	}
+
+	return nil
+}